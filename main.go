@@ -23,10 +23,19 @@ func main() {
 
 const usage = `    X_CSI_SCALEIO_ENDPOINT
         Specifies the HTTP endpoint for the ScaleIO gateway. This parameter is
-        required when running the Controller service.
+        required when running the Controller service. Several endpoints, of
+        gateways of the same system, may be given as a comma-separated list.
 
         The default value is empty.
 
+    X_CSI_SCALEIO_ENDPOINTPOLICY
+        Specifies how the endpoint that serves a request is chosen when several
+        endpoints are given. With "failover", requests are sent to the first
+        endpoint that is up. With "roundrobin", requests are spread across the
+        endpoints that are up.
+
+        The default value is failover.
+
     X_CSI_SCALEIO_USER
         Specifies the user name when authenticating to the ScaleIO Gateway.
 
@@ -39,17 +48,69 @@ const usage = `    X_CSI_SCALEIO_ENDPOINT
 
         The default value is empty.
 
+    X_CSI_SCALEIO_USERFILE
+        Specifies the path of a file that the user name is read from, instead
+        of X_CSI_SCALEIO_USER. The file is reloaded when it changes.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_PASSWORDFILE
+        Specifies the path of a file that the password is read from, instead
+        of X_CSI_SCALEIO_PASSWORD. The file is reloaded when it changes, and
+        the previous password keeps being used until the new one is accepted
+        by the ScaleIO Gateway.
+
+        The default value is empty.
+
     X_CSI_SCALEIO_INSECURE
         Specifies that the ScaleIO Gateway's hostname and certificate chain
 	should not be verified.
 
         The default value is false.
 
+    X_CSI_SCALEIO_CACERTS
+        Specifies the path of a PEM file of the CA certificates that the
+        ScaleIO Gateway's certificate is verified with. The file is reloaded
+        when it changes.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_CLIENTCERT
+        Specifies the path of a PEM file of the client certificate presented
+        to the ScaleIO Gateway. The file is reloaded when it changes.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_CLIENTKEY
+        Specifies the path of a PEM file of the key of the client certificate
+        defined by X_CSI_SCALEIO_CLIENTCERT. The file is reloaded when it
+        changes.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_CERTPINS
+        Specifies a comma-separated list of the base64 encoded SHA-256 hashes
+        of the public keys accepted in the ScaleIO Gateway's certificate chain.
+        Pins may be prefixed by "sha256//", and are checked even when
+        X_CSI_SCALEIO_INSECURE is set.
+
+        The default value is empty.
+
     X_CSI_SCALEIO_SYSTEMNAME
         Specifies the name of the ScaleIO system to interact with.
 
         The default value is default.
 
+    X_CSI_SCALEIO_SYSTEMSFILE
+        Specifies the path of a JSON file that configures several ScaleIO
+        systems, and the Gateways used to manage them. When set, the
+        X_CSI_SCALEIO_ENDPOINT, X_CSI_SCALEIO_USER, X_CSI_SCALEIO_PASSWORD,
+        X_CSI_SCALEIO_INSECURE, X_CSI_SCALEIO_SYSTEMNAME,
+        X_CSI_SCALEIO_STORAGEPOOL, credentials files and TLS variables are
+        ignored.
+
+        The default value is empty.
+
     X_CSI_SCALEIO_SDCGUID
         Specifies the GUID of the SDC. This is only used by the Node Service,
         and removes a need for calling an external binary to retrieve the GUID.
@@ -61,4 +122,77 @@ const usage = `    X_CSI_SCALEIO_ENDPOINT
         Specifies whether thick provisiong should be used when creating volumes.
 
         The default value is false.
+
+    X_CSI_SCALEIO_STORAGEPOOL
+        Specifies the storage pool that volumes are created in when the
+        CreateVolume parameters name none. It may be "auto", to place volumes
+        in the storage pool with the most available capacity, or a
+        comma-separated list of candidate storage pools. When
+        X_CSI_SCALEIO_SYSTEMSFILE is set, the storagePool of each system is
+        used instead.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_VOLUMENAMEPREFIX
+        Specifies the prefix of the names of the ScaleIO volumes and snapshots
+        created by the plugin, of up to 10 letters, digits, '-' or '_'. The
+        names start with the prefix followed by '.'. CO names that are too
+        long, or that have other characters, are
+        shortened and suffixed with a hash of the CO name.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_VOLUMENAMETEMPLATE
+        Specifies the template of the names of the ScaleIO volumes created by
+        the plugin, such as "{cluster}-{namespace}-{pvcname}". Variables are
+        replaced by the volume create parameters of the same name. {name} is
+        the CO name, and {pvcname}, {namespace} and {pvname} are the
+        parameters set by the Kubernetes external provisioner. The expanded
+        template follows the X_CSI_SCALEIO_VOLUMENAMEPREFIX, and is suffixed
+        with a hash of the CO name.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_PREFIXEDVOLUMESONLY
+        Specifies whether the plugin only lists and deletes the volumes and
+        snapshots named with X_CSI_SCALEIO_VOLUMENAMEPREFIX, which must then
+        be set. This keeps the drivers of clusters that share a ScaleIO system
+        from managing each other's volumes.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_PROTECTIONDOMAINS
+        Specifies a comma-separated list of the names of the protection domains
+        whose SDSs are reachable from the node. This is only used by the Node
+        Service, which reports the protection domains as topology segments.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_OTLPENDPOINT
+        Specifies the OTLP/HTTP endpoint, such as "http://otel-collector:4318",
+        that the trace spans of RPCs and ScaleIO Gateway requests are exported
+        to, using the JSON encoding.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_TRACEFILE
+        Specifies the path of a file that trace spans are appended to, as OTLP
+        JSON, when X_CSI_SCALEIO_OTLPENDPOINT is not set. Tracing is disabled
+        when neither is set.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_AUDITFILE
+        Specifies the path of a file that a JSON audit record is appended to
+        for every operation that creates, deletes, maps, unmaps, mounts,
+        unmounts or expands a volume, snapshot or snapshot group.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_METRICSADDRESS
+        Specifies the address, such as ":9100", of an HTTP listener that serves
+        Prometheus metrics at /metrics. The metrics are not served when it is
+        not set.
+
+        The default value is empty.
 `
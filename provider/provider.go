@@ -1,7 +1,10 @@
 package provider
 
 import (
+	"context"
+
 	"github.com/rexray/gocsi"
+	"google.golang.org/grpc"
 
 	"github.com/thecodeteam/csi-scaleio/service"
 )
@@ -9,12 +12,18 @@ import (
 // New returns a new Mock Storage Plug-in Provider.
 func New() gocsi.StoragePluginProvider {
 	svc := service.New()
-	return &gocsi.StoragePlugin{
+	return &storagePlugin{&gocsi.StoragePlugin{
 		Controller:  svc,
 		Identity:    svc,
 		Node:        svc,
 		BeforeServe: svc.BeforeServe,
 
+		// Record the metrics of all RPCs, including those rejected by the
+		// GoCSI interceptors
+		Interceptors: []grpc.UnaryServerInterceptor{
+			service.MetricsInterceptor,
+		},
+
 		EnvVars: []string{
 			// Enable request validation
 			gocsi.EnvVarSpecReqValidation + "=true",
@@ -32,5 +41,24 @@ func New() gocsi.StoragePluginProvider {
 			//    * NodePublishVolumeRequest.PublishInfo
 			gocsi.EnvVarRequirePubVolInfo + "=false",
 		},
-	}
+	}}
+}
+
+// storagePlugin is a GoCSI storage plug-in that exports the trace spans
+// that are still buffered once the server is stopped, as the plug-in exits
+// right after
+type storagePlugin struct {
+	*gocsi.StoragePlugin
+}
+
+// GracefulStop implements gocsi.StoragePluginProvider
+func (sp *storagePlugin) GracefulStop(ctx context.Context) {
+	sp.StoragePlugin.GracefulStop(ctx)
+	service.ShutdownTracing()
+}
+
+// Stop implements gocsi.StoragePluginProvider
+func (sp *storagePlugin) Stop(ctx context.Context) {
+	sp.StoragePlugin.Stop(ctx)
+	service.ShutdownTracing()
 }
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+const (
+	// AttributeKeyVolumeName is the key of the name of the ScaleIO volume
+	// in the volume attributes
+	AttributeKeyVolumeName = "volumename"
+
+	// AttributeKeyCSIName is the key of the name that the CO requested the
+	// volume with in the volume attributes. It differs from the name of the
+	// ScaleIO volume when that is prefixed or shortened.
+	AttributeKeyCSIName = "csiname"
+
+	// AttributeKeyStoragePool is the key of the name of the storage pool of
+	// a volume in the volume attributes
+	AttributeKeyStoragePool = KeyStoragePool
+
+	// AttributeKeyStoragePoolID is the key of the ID of the storage pool of
+	// a volume in the volume attributes
+	AttributeKeyStoragePoolID = KeyStoragePoolID
+
+	// AttributeKeyProtectionDomain is the key of the name of the protection
+	// domain of a volume in the volume attributes
+	AttributeKeyProtectionDomain = KeyProtectionDomain
+
+	// AttributeKeyProtectionDomainID is the key of the ID of the protection
+	// domain of a volume in the volume attributes
+	AttributeKeyProtectionDomainID = "protectiondomainid"
+
+	// AttributeKeyProvisioning is the key of the provisioning type of a
+	// volume, ProvisioningThin or ProvisioningThick, in the volume
+	// attributes
+	AttributeKeyProvisioning = "provisioning"
+
+	// AttributeKeySystemName is the key of the name of the ScaleIO system
+	// of a volume in the volume attributes
+	AttributeKeySystemName = KeySystemName
+
+	// AttributeKeySystemID is the key of the ID of the ScaleIO system of a
+	// volume in the volume attributes
+	AttributeKeySystemID = "systemid"
+
+	// AttributeKeyVTreeID is the key of the ID of the VTree of a volume in
+	// the volume attributes. Volumes created from the same source share a
+	// VTree.
+	AttributeKeyVTreeID = "vtreeid"
+
+	// AttributeKeyCreationTime is the key of the creation time of a volume,
+	// in RFC 3339 format, in the volume attributes
+	AttributeKeyCreationTime = "creationtime"
+
+	// AttributeKeyRmCache is the key of whether a volume uses the RAM read
+	// cache of the SDSs, "true" or "false", in the volume attributes
+	AttributeKeyRmCache = KeyRmCache
+
+	// AttributeKeyImported is the key of the flag that marks volumes that
+	// were imported rather than created, in the volume attributes. The
+	// node checks that imported volumes have a filesystem, and never
+	// formats them.
+	AttributeKeyImported = "imported"
+
+	// ProvisioningThin is the provisioning type of thin provisioned volumes
+	ProvisioningThin = "thin"
+
+	// ProvisioningThick is the provisioning type of thick provisioned
+	// volumes
+	ProvisioningThick = "thick"
+
+	// sioVolumeTypeSnapshot is the ScaleIO volume type of snapshots,
+	// including the volumes created from a snapshot or another volume
+	sioVolumeTypeSnapshot = "Snapshot"
+)
+
+// poolInfo holds the details of a storage pool that are reported in the
+// volume attributes
+type poolInfo struct {
+	name   string
+	pdID   string
+	pdName string
+}
+
+// getCSIVolume returns the CSI volume of a volume of the system, with the
+// volume attributes that describe it
+func (sys *scaleioSystem) getCSIVolume(vol *siotypes.Volume) *csi.Volume {
+	vi := getCSIVolume(sys.id(), vol)
+	vi.Attributes[AttributeKeySystemName] = sys.SystemName
+
+	if vol.StoragePoolID == "" {
+		return vi
+	}
+	pi, err := sys.getPoolInfo(vol.StoragePoolID)
+	if err != nil {
+		// The attributes are informational, so the volume is returned
+		// without them
+		log.WithError(err).WithField("storagePoolID", vol.StoragePoolID).Warn(
+			"unable to look up storage pool of volume")
+		return vi
+	}
+	vi.Attributes[AttributeKeyStoragePool] = pi.name
+	vi.Attributes[AttributeKeyProtectionDomainID] = pi.pdID
+	vi.Attributes[AttributeKeyProtectionDomain] = pi.pdName
+	return vi
+}
+
+// getVolumeAttributes returns the attributes of a volume that are known from
+// the volume alone
+func getVolumeAttributes(systemID string, vol *siotypes.Volume) map[string]string {
+	attrs := map[string]string{
+		AttributeKeySystemID: systemID,
+	}
+	if vol.Name != "" {
+		attrs[AttributeKeyVolumeName] = vol.Name
+	}
+	if vol.StoragePoolID != "" {
+		attrs[AttributeKeyStoragePoolID] = vol.StoragePoolID
+	}
+	if pt := getProvisioning(vol.VolumeType); pt != "" {
+		attrs[AttributeKeyProvisioning] = pt
+	}
+	if vol.VTreeID != "" {
+		attrs[AttributeKeyVTreeID] = vol.VTreeID
+	}
+	attrs[AttributeKeyRmCache] = strconv.FormatBool(vol.UseRmCache)
+	if vol.CreationTime > 0 {
+		attrs[AttributeKeyCreationTime] = time.Unix(
+			int64(vol.CreationTime), 0).UTC().Format(time.RFC3339)
+	}
+
+	// ScaleIO limits each mapping of a volume, so the volume has QoS
+	// limits when all of its mappings have the same ones
+	var qos *volumeQoS
+	for _, sdc := range vol.MappedSdcInfo {
+		mq := volumeQoS{iops: sdc.LimitIops, bwInMBps: sdc.LimitBwInMbps}
+		if qos != nil && *qos != mq {
+			qos = nil
+			break
+		}
+		qos = &mq
+	}
+	if qos != nil {
+		for k, v := range qos.attributes() {
+			attrs[k] = v
+		}
+	}
+
+	return attrs
+}
+
+// addAttributes adds the given attributes to those of a volume, replacing
+// those with the same keys. It is used to record the QoS limits requested at
+// creation, which are applied when the volume is mapped.
+func addAttributes(vi *csi.Volume, attrs map[string]string) {
+	if vi.Attributes == nil {
+		vi.Attributes = map[string]string{}
+	}
+	for k, v := range attrs {
+		vi.Attributes[k] = v
+	}
+}
+
+// getProvisioning returns the provisioning type of a ScaleIO volume type
+func getProvisioning(volType string) string {
+	switch volType {
+	case thinProvisioned:
+		return ProvisioningThin
+	case thickProvisioned:
+		return ProvisioningThick
+	case sioVolumeTypeSnapshot:
+		// ScaleIO snapshots are always thin provisioned
+		return ProvisioningThin
+	}
+	return ""
+}
+
+// getPoolInfo returns the details of the storage pool with the given ID.
+// The details of all the pools of the system are looked up at once on a
+// cache miss, as listed volumes are usually spread across them.
+func (sys *scaleioSystem) getPoolInfo(id string) (poolInfo, error) {
+	// check if the details are already in cache
+	f := func() (poolInfo, bool) {
+		sys.poolInfoRWL.RLock()
+		defer sys.poolInfoRWL.RUnlock()
+
+		pi, ok := sys.poolInfo[id]
+		return pi, ok
+	}
+	pi, ok := f()
+	defaultMetrics.observeCacheLookup("poolinfo", ok)
+	if ok {
+		return pi, nil
+	}
+
+	pools, err := sys.client.GetStoragePool("")
+	if err != nil {
+		return poolInfo{}, err
+	}
+	pds, err := sys.system.GetProtectionDomain("")
+	if err != nil {
+		return poolInfo{}, err
+	}
+	pdNames := map[string]string{}
+	for _, pd := range pds {
+		pdNames[pd.ID] = pd.Name
+	}
+
+	sys.poolInfoRWL.Lock()
+	defer sys.poolInfoRWL.Unlock()
+	for _, pool := range pools {
+		sys.poolInfo[pool.ID] = poolInfo{
+			name:   pool.Name,
+			pdID:   pool.ProtectionDomainID,
+			pdName: pdNames[pool.ProtectionDomainID],
+		}
+	}
+
+	if pi, ok = sys.poolInfo[id]; !ok {
+		return poolInfo{}, fmt.Errorf("unable to find storage pool: %s", id)
+	}
+	return pi, nil
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	csictx "github.com/rexray/gocsi/context"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// redactedValue replaces the values of parameters that may be secrets
+const redactedValue = "******"
+
+// secretParamKeys are the substrings of the keys of the parameters whose
+// values are redacted from the audit log
+var secretParamKeys = []string{"password", "secret", "token", "credential"}
+
+// defaultAuditor writes the audit log of the plugin. It is nil when the audit
+// log is not enabled.
+var defaultAuditor *auditor
+
+// auditRecord is an entry of the audit log, which records a mutating
+// operation and its outcome
+type auditRecord struct {
+	Time          time.Time         `json:"time"`
+	RequestID     uint64            `json:"requestID,omitempty"`
+	Method        string            `json:"method"`
+	Peer          string            `json:"peer,omitempty"`
+	UserAgent     string            `json:"userAgent,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	VolumeID      string            `json:"volumeID,omitempty"`
+	SnapshotID    string            `json:"snapshotID,omitempty"`
+	SourceIDs     []string          `json:"sourceIDs,omitempty"`
+	NodeID        string            `json:"nodeID,omitempty"`
+	SdcID         string            `json:"sdcID,omitempty"`
+	TargetPath    string            `json:"targetPath,omitempty"`
+	CapacityBytes int64             `json:"capacityBytes,omitempty"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+	Result        string            `json:"result"`
+	Error         string            `json:"error,omitempty"`
+	Duration      string            `json:"duration"`
+}
+
+type auditRecordKey struct{}
+
+// setAuditSdcID records the ID of the SDC that an operation acts on in the
+// audit record of the operation, if any
+func setAuditSdcID(ctx context.Context, sdcID string) {
+	if rec, ok := ctx.Value(auditRecordKey{}).(*auditRecord); ok {
+		rec.SdcID = sdcID
+	}
+}
+
+// auditor appends audit records to a file, one JSON object per line
+type auditor struct {
+	fileL sync.Mutex
+	file  *os.File
+}
+
+func newAuditor(path string) (*auditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditor{file: f}, nil
+}
+
+func (a *auditor) write(rec *auditRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.WithError(err).Error("unable to encode audit record")
+		return
+	}
+
+	a.fileL.Lock()
+	defer a.fileL.Unlock()
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		log.WithError(err).WithField("method", rec.Method).Error(
+			"unable to write audit record")
+	}
+}
+
+// AuditInterceptor is a gRPC server interceptor that writes an audit record
+// for every mutating operation. The record includes the GoCSI request ID, so
+// the interceptor must run after the GoCSI request ID injector.
+func AuditInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	a := defaultAuditor
+	if a == nil {
+		return handler(ctx, req)
+	}
+
+	_, method := splitFullMethod(info.FullMethod)
+	rec := newAuditRecord(method, req)
+	if rec == nil {
+		// Not a mutating operation
+		return handler(ctx, req)
+	}
+
+	rec.Time = time.Now().UTC()
+	if id, ok := csictx.GetRequestID(ctx); ok {
+		rec.RequestID = id
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		rec.Peer = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ua := md["user-agent"]; len(ua) > 0 {
+			rec.UserAgent = ua[0]
+		}
+	}
+
+	rep, err := handler(context.WithValue(ctx, auditRecordKey{}, rec), req)
+
+	rec.Duration = time.Since(rec.Time).String()
+	rec.Result = status.Code(err).String()
+	if err != nil {
+		rec.Error = status.Convert(err).Message()
+	} else {
+		rec.addResponse(rep)
+	}
+	a.write(rec)
+
+	return rep, err
+}
+
+// newAuditRecord returns the audit record of a request, or nil if the
+// request is not a mutating operation
+func newAuditRecord(method string, req interface{}) *auditRecord {
+	rec := &auditRecord{Method: method}
+
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		rec.Name = r.GetName()
+		rec.CapacityBytes = r.GetCapacityRange().GetRequiredBytes()
+		rec.Parameters = redactParams(r.GetParameters())
+		if id := r.GetVolumeContentSource().GetSnapshot().GetId(); id != "" {
+			rec.SourceIDs = []string{id}
+		}
+	case *csi.DeleteVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+	case *csi.ControllerPublishVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.NodeID = r.GetNodeId()
+	case *csi.ControllerUnpublishVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.NodeID = r.GetNodeId()
+	case *csi.CreateSnapshotRequest:
+		rec.Name = r.GetName()
+		rec.SourceIDs = []string{r.GetSourceVolumeId()}
+		rec.Parameters = redactParams(r.GetParameters())
+	case *csi.DeleteSnapshotRequest:
+		rec.SnapshotID = r.GetSnapshotId()
+	case *csi.NodeStageVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.TargetPath = r.GetStagingTargetPath()
+	case *csi.NodeUnstageVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.TargetPath = r.GetStagingTargetPath()
+	case *csi.NodePublishVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.TargetPath = r.GetTargetPath()
+	case *csi.NodeUnpublishVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.TargetPath = r.GetTargetPath()
+	case *CreateSnapshotGroupRequest:
+		rec.Name = r.Name
+		rec.SourceIDs = r.SourceVolumeIds
+	case *DeleteSnapshotGroupRequest:
+		rec.SnapshotID = r.SnapshotGroupId
+	case *ControllerExpandVolumeRequest:
+		rec.VolumeID = r.VolumeId
+		rec.CapacityBytes = r.CapacityRange.GetRequiredBytes()
+	case *NodeExpandVolumeRequest:
+		rec.VolumeID = r.VolumeId
+	case *ImportVolumeRequest:
+		// The volume may be renamed when it is imported
+		rec.Name = r.Volume
+		rec.CapacityBytes = r.CapacityRange.GetRequiredBytes()
+		rec.Parameters = redactParams(r.Parameters)
+	default:
+		return nil
+	}
+
+	return rec
+}
+
+// addResponse records the IDs of the objects created by an operation
+func (rec *auditRecord) addResponse(rep interface{}) {
+	switch r := rep.(type) {
+	case *csi.CreateVolumeResponse:
+		rec.VolumeID = r.GetVolume().GetId()
+	case *csi.CreateSnapshotResponse:
+		rec.SnapshotID = r.GetSnapshot().GetId()
+	case *CreateSnapshotGroupResponse:
+		rec.SnapshotID = r.SnapshotGroupId
+	case *ControllerExpandVolumeResponse:
+		rec.CapacityBytes = r.CapacityBytes
+	case *ImportVolumeResponse:
+		rec.VolumeID = r.Volume.GetId()
+	}
+}
+
+// redactParams returns a copy of the parameters, with the values of those
+// that may be secrets redacted
+func redactParams(params map[string]string) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+	redacted := make(map[string]string, len(params))
+	for k, v := range params {
+		lk := strings.ToLower(k)
+		for _, s := range secretParamKeys {
+			if strings.Contains(lk, s) {
+				v = redactedValue
+				break
+			}
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// authMaxAttempts is the number of times logging in to the Gateway is
+	// attempted before giving up
+	authMaxAttempts = 5
+
+	// authInitialBackoff is the time waited before the second attempt at
+	// logging in to the Gateway. It doubles for each following attempt, up
+	// to authMaxBackoff.
+	authInitialBackoff = 250 * time.Millisecond
+
+	// authMaxBackoff is the longest time waited between attempts at
+	// logging in to the Gateway
+	authMaxBackoff = 4 * time.Second
+)
+
+// authTransport is an http.RoundTripper that keeps the session of a ScaleIO
+// Gateway client alive. It records the token of every login to the Gateway,
+// and sets it on every other request. When a request is rejected as
+// unauthorized, the transport logs in again and retries the request once.
+// Logins are serialized, so that concurrent requests that are rejected at
+// the same time cause a single login. When the credentials change, the
+// transport logs in again with them before sending the next request.
+type authTransport struct {
+	base     http.RoundTripper
+	endpoint url.URL
+	creds    *credentialsSource
+
+	// loginL serializes logins
+	loginL sync.Mutex
+
+	tokenRWL sync.RWMutex
+	token    string
+	// gen is incremented every time the token changes, so that a request
+	// rejected with an old token does not cause another login
+	gen uint64
+	// credGen is the generation of the credentials of the last login
+	credGen uint64
+}
+
+func newAuthTransport(
+	base http.RoundTripper,
+	endpoint url.URL,
+	creds *credentialsSource) *authTransport {
+
+	return &authTransport{
+		base:     base,
+		endpoint: endpoint,
+		creds:    creds,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.creds.reload()
+
+	if isLoginRequest(req) {
+		return t.roundTripLogin(req)
+	}
+
+	// The body is buffered, so that the request can be retried
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	token, gen, credGen := t.getToken()
+	if token != "" && credGen != t.creds.getGen() {
+		// The credentials have changed. If the new ones are rejected, the
+		// current session keeps being used.
+		if _, err := t.refresh(req, gen); err != nil {
+			log.WithError(err).WithField("endpoint", t.endpoint.Host).Warn(
+				"failed to log in to ScaleIO Gateway with new credentials")
+		}
+		token, gen, _ = t.getToken()
+	}
+
+	resp, err := t.base.RoundTrip(withToken(req, body, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	log.WithField("url", req.URL.String()).Debug(
+		"request unauthorized by ScaleIO Gateway")
+
+	if token, err = t.refresh(req, gen); err != nil {
+		return nil, fmt.Errorf(
+			"error re-authenticating with ScaleIO Gateway: %s", err.Error())
+	}
+
+	return t.base.RoundTrip(withToken(req, body, token))
+}
+
+// isLoginRequest returns whether the request logs in to the Gateway
+func isLoginRequest(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/login")
+}
+
+// withToken returns a copy of the request with the given body that is
+// authorized by the given token
+func withToken(req *http.Request, body []byte, token string) *http.Request {
+	if token == "" {
+		return withBasicAuth(req, body, nil)
+	}
+	return withBasicAuth(req, body, &credentials{password: token})
+}
+
+// withBasicAuth returns a copy of the request with the given body that is
+// authorized by the given credentials
+func withBasicAuth(
+	req *http.Request, body []byte, creds *credentials) *http.Request {
+
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if creds != nil {
+		r.SetBasicAuth(creds.user, creds.password)
+	}
+	return r
+}
+
+// roundTripLogin sends a login request with the credentials of the
+// transport, and records the token from its response
+func (t *authTransport) roundTripLogin(
+	req *http.Request) (*http.Response, error) {
+
+	cands, credGen := t.creds.candidates()
+	for i, creds := range cands {
+		resp, err := t.base.RoundTrip(withBasicAuth(req, nil, &creds))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && i < len(cands)-1 {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			log.WithField("endpoint", t.endpoint.Host).Warn(
+				"new ScaleIO Gateway credentials rejected, using previous")
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return resp, nil
+		}
+
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+		t.creds.accept(creds)
+		t.setToken(parseToken(b), credGen)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no ScaleIO Gateway credentials")
+}
+
+// parseToken returns the token in the body of a login response, which is a
+// JSON string
+func parseToken(b []byte) string {
+	return strings.Trim(strings.TrimSpace(string(b)), `"`)
+}
+
+func (t *authTransport) getToken() (string, uint64, uint64) {
+	t.tokenRWL.RLock()
+	defer t.tokenRWL.RUnlock()
+	return t.token, t.gen, t.credGen
+}
+
+func (t *authTransport) setToken(token string, credGen uint64) {
+	t.tokenRWL.Lock()
+	defer t.tokenRWL.Unlock()
+	t.token = token
+	t.gen++
+	t.credGen = credGen
+}
+
+// refresh logs in to the Gateway, unless the token has changed since gen,
+// and returns the current token
+func (t *authTransport) refresh(req *http.Request, gen uint64) (string, error) {
+	t.loginL.Lock()
+	defer t.loginL.Unlock()
+
+	if token, curGen, _ := t.getToken(); curGen != gen {
+		// Another request has already logged in again
+		return token, nil
+	}
+
+	backoff := authInitialBackoff
+	for attempt := 1; ; attempt++ {
+		token, retry, err := t.login(req)
+		if err == nil {
+			log.WithField("endpoint", t.endpoint.Host).Info(
+				"re-authenticated with ScaleIO Gateway")
+			return token, nil
+		}
+		if !retry || attempt == authMaxAttempts {
+			return "", err
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"endpoint": t.endpoint.Host,
+			"attempt":  attempt,
+			"backoff":  backoff,
+		}).Warn("failed to log in to ScaleIO Gateway, retrying")
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return "", req.Context().Err()
+		}
+		if backoff *= 2; backoff > authMaxBackoff {
+			backoff = authMaxBackoff
+		}
+	}
+}
+
+// login logs in to the Gateway, trying the pending credentials first, and
+// records and returns the new token. The returned flag indicates if the
+// login failed in a way that may succeed if retried.
+func (t *authTransport) login(req *http.Request) (string, bool, error) {
+	cands, credGen := t.creds.candidates()
+	for i, creds := range cands {
+		token, retry, err := t.loginWith(req, creds)
+		if err == nil {
+			t.creds.accept(creds)
+			t.setToken(token, credGen)
+			return token, false, nil
+		}
+		if retry || i == len(cands)-1 {
+			return "", retry, err
+		}
+		log.WithError(err).WithField("endpoint", t.endpoint.Host).Warn(
+			"new ScaleIO Gateway credentials rejected, using previous")
+	}
+	return "", false, fmt.Errorf("no ScaleIO Gateway credentials")
+}
+
+// loginWith logs in to the Gateway with the given credentials
+func (t *authTransport) loginWith(
+	req *http.Request, creds credentials) (string, bool, error) {
+
+	u := t.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/login"
+
+	loginReq, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	loginReq = loginReq.WithContext(req.Context())
+	loginReq.SetBasicAuth(creds.user, creds.password)
+
+	resp, err := t.base.RoundTrip(loginReq)
+	if err != nil {
+		return "", true, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", true, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return parseToken(b), false, nil
+	case resp.StatusCode >= 500:
+		return "", true, fmt.Errorf("unexpected response: %s", resp.Status)
+	default:
+		// The credentials are rejected, which won't change by retrying
+		return "", false, fmt.Errorf("login rejected: %s", resp.Status)
+	}
+}
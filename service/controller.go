@@ -20,6 +20,50 @@ const (
 	// volume create parameters map
 	KeyStoragePool = "storagepool"
 
+	// KeyStoragePoolID is the key used to get the ID of the storage pool
+	// from the volume create parameters map. It can be used instead of the
+	// storage pool name.
+	KeyStoragePoolID = "storagepoolid"
+
+	// KeyProtectionDomain is the key used to get the name of the protection
+	// domain of the storage pool from the volume create parameters map. It
+	// is needed when pools of different protection domains share a name.
+	KeyProtectionDomain = "protectiondomain"
+
+	// PublishInfoKeyMdmID is the key of the ID of the MDM, which is the ID
+	// of the ScaleIO system, that a volume is mapped from in the publish
+	// info returned by ControllerPublishVolume
+	PublishInfoKeyMdmID = "mdmid"
+
+	// KeySourceVolumeID is the key used to get the ID of a volume to clone
+	// from the volume create parameters map
+	KeySourceVolumeID = "sourcevolumeid"
+
+	// KeyImportVolume is the key used to get the name or ScaleIO ID of an
+	// existing volume to import from the volume create parameters map
+	KeyImportVolume = "importvolume"
+
+	// KeyMaxIOPS is the key used to get the IOPS limit of a volume from the
+	// volume create parameters map. The limit is stored in the attributes of
+	// the volume, and applied to every SDC the volume is mapped to.
+	KeyMaxIOPS = "maxiops"
+
+	// KeyMaxBandwidthMBps is the key used to get the bandwidth limit of a
+	// volume, in MiB/s, from the volume create parameters map. The limit is
+	// stored in the attributes of the volume, and applied to every SDC the
+	// volume is mapped to.
+	KeyMaxBandwidthMBps = "maxbwmbps"
+
+	// KeyRmCache is the key used to get whether a volume uses the RAM read
+	// cache of the SDSs from the volume create parameters map. The cache
+	// is only used when it is also enabled for the storage pool. The
+	// ScaleIO default applies when the key is not given.
+	KeyRmCache = "rmcache"
+
+	// minIOPSLimit is the smallest IOPS limit accepted by ScaleIO, other
+	// than 0 for no limit
+	minIOPSLimit = 11
+
 	// DefaultVolumeSizeKiB is default volume size to create on a scaleIO
 	// cluster when no size is given, expressed in KiB
 	DefaultVolumeSizeKiB = 16 * kiBytesInGiB
@@ -47,6 +91,13 @@ const (
 	errNoMultiNodeWriter      = "multi-node with writer(s) only supported for block access type"
 )
 
+// isVolumeNotFound returns whether an error of the Gateway reports that a
+// volume does not exist. The error may be wrapped by goscaleio, so its message
+// only contains that of the Gateway.
+func isVolumeNotFound(err error) bool {
+	return strings.Contains(err.Error(), sioGatewayVolumeNotFound)
+}
+
 func (s *service) CreateVolume(
 	ctx context.Context,
 	req *csi.CreateVolumeRequest) (
@@ -57,18 +108,27 @@ func (s *service) CreateVolume(
 	}
 
 	cr := req.GetCapacityRange()
-	sizeInKiB, err := validateVolSize(cr)
+	params := req.GetParameters()
+
+	sys, err := s.getCreateSystem(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	params := req.GetParameters()
-
-	// We require the storagePool name for creation
-	sp, ok := params[KeyStoragePool]
-	if !ok {
+	// We require the storagePool name or ID for creation, unless one can
+	// be selected from the protection domains of the topology
+	// requirements, or else the system has a default storage pool
+	reqs := req.GetAccessibilityRequirements()
+	spRef := getPoolRef(params)
+	importRef, importing := params[KeyImportVolume]
+	if spRef.id == "" && spRef.name == "" && !importing &&
+		!namesProtectionDomains(reqs) {
+		spRef.name = sys.StoragePool
+	}
+	if spRef.isEmpty() && !importing && len(orderedTopologies(reqs)) == 0 {
 		return nil, status.Errorf(codes.InvalidArgument,
-			"`%s` is a required parameter", KeyStoragePool)
+			"`%s` or `%s` is a required parameter",
+			KeyStoragePool, KeyStoragePoolID)
 	}
 
 	volType := s.getVolProvisionType(params)
@@ -79,58 +139,154 @@ func (s *service) CreateVolume(
 			"'name' cannot be empty")
 	}
 
+	qos, err := getVolumeQoS(params)
+	if err != nil {
+		return nil, err
+	}
+
+	tunables, err := getVolumeTunables(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Volumes created from a source are ScaleIO snapshots, which keep the
+	// settings of their source
+	fromSource := req.GetVolumeContentSource() != nil ||
+		params[KeySourceVolumeID] != ""
+	if key := tunables.key(); key != "" && fromSource {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"`%s` cannot be used with a volume source", key)
+	}
+
+	// The CO name is recorded in the attributes, as the ScaleIO name may
+	// differ from it
+	volName, err := s.getCreateVolumeName(name, params, fromSource)
+	if err != nil {
+		return nil, err
+	}
+	attrs := qos.attributes()
+	attrs[AttributeKeyCSIName] = name
+
+	if importing {
+		if fromSource {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"`%s` cannot be used with a volume source", KeyImportVolume)
+		}
+		vi, err := sys.importVolume(importRef, s.getImportPrefix(), spRef,
+			tunables, cr, reqs)
+		if err != nil {
+			return nil, err
+		}
+		addAttributes(vi, attrs)
+		return &csi.CreateVolumeResponse{
+			Volume: vi,
+		}, nil
+	}
+
+	var pool *siotypes.StoragePool
+	switch {
+	case spRef.isEmpty():
+		pool, err = s.selectStoragePool(ctx, sys, volName, req)
+	case spRef.isSelection():
+		pool, err = s.placeVolume(ctx, sys, volName, spRef, req)
+	default:
+		pool, err = sys.getStoragePool(spRef)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	topo, err := sys.getVolumeTopology(pool, reqs)
+	if err != nil {
+		return nil, err
+	}
+
+	if cs := req.GetVolumeContentSource(); cs != nil {
+		snapSrc := cs.GetSnapshot()
+		if snapSrc == nil {
+			return nil, status.Error(codes.InvalidArgument,
+				"unsupported volume content source")
+		}
+		csiResp, err := s.createVolumeFromSnapshot(
+			ctx, sys, volName, pool, cr, snapSrc.GetId())
+		if err != nil {
+			return nil, err
+		}
+		addAttributes(csiResp.Volume, attrs)
+		csiResp.Volume.AccessibleTopology = topo
+		return csiResp, nil
+	}
+
+	if srcID, ok := params[KeySourceVolumeID]; ok {
+		csiResp, err := s.cloneVolume(ctx, sys, volName, pool, cr, srcID)
+		if err != nil {
+			return nil, err
+		}
+		addAttributes(csiResp.Volume, attrs)
+		csiResp.Volume.AccessibleTopology = topo
+		return csiResp, nil
+	}
+
+	sizeInKiB, err := validateVolSize(cr)
+	if err != nil {
+		return nil, err
+	}
+
 	// TODO handle Access mode in volume capability
 
 	fields := map[string]interface{}{
-		"name":        name,
-		"sizeInKiB":   sizeInKiB,
-		"storagePool": sp,
-		"volType":     volType,
+		"name":               volName,
+		"csiName":            name,
+		"sizeInKiB":          sizeInKiB,
+		"storagePool":        pool.Name,
+		"storagePoolID":      pool.ID,
+		"protectionDomainID": pool.ProtectionDomainID,
+		"volType":            volType,
+		"systemName":         sys.SystemName,
 	}
 
 	log.WithFields(fields).Info("creating volume")
 
 	volumeParam := &siotypes.VolumeParam{
-		Name:           name,
+		Name:           volName,
 		VolumeSizeInKb: fmt.Sprintf("%d", sizeInKiB),
 		VolumeType:     volType,
 	}
-	createResp, err := s.adminClient.CreateVolume(volumeParam, sp)
+	tunables.apply(volumeParam)
+	// The volume is created in the resolved pool, which also sets the
+	// protection domain of the volume
+	createResp, err := goscaleio.NewStoragePoolEx(
+		sys.client, pool).CreateVolume(volumeParam)
 	if err != nil {
-		// handle case where volume already exists
-		if !strings.EqualFold(err.Error(), sioGatewayVolumeNameInUse) {
+		// handle case where volume already exists. The Gateway error is
+		// wrapped by goscaleio.
+		if !strings.Contains(err.Error(), sioGatewayVolumeNameInUse) {
 			return nil, status.Errorf(codes.Internal,
 				"error when creating volume: %s", err.Error())
 		}
 	}
 
 	var id string
-	if createResp == nil {
+	if createResp == nil || createResp.ID == "" {
 		// volume already exists, look it up by name
-		id, err = s.adminClient.FindVolumeID(name)
+		id, err = sys.client.FindVolumeID(volName)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
 		id = createResp.ID
 	}
 
-	vol, err := s.getVolByID(id)
+	vol, err := sys.getVolByID(id)
 	if err != nil {
 		return nil, status.Errorf(codes.Unavailable,
 			"error retrieving volume details: %s", err.Error())
 	}
-	vi := getCSIVolume(vol)
+	vi := sys.getCSIVolume(vol)
 
 	// since the volume could have already exists, double check that the
 	// volume has the expected parameters
-	spID, err := s.getStoragePoolID(sp)
-	if err != nil {
-		return nil, status.Errorf(codes.Unavailable,
-			"volume exists, but could not verify parameters: %s",
-			err.Error())
-	}
-	if vol.StoragePoolID != spID {
+	if vol.StoragePoolID != pool.ID {
 		return nil, status.Errorf(codes.Unavailable,
 			"volume exists, but in different storage pool than requested")
 	}
@@ -140,206 +296,737 @@ func (s *service) CreateVolume(
 			"volume exists, but at different size than requested")
 	}
 
+	if vol.VolumeType != volType {
+		return nil, status.Errorf(codes.Unavailable,
+			"volume exists, but with different provisioning than requested")
+	}
+
+	if key := tunables.mismatch(vol); key != "" {
+		return nil, status.Errorf(codes.Unavailable,
+			"volume exists, but with different `%s` than requested", key)
+	}
+
+	addAttributes(vi, attrs)
+	vi.AccessibleTopology = topo
+
 	csiResp := &csi.CreateVolumeResponse{
 		Volume: vi,
 	}
 
-	s.clearCache()
-
 	return csiResp, nil
 }
 
-func (s *service) clearCache() {
-	s.volCacheRWL.Lock()
-	defer s.volCacheRWL.Unlock()
-	s.volCache = make([]*siotypes.Volume, 0)
-}
+// ImportVolume checks that an existing volume, created outside of the CO, can
+// be used as a CSI volume, and returns it as CreateVolume would when the
+// volume is named by the importvolume parameter. Like CreateVolume, it renames
+// the volume with the prefix when the plugin only manages prefixed volumes.
+func (s *service) ImportVolume(
+	ctx context.Context,
+	req *ImportVolumeRequest) (
+	*ImportVolumeResponse, error) {
 
-// validateVolSize uses the CapacityRange range params to determine what size
-// volume to create, and returns an error if volume size would be greater than
-// the given limit. Returned size is in KiB
-func validateVolSize(cr *csi.CapacityRange) (int64, error) {
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
 
-	minSize := cr.GetRequiredBytes()
-	maxSize := cr.GetLimitBytes()
+	if req.Volume == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"volume is required")
+	}
 
-	if minSize == 0 {
-		minSize = DefaultVolumeSizeKiB
-	} else {
-		minSize = minSize / bytesInKiB
+	params := req.Parameters
+	qos, err := getVolumeQoS(params)
+	if err != nil {
+		return nil, err
 	}
 
-	var (
-		sizeGiB int64
-		sizeKiB int64
-		sizeB   int64
-	)
-	// ScaleIO creates volumes in multiples of 8GiB, rounding up.
-	// Determine what actual size of volume will be, and check that
-	// we do not exceed maxSize
-	sizeGiB = minSize / kiBytesInGiB
-	mod := sizeGiB % VolSizeMultipleGiB
-	if mod > 0 {
-		sizeGiB = sizeGiB - mod + VolSizeMultipleGiB
+	sys, err := s.getSystemByName(ctx, params[KeySystemName])
+	if err != nil {
+		return nil, err
 	}
-	sizeB = sizeGiB * bytesInGiB
-	if maxSize != 0 {
-		if sizeB > maxSize {
-			return 0, status.Errorf(
-				codes.OutOfRange,
-				"volume size %d > limit_bytes: %d", sizeB, maxSize)
-		}
+
+	tunables, err := getVolumeTunables(params)
+	if err != nil {
+		return nil, err
 	}
 
-	sizeKiB = sizeGiB * kiBytesInGiB
-	return sizeKiB, nil
+	vi, err := sys.importVolume(req.Volume, s.getImportPrefix(),
+		getPoolRef(params), tunables, req.CapacityRange, nil)
+	if err != nil {
+		return nil, err
+	}
+	addAttributes(vi, qos.attributes())
+
+	return &ImportVolumeResponse{
+		Volume: vi,
+	}, nil
 }
 
-func (s *service) DeleteVolume(
-	ctx context.Context,
-	req *csi.DeleteVolumeRequest) (
-	*csi.DeleteVolumeResponse, error) {
+// importVolume looks up an existing volume by name, or else by ScaleIO ID,
+// and checks that it can be imported: it must be in the named storage pool,
+// if any, have the requested settings, satisfy the capacity range and
+// topology requirements, and not be mapped to any SDC, as it would then be in
+// use outside of the CO. If a prefix is given, the volume is renamed with it,
+// unless it is already named with it, so that it is managed by a plugin that
+// only manages prefixed volumes. The returned volume is marked as imported,
+// so that the node never formats it.
+func (sys *scaleioSystem) importVolume(
+	ref string,
+	prefix string,
+	spRef poolRef,
+	tunables volumeTunables,
+	cr *csi.CapacityRange,
+	reqs *csi.TopologyRequirement) (*csi.Volume, error) {
 
-	if err := s.requireProbe(ctx); err != nil {
-		return nil, err
+	fields := map[string]interface{}{
+		"volume":      ref,
+		"storagePool": spRef.String(),
+		"systemName":  sys.SystemName,
 	}
 
-	id := req.GetVolumeId()
-
-	vol, err := s.getVolByID(id)
+	// A retried request finds the volume by the name it was given
+	id, err := sys.client.FindVolumeID(ref)
+	for _, name := range []string{
+		getVolumeName(prefix, ref), getMarkedVolumeName(prefix, ref),
+	} {
+		if err == nil && id != "" {
+			break
+		}
+		if name != ref {
+			id, err = sys.client.FindVolumeID(name)
+		}
+	}
+	if err != nil || id == "" {
+		id = ref
+	}
+	vol, err := sys.getVolByID(id)
 	if err != nil {
-		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
-			log.Debug("volume already deleted")
-			return &csi.DeleteVolumeResponse{}, nil
+		if isVolumeNotFound(err) {
+			return nil, status.Errorf(codes.NotFound,
+				"volume to import: %s not found", ref)
 		}
 		return nil, status.Errorf(codes.Internal,
-			"failure checking volume status before deletion: %s",
-			err.Error())
+			"failure checking volume to import: %s", err.Error())
+	}
+	if isCSISnapshot(vol) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"volume to import: %s is a snapshot", ref)
+	}
+
+	if !spRef.isEmpty() {
+		pool, err := sys.getStoragePool(spRef)
+		if err != nil {
+			return nil, err
+		}
+		if vol.StoragePoolID != pool.ID {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"volume to import: %s is in different storage pool than requested",
+				ref)
+		}
+	}
+
+	if key := tunables.mismatch(vol); key != "" {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"volume to import: %s has different `%s` than requested",
+			ref, key)
+	}
+
+	if err := validateSourceSize(cr, int64(vol.SizeInKb)); err != nil {
+		return nil, err
 	}
 
 	if len(vol.MappedSdcInfo) > 0 {
-		// Volume is in use
 		return nil, status.Errorf(codes.FailedPrecondition,
-			"volume in use by %s", vol.MappedSdcInfo[0].SdcID)
+			"volume to import: %s is mapped to SDC: %s",
+			ref, vol.MappedSdcInfo[0].SdcID)
 	}
 
-	tgtVol := goscaleio.NewVolume(s.adminClient)
-	tgtVol.Volume = vol
-	err = tgtVol.RemoveVolume(removeModeOnlyMe)
+	pool, err := sys.getStoragePool(poolRef{id: vol.StoragePoolID})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,
-			"error removing volume: %s", err.Error())
+		return nil, err
+	}
+	topo, err := sys.getVolumeTopology(pool, reqs)
+	if err != nil {
+		return nil, err
 	}
 
-	s.clearCache()
+	log.WithFields(fields).WithField("volumeID", vol.ID).Info(
+		"importing volume")
 
-	return &csi.DeleteVolumeResponse{}, nil
+	// ScaleIO snapshots are renamed with the mark of a CSI volume, as they
+	// are not listed as volumes otherwise
+	name := vol.Name
+	switch {
+	case !isCSIVolume(vol):
+		name = getMarkedVolumeName(prefix, vol.Name)
+	case prefix != "" &&
+		!strings.HasPrefix(vol.Name, volumeNamePrefix(prefix)):
+		name = getVolumeName(prefix, vol.Name)
+	}
+	if name != vol.Name {
+		if err := sys.setVolumeName(vol.ID, name); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error renaming volume to import: %s to: %s, err: %s",
+				ref, name, err.Error())
+		}
+		log.WithFields(fields).WithField("volumeName", name).Info(
+			"renamed imported volume")
+		vol.Name = name
+	}
+
+	vi := sys.getCSIVolume(vol)
+	vi.Attributes[AttributeKeyImported] = "true"
+	vi.AccessibleTopology = topo
+	return vi, nil
 }
 
-func (s *service) ControllerPublishVolume(
+// createVolumeFromSnapshot creates a new volume from the given snapshot, and
+// records the snapshot as the content source of the volume
+func (s *service) createVolumeFromSnapshot(
 	ctx context.Context,
-	req *csi.ControllerPublishVolumeRequest) (
-	*csi.ControllerPublishVolumeResponse, error) {
+	sys *scaleioSystem,
+	name string,
+	pool *siotypes.StoragePool,
+	cr *csi.CapacityRange,
+	id string) (*csi.CreateVolumeResponse, error) {
 
-	if err := s.requireProbe(ctx); err != nil {
+	snapSys, snapID, err := s.getSystemForID(ctx, id)
+	if err != nil {
 		return nil, err
 	}
-
-	volID := req.GetVolumeId()
-	if volID == "" {
-		return nil, status.Error(codes.InvalidArgument,
-			"volumeID is required")
+	if snapSys.id() != sys.id() {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"snapshot: %s is not in ScaleIO system: %s",
+			id, sys.SystemName)
 	}
 
-	vol, err := s.getVolByID(volID)
+	snap, err := sys.getVolByID(snapID)
 	if err != nil {
-		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
-			return nil, status.Error(codes.NotFound,
-				"volume not found")
+		if isVolumeNotFound(err) {
+			return nil, status.Errorf(codes.NotFound,
+				"snapshot: %s not found", snapID)
 		}
 		return nil, status.Errorf(codes.Internal,
-			"failure checking volume status before controller publish: %s",
-			err.Error())
-	}
-
-	nodeID := req.GetNodeId()
-	if nodeID == "" {
-		return nil, status.Error(codes.InvalidArgument,
-			"node ID is required")
+			"failure checking snapshot status: %s", err.Error())
 	}
-
-	sdcID, err := s.getSDCID(nodeID)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+	if !isCSISnapshot(snap) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"volume: %s is not a snapshot", snapID)
 	}
-
-	vc := req.GetVolumeCapability()
-	if vc == nil {
-		return nil, status.Error(codes.InvalidArgument,
-			"volume capability is required")
+	if err := s.requireOwnership(snap, "snapshot"); err != nil {
+		return nil, err
 	}
 
-	am := vc.GetAccessMode()
-	if am == nil {
-		return nil, status.Error(codes.InvalidArgument,
-			"access mode is required")
+	vi, err := s.createVolumeFromSource(sys, name, pool, cr, snap)
+	if err != nil {
+		return nil, err
 	}
-
-	if am.Mode == csi.VolumeCapability_AccessMode_UNKNOWN {
-		return nil, status.Error(codes.InvalidArgument,
-			errUnknownAccessMode)
+	vi.ContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				Id: newVolumeID(sys.id(), snap.ID),
+			},
+		},
 	}
-	// Check if volume is published to any node already
-	if len(vol.MappedSdcInfo) > 0 {
-		vcs := []*csi.VolumeCapability{req.GetVolumeCapability()}
-		isBlock := accTypeIsBlock(vcs)
-
-		for _, sdc := range vol.MappedSdcInfo {
-			if sdc.SdcID == sdcID {
-				// TODO check if published volume is compatible with this request
-				// volume already mapped
-				log.Debug("volume already mapped")
-				return &csi.ControllerPublishVolumeResponse{}, nil
-			}
-		}
 
-		// If volume has SINGLE_NODE cap, go no farther
-		switch am.Mode {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
-			return nil, status.Errorf(codes.FailedPrecondition,
-				"volume already published to SDC id: %s", vol.MappedSdcInfo[0].SdcID)
-		}
+	return &csi.CreateVolumeResponse{
+		Volume: vi,
+	}, nil
+}
 
-		// All remaining cases are MULTI_NODE, make sure volume has
-		// multi-map enabled
-		if !vol.MappingToAllSdcsEnabled {
-			return nil, status.Error(codes.FailedPrecondition,
-				errNoMultiMap)
-		}
+// cloneVolume creates a new volume that is a clone of the given volume
+func (s *service) cloneVolume(
+	ctx context.Context,
+	sys *scaleioSystem,
+	name string,
+	pool *siotypes.StoragePool,
+	cr *csi.CapacityRange,
+	id string) (*csi.CreateVolumeResponse, error) {
 
-		if err := validateAccessType(am, isBlock); err != nil {
-			return nil, err
-		}
+	srcSys, srcID, err := s.getSystemForID(ctx, id)
+	if err != nil {
+		return nil, err
 	}
-
-	mapVolumeSdcParam := &siotypes.MapVolumeSdcParam{
-		SdcID: sdcID,
-		AllowMultipleMappings: "false",
-		AllSdcs:               "",
+	if srcSys.id() != sys.id() {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"source volume: %s is not in ScaleIO system: %s",
+			id, sys.SystemName)
 	}
 
-	targetVolume := goscaleio.NewVolume(s.adminClient)
-	targetVolume.Volume = &siotypes.Volume{ID: vol.ID}
-
-	err = targetVolume.MapVolumeSdc(mapVolumeSdcParam)
+	src, err := sys.getVolByID(srcID)
 	if err != nil {
+		if isVolumeNotFound(err) {
+			return nil, status.Errorf(codes.NotFound,
+				"source volume: %s not found", srcID)
+		}
 		return nil, status.Errorf(codes.Internal,
-			"error mapping volume to node: %s", err.Error())
+			"failure checking source volume status: %s", err.Error())
+	}
+	if !isCSIVolume(src) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"source volume: %s is a snapshot", srcID)
+	}
+	if err := s.requireOwnership(src, "volume"); err != nil {
+		return nil, err
 	}
 
-	return &csi.ControllerPublishVolumeResponse{}, nil
-}
+	vi, err := s.createVolumeFromSource(sys, name, pool, cr, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: vi,
+	}, nil
+}
+
+// createVolumeFromSource creates a new volume from the given source volume or
+// snapshot. The volume is itself a ScaleIO snapshot of the source, within the
+// same VTree, so no data is copied.
+func (s *service) createVolumeFromSource(
+	sys *scaleioSystem,
+	name string,
+	pool *siotypes.StoragePool,
+	cr *csi.CapacityRange,
+	src *siotypes.Volume) (*csi.Volume, error) {
+
+	// The new volume shares the VTree of the source, so it can only be
+	// in the storage pool of the source
+	if src.StoragePoolID != pool.ID {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"source is in different storage pool than requested")
+	}
+
+	if err := validateSourceSize(cr, int64(src.SizeInKb)); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(map[string]interface{}{
+		"name":     name,
+		"sourceID": src.ID,
+	}).Info("creating volume from source")
+
+	vol, err := sys.createSnapshotVolume(name, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return sys.getCSIVolume(vol), nil
+}
+
+// createSnapshotVolume creates a ScaleIO snapshot of src with the given name.
+// If a volume with the given name already exists, it is returned as long as
+// it is a snapshot of src.
+func (sys *scaleioSystem) createSnapshotVolume(
+	name string,
+	src *siotypes.Volume) (*siotypes.Volume, error) {
+
+	fields := map[string]interface{}{
+		"name":     name,
+		"sourceID": src.ID,
+	}
+
+	// Volume names are unique within the system, so if one already exists
+	// with the requested name, it must be a snapshot of the same source
+	// volume to satisfy the request
+	if id, err := sys.client.FindVolumeID(name); err == nil {
+		vol, err := sys.getVolByID(id)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable,
+				"error retrieving snapshot details: %s", err.Error())
+		}
+		if vol.AncestorVolumeID != src.ID {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"volume: %s exists, but with different source", name)
+		}
+		log.WithFields(fields).Debug("snapshot already exists")
+		return vol, nil
+	}
+
+	log.WithFields(fields).Info("creating snapshot")
+
+	snapParam := &siotypes.SnapshotVolumesParam{
+		SnapshotDefs: []*siotypes.SnapshotDef{
+			&siotypes.SnapshotDef{
+				VolumeID:     src.ID,
+				SnapshotName: name,
+			},
+		},
+	}
+	snapResp, err := sys.system.CreateSnapshotConsistencyGroup(snapParam)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error when creating snapshot: %s", err.Error())
+	}
+	if len(snapResp.VolumeIDList) != 1 {
+		return nil, status.Errorf(codes.Internal,
+			"expected 1 snapshot to be created, got %d",
+			len(snapResp.VolumeIDList))
+	}
+
+	vol, err := sys.getVolByID(snapResp.VolumeIDList[0])
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"error retrieving snapshot details: %s", err.Error())
+	}
+	return vol, nil
+}
+
+// validateSourceSize checks that a volume created from a source of the given
+// size, in KiB, satisfies the CapacityRange. ScaleIO snapshots always have
+// the size of their source, so the source must be large enough without
+// exceeding the limit
+func validateSourceSize(cr *csi.CapacityRange, srcSizeKiB int64) error {
+
+	srcSize := srcSizeKiB * bytesInKiB
+
+	if minSize := cr.GetRequiredBytes(); minSize > srcSize {
+		return status.Errorf(codes.OutOfRange,
+			"required_bytes: %d > source size: %d", minSize, srcSize)
+	}
+	if maxSize := cr.GetLimitBytes(); maxSize != 0 && srcSize > maxSize {
+		return status.Errorf(codes.OutOfRange,
+			"source size: %d > limit_bytes: %d", srcSize, maxSize)
+	}
+	return nil
+}
+
+// volumeQoS holds the limits that are applied to each mapping of a volume to
+// an SDC. A limit of 0 means the volume is not limited.
+type volumeQoS struct {
+	iops     int
+	bwInMBps int
+}
+
+// getVolumeQoS parses the QoS limits from the given map, which are either the
+// volume create parameters, or the attributes of a volume
+func getVolumeQoS(params map[string]string) (volumeQoS, error) {
+	var qos volumeQoS
+
+	if v, ok := params[KeyMaxIOPS]; ok {
+		iops, err := strconv.Atoi(v)
+		if err != nil || iops < 0 || (iops > 0 && iops < minIOPSLimit) {
+			return qos, status.Errorf(codes.InvalidArgument,
+				"invalid `%s`=(%v), must be 0 or at least %d",
+				KeyMaxIOPS, v, minIOPSLimit)
+		}
+		qos.iops = iops
+	}
+
+	if v, ok := params[KeyMaxBandwidthMBps]; ok {
+		bw, err := strconv.Atoi(v)
+		if err != nil || bw < 0 {
+			return qos, status.Errorf(codes.InvalidArgument,
+				"invalid `%s`=(%v), must be 0 or greater",
+				KeyMaxBandwidthMBps, v)
+		}
+		qos.bwInMBps = bw
+	}
+
+	return qos, nil
+}
+
+// attributes returns the volume attributes that store the QoS limits
+func (qos volumeQoS) attributes() map[string]string {
+	attrs := map[string]string{}
+	if qos.iops > 0 {
+		attrs[KeyMaxIOPS] = strconv.Itoa(qos.iops)
+	}
+	if qos.bwInMBps > 0 {
+		attrs[KeyMaxBandwidthMBps] = strconv.Itoa(qos.bwInMBps)
+	}
+	return attrs
+}
+
+// matches returns whether the limits of the given SDC mapping are the QoS
+// limits
+func (qos volumeQoS) matches(sdc *siotypes.MappedSdcInfo) bool {
+	return sdc.LimitIops == qos.iops && sdc.LimitBwInMbps == qos.bwInMBps
+}
+
+// volumeTunables holds the settings of a volume that are applied when it is
+// created. Settings that are not given are left to the ScaleIO defaults.
+type volumeTunables struct {
+	// rmCache is whether the volume uses the RAM read cache, if given
+	rmCache *bool
+}
+
+// getVolumeTunables parses the volume settings from the volume create
+// parameters
+func getVolumeTunables(params map[string]string) (volumeTunables, error) {
+	var vt volumeTunables
+
+	if v, ok := params[KeyRmCache]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return vt, status.Errorf(codes.InvalidArgument,
+				"invalid `%s`=(%v), must be true or false", KeyRmCache, v)
+		}
+		vt.rmCache = &b
+	}
+
+	return vt, nil
+}
+
+// key returns the name of the first volume setting that was given, or "" if
+// none was
+func (vt volumeTunables) key() string {
+	if vt.rmCache != nil {
+		return KeyRmCache
+	}
+	return ""
+}
+
+// apply sets the volume settings in the parameters of a new volume
+func (vt volumeTunables) apply(p *siotypes.VolumeParam) {
+	if vt.rmCache != nil {
+		p.UseRmCache = strconv.FormatBool(*vt.rmCache)
+	}
+}
+
+// mismatch returns the name of the first volume setting that the given
+// volume does not have, or "" if it has all of them
+func (vt volumeTunables) mismatch(vol *siotypes.Volume) string {
+	if vt.rmCache != nil && vol.UseRmCache != *vt.rmCache {
+		return KeyRmCache
+	}
+	return ""
+}
+
+// validateVolSize uses the CapacityRange range params to determine what size
+// volume to create, and returns an error if volume size would be greater than
+// the given limit. Returned size is in KiB
+func validateVolSize(cr *csi.CapacityRange) (int64, error) {
+
+	minSize := cr.GetRequiredBytes()
+	maxSize := cr.GetLimitBytes()
+
+	if minSize == 0 {
+		minSize = DefaultVolumeSizeKiB
+	} else {
+		minSize = minSize / bytesInKiB
+	}
+
+	var (
+		sizeGiB int64
+		sizeKiB int64
+		sizeB   int64
+	)
+	// ScaleIO creates volumes in multiples of 8GiB, rounding up.
+	// Determine what actual size of volume will be, and check that
+	// we do not exceed maxSize
+	sizeGiB = minSize / kiBytesInGiB
+	mod := sizeGiB % VolSizeMultipleGiB
+	if mod > 0 {
+		sizeGiB = sizeGiB - mod + VolSizeMultipleGiB
+	}
+	sizeB = sizeGiB * bytesInGiB
+	if maxSize != 0 {
+		if sizeB > maxSize {
+			return 0, status.Errorf(
+				codes.OutOfRange,
+				"volume size %d > limit_bytes: %d", sizeB, maxSize)
+		}
+	}
+
+	sizeKiB = sizeGiB * kiBytesInGiB
+	return sizeKiB, nil
+}
+
+func (s *service) DeleteVolume(
+	ctx context.Context,
+	req *csi.DeleteVolumeRequest) (
+	*csi.DeleteVolumeResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	sys, id, err := s.getSystemForID(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := sys.getVolByID(id)
+	if err != nil {
+		if isVolumeNotFound(err) {
+			log.Debug("volume already deleted")
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failure checking volume status before deletion: %s",
+			err.Error())
+	}
+
+	if !isCSIVolume(vol) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"volume: %s is a snapshot", id)
+	}
+
+	if err := s.requireOwnership(vol, "volume"); err != nil {
+		return nil, err
+	}
+
+	if len(vol.MappedSdcInfo) > 0 {
+		// Volume is in use
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume in use by %s", vol.MappedSdcInfo[0].SdcID)
+	}
+
+	tgtVol := goscaleio.NewVolume(sys.client)
+	tgtVol.Volume = vol
+	err = tgtVol.RemoveVolume(removeModeOnlyMe)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error removing volume: %s", err.Error())
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (s *service) ControllerPublishVolume(
+	ctx context.Context,
+	req *csi.ControllerPublishVolumeRequest) (
+	*csi.ControllerPublishVolumeResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"volumeID is required")
+	}
+
+	sys, volID, err := s.getSystemForID(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := sys.getVolByID(volID)
+	if err != nil {
+		if isVolumeNotFound(err) {
+			return nil, status.Error(codes.NotFound,
+				"volume not found")
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failure checking volume status before controller publish: %s",
+			err.Error())
+	}
+
+	if err := s.requireOwnership(vol, "volume"); err != nil {
+		return nil, err
+	}
+
+	nodeID := req.GetNodeId()
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"node ID is required")
+	}
+
+	sdcID, err := sys.getSDCID(nodeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	setAuditSdcID(ctx, sdcID)
+
+	vc := req.GetVolumeCapability()
+	if vc == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"volume capability is required")
+	}
+
+	am := vc.GetAccessMode()
+	if am == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"access mode is required")
+	}
+
+	if am.Mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+		return nil, status.Error(codes.InvalidArgument,
+			errUnknownAccessMode)
+	}
+
+	qos, err := getVolumeQoS(req.GetVolumeAttributes())
+	if err != nil {
+		return nil, err
+	}
+
+	publishInfo := map[string]string{
+		PublishInfoKeyMdmID: sys.id(),
+	}
+
+	// Check if volume is published to any node already
+	if len(vol.MappedSdcInfo) > 0 {
+		vcs := []*csi.VolumeCapability{req.GetVolumeCapability()}
+		isBlock := accTypeIsBlock(vcs)
+
+		for _, sdc := range vol.MappedSdcInfo {
+			if sdc.SdcID == sdcID {
+				// TODO check if published volume is compatible with this request
+				// volume already mapped
+				log.Debug("volume already mapped")
+				if !qos.matches(sdc) {
+					if err := sys.setMappedSdcLimits(
+						vol.ID, sdcID, qos); err != nil {
+						return nil, status.Errorf(codes.Internal,
+							"error setting limits of volume mapping: %s",
+							err.Error())
+					}
+				}
+				return &csi.ControllerPublishVolumeResponse{
+					PublishInfo: publishInfo,
+				}, nil
+			}
+		}
+
+		// If volume has SINGLE_NODE cap, go no farther
+		switch am.Mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume already published to SDC id: %s", vol.MappedSdcInfo[0].SdcID)
+		}
+
+		// All remaining cases are MULTI_NODE, make sure volume has
+		// multi-map enabled
+		if !vol.MappingToAllSdcsEnabled {
+			return nil, status.Error(codes.FailedPrecondition,
+				errNoMultiMap)
+		}
+
+		if err := validateAccessType(am, isBlock); err != nil {
+			return nil, err
+		}
+	}
+
+	mapVolumeSdcParam := &siotypes.MapVolumeSdcParam{
+		SdcID: sdcID,
+		AllowMultipleMappings: "false",
+		AllSdcs:               "",
+	}
+
+	targetVolume := goscaleio.NewVolume(sys.client)
+	targetVolume.Volume = &siotypes.Volume{ID: vol.ID}
+
+	err = targetVolume.MapVolumeSdc(mapVolumeSdcParam)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error mapping volume to node: %s", err.Error())
+	}
+
+	// New mappings are not limited
+	if qos != (volumeQoS{}) {
+		if err := sys.setMappedSdcLimits(vol.ID, sdcID, qos); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error setting limits of volume mapping: %s", err.Error())
+		}
+	}
+
+	return &csi.ControllerPublishVolumeResponse{
+		PublishInfo: publishInfo,
+	}, nil
+}
 
 func validateAccessType(
 	am *csi.VolumeCapability_AccessMode,
@@ -376,15 +1063,19 @@ func (s *service) ControllerUnpublishVolume(
 		return nil, err
 	}
 
-	volID := req.GetVolumeId()
-	if volID == "" {
+	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument,
 			"volumeID is required")
 	}
 
-	vol, err := s.getVolByID(volID)
+	sys, volID, err := s.getSystemForID(ctx, req.GetVolumeId())
 	if err != nil {
-		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
+		return nil, err
+	}
+
+	vol, err := sys.getVolByID(volID)
+	if err != nil {
+		if isVolumeNotFound(err) {
 			return nil, status.Error(codes.NotFound,
 				"volume not found")
 		}
@@ -393,16 +1084,21 @@ func (s *service) ControllerUnpublishVolume(
 			err.Error())
 	}
 
+	if err := s.requireOwnership(vol, "volume"); err != nil {
+		return nil, err
+	}
+
 	nodeID := req.GetNodeId()
 	if nodeID == "" {
 		return nil, status.Error(codes.InvalidArgument,
 			"Node ID is required")
 	}
 
-	sdcID, err := s.getSDCID(nodeID)
+	sdcID, err := sys.getSDCID(nodeID)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, status.Error(codes.NotFound, err.Error())
 	}
+	setAuditSdcID(ctx, sdcID)
 
 	// check if volume is attached to node at all
 	mappedToNode := false
@@ -418,7 +1114,7 @@ func (s *service) ControllerUnpublishVolume(
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
-	targetVolume := goscaleio.NewVolume(s.adminClient)
+	targetVolume := goscaleio.NewVolume(sys.client)
 	targetVolume.Volume = vol
 
 	unmapVolumeSdcParam := &siotypes.UnmapVolumeSdcParam{
@@ -444,10 +1140,14 @@ func (s *service) ValidateVolumeCapabilities(
 		return nil, err
 	}
 
-	volID := req.GetVolumeId()
-	vol, err := s.getVolByID(volID)
+	sys, volID, err := s.getSystemForID(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := sys.getVolByID(volID)
 	if err != nil {
-		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
+		if isVolumeNotFound(err) {
 			return nil, status.Error(codes.NotFound,
 				"volume not found")
 		}
@@ -520,303 +1220,881 @@ func valVolumeCaps(
 		}
 	}
 
-	return supported, reason
+	return supported, reason
+}
+
+func (s *service) ListVolumes(
+	ctx context.Context,
+	req *csi.ListVolumesRequest) (
+	*csi.ListVolumesResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	var (
+		vols   []*csi.Volume
+		id     string
+		offset int
+	)
+
+	if token := req.StartingToken; token != "" {
+		// Return the next page of a listing
+		var (
+			entries interface{}
+			err     error
+			ok      bool
+		)
+		if id, offset, entries, err = s.volListings.resume(token); err != nil {
+			return nil, err
+		}
+		if vols, ok = entries.([]*csi.Volume); !ok {
+			return nil, status.Errorf(codes.Aborted,
+				"startingToken: %s is not a volume listing", token)
+		}
+		if offset > len(vols) {
+			return nil, status.Errorf(codes.Aborted,
+				"startingToken=%d > len(vols)=%d", offset, len(vols))
+		}
+	} else {
+		// make calls to the clusters to get all volumes. The systems
+		// that cannot be probed are left out of the listing.
+		for _, sys := range s.systems {
+			sys, err := s.requireSystem(ctx, sys)
+			if err != nil {
+				log.WithError(err).Warn("not listing volumes of system")
+				continue
+			}
+			// Volumes created from a snapshot or cloned are ScaleIO
+			// snapshots, which are listed along with the other snapshots
+			sioVols, err := sys.getVolumes()
+			if err != nil {
+				return nil, status.Errorf(
+					codes.Internal,
+					"unable to list volumes of system: %s, err: %s",
+					sys.SystemName, err.Error())
+			}
+			for _, vol := range sioVols {
+				if !isCSIVolume(vol) || !s.ownsVolume(vol) {
+					continue
+				}
+				vols = append(vols, sys.getCSIVolume(vol))
+			}
+		}
+	}
+
+	// Discern the number of remaining entries.
+	rem := len(vols) - offset
+
+	// If maxEntries is 0 or greater than the number of remaining entries then
+	// set maxEntries to the number of remaining entries.
+	maxEntries := int(req.MaxEntries)
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"maxEntries=%d < 0", maxEntries)
+	}
+	if maxEntries == 0 || maxEntries > rem {
+		maxEntries = rem
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, maxEntries)
+	for i, vol := range vols[offset : offset+maxEntries] {
+		entries[i] = &csi.ListVolumesResponse_Entry{
+			Volume: vol,
+		}
+	}
+
+	var nextToken string
+	if n := offset + maxEntries; n < len(vols) {
+		// The listing is kept, so that the following pages are taken
+		// from the same list of volumes
+		if id == "" {
+			id = s.volListings.add(vols)
+		}
+		nextToken = formatListToken(id, n)
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (s *service) GetCapacity(
+	ctx context.Context,
+	req *csi.GetCapacityRequest) (
+	*csi.GetCapacityResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	params := req.GetParameters()
+
+	sys, err := s.getSystemByName(ctx, params[KeySystemName])
+	if err != nil {
+		return nil, err
+	}
+
+	var statsFunc func() (*siotypes.Statistics, error)
+
+	// Default to get Capacity of system
+	statsFunc = sys.system.GetStatistics
+
+	// if candidate storage pools are given, get the largest capacity of
+	// the pools, as a volume is created in a single pool
+	if spRef := getPoolRef(params); spRef.isSelection() {
+		pools, err := sys.getCandidatePools(spRef)
+		if err != nil {
+			return nil, err
+		}
+		var availKiB int64
+		for _, pool := range pools {
+			avail, err := sys.getAvailableCapacity(pool)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal,
+					"unable to get storage pool stats: %s", err.Error())
+			}
+			if avail > availKiB {
+				availKiB = avail
+			}
+		}
+		return &csi.GetCapacityResponse{
+			AvailableCapacity: availKiB * bytesInKiB,
+		}, nil
+	}
+
+	// if storage pool is given, get capacity of storage pool
+	if spRef := getPoolRef(params); !spRef.isEmpty() {
+		sp, err := sys.getStoragePool(spRef)
+		if err != nil {
+			return nil, err
+		}
+		spc := goscaleio.NewStoragePoolEx(sys.client, sp)
+		statsFunc = spc.GetStatistics
+	}
+	stats, err := statsFunc()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to get system stats: %s", err.Error())
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: int64(stats.CapacityAvailableForVolumeAllocationInKb * bytesInKiB),
+	}, nil
+}
+
+func (s *service) ControllerGetCapabilities(
+	ctx context.Context,
+	req *csi.ControllerGetCapabilitiesRequest) (
+	*csi.ControllerGetCapabilitiesResponse, error) {
+
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// controllerProbe probes every system. A system that fails to probe does
+// not keep the others from being probed, and is probed again by the requests
+// that target it. An error is only returned when no system could be probed.
+func (s *service) controllerProbe(ctx context.Context) error {
+
+	if s.systems == nil {
+		cfgs := s.opts.getSystemConfigs()
+		systems := make([]*scaleioSystem, len(cfgs))
+		for i, cfg := range cfgs {
+			systems[i] = newScaleIOSystem(cfg)
+		}
+		s.systems = systems
+	}
+
+	if len(s.systems) == 1 {
+		return s.systems[0].probe()
+	}
+
+	var (
+		code   codes.Code
+		failed []string
+	)
+	for _, sys := range s.systems {
+		fields := log.Fields{"systemName": sys.SystemName}
+		if err := sys.probe(); err != nil {
+			log.WithFields(fields).WithError(err).Warn(
+				"unable to probe ScaleIO system")
+			code = status.Code(err)
+			failed = append(failed, fmt.Sprintf("system: %s: %s",
+				sys.SystemName, status.Convert(err).Message()))
+			continue
+		}
+		log.WithFields(fields).Debug("probed ScaleIO system")
+	}
+	if len(failed) == len(s.systems) {
+		return status.Error(code, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// requireProbe checks that the controller has been probed. The systems that
+// requests target are checked by requireSystem.
+func (s *service) requireProbe(ctx context.Context) error {
+	if s.systems == nil {
+		if !s.opts.AutoProbe {
+			return status.Error(codes.FailedPrecondition,
+				"Controller Service has not been probed")
+		}
+		log.Debug("probing controller service automatically")
+		if err := s.controllerProbe(ctx); err != nil {
+			return status.Errorf(codes.FailedPrecondition,
+				"failed to probe/init plugin: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *service) CreateSnapshot(
+	ctx context.Context,
+	req *csi.CreateSnapshotRequest) (
+	*csi.CreateSnapshotResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"'name' cannot be empty")
+	}
+
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"source volume ID is required")
+	}
+
+	sys, srcID, err := s.getSystemForID(ctx, req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	srcVol, err := sys.getVolByID(srcID)
+	if err != nil {
+		if isVolumeNotFound(err) {
+			return nil, status.Errorf(codes.NotFound,
+				"source volume: %s not found", srcID)
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failure checking source volume status: %s", err.Error())
+	}
+	if err := s.requireOwnership(srcVol, "volume"); err != nil {
+		return nil, err
+	}
+
+	snap, err := sys.createSnapshotVolume(s.getSnapshotName(name), srcVol)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: getCSISnapshot(sys.id(), snap),
+	}, nil
+}
+
+func (s *service) DeleteSnapshot(
+	ctx context.Context,
+	req *csi.DeleteSnapshotRequest) (
+	*csi.DeleteSnapshotResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"snapshot ID is required")
+	}
+
+	sys, id, err := s.getSystemForID(ctx, req.GetSnapshotId())
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := sys.getVolByID(id)
+	if err != nil {
+		if isVolumeNotFound(err) {
+			log.Debug("snapshot already deleted")
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failure checking snapshot status before deletion: %s",
+			err.Error())
+	}
+
+	// Volumes created from a snapshot or cloned are ScaleIO snapshots,
+	// but not CSI snapshots
+	if !isCSISnapshot(snap) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"volume: %s is not a snapshot", id)
+	}
+
+	if err := s.requireOwnership(snap, "snapshot"); err != nil {
+		return nil, err
+	}
+
+	if len(snap.MappedSdcInfo) > 0 {
+		// Snapshot is in use
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"snapshot in use by %s", snap.MappedSdcInfo[0].SdcID)
+	}
+
+	tgtVol := goscaleio.NewVolume(sys.client)
+	tgtVol.Volume = snap
+	if err := tgtVol.RemoveVolume(removeModeOnlyMe); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error removing snapshot: %s", err.Error())
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (s *service) ListVolumes(
+func (s *service) ListSnapshots(
 	ctx context.Context,
-	req *csi.ListVolumesRequest) (
-	*csi.ListVolumesResponse, error) {
+	req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse, error) {
 
 	if err := s.requireProbe(ctx); err != nil {
 		return nil, err
 	}
 
 	var (
-		startToken int
-		cacheLen   int
+		snaps  []*csi.Snapshot
+		id     string
+		offset int
 	)
 
-	if v := req.StartingToken; v != "" {
-		i, err := strconv.ParseInt(v, 10, 32)
+	switch {
+	case req.StartingToken != "":
+		// Return the next page of a listing
+		var (
+			entries interface{}
+			err     error
+			ok      bool
+		)
+		token := req.StartingToken
+		if id, offset, entries, err = s.volListings.resume(token); err != nil {
+			return nil, err
+		}
+		if snaps, ok = entries.([]*csi.Snapshot); !ok {
+			return nil, status.Errorf(codes.Aborted,
+				"startingToken: %s is not a snapshot listing", token)
+		}
+	case req.GetSnapshotId() != "":
+		// A snapshot of an unknown system does not exist
+		sys, id, err := s.getSystemForID(ctx, req.GetSnapshotId())
 		if err != nil {
-			return nil, status.Errorf(
-				codes.Aborted,
-				"unable to parse startingToken:%v into uint32",
-				req.StartingToken)
+			break
 		}
-		startToken = int(i)
-	}
-
-	// Get the length of cached volumes. Do it in a funcion so as not to
-	// hold the lock
-	func() {
-		s.volCacheRWL.RLock()
-		defer s.volCacheRWL.RUnlock()
-		cacheLen = len(s.volCache)
-	}()
-
-	var (
-		lvols      int
-		sioVols    []*siotypes.Volume
-		err        error
-		maxEntries = int(req.MaxEntries)
-	)
-
-	if startToken == 0 || (startToken > 0 && cacheLen == 0) {
-		// make call to cluster to get all volumes
-		sioVols, err = s.adminClient.GetVolume("", "", "", "", false)
+		snap, err := sys.getVolByID(id)
 		if err != nil {
-			return nil, status.Errorf(
-				codes.Internal,
-				"unable to list volumes: %s", err.Error())
-		}
-
-		lvols = len(sioVols)
-		if maxEntries > 0 && maxEntries < lvols {
-			// We want to cache this volume list so that we don't
-			// have to get all the volumes again on the next call
-			func() {
-				s.volCacheRWL.Lock()
-				defer s.volCacheRWL.Unlock()
-				s.volCache = make([]*siotypes.Volume, lvols)
-				copy(s.volCache, sioVols)
-				cacheLen = lvols
-			}()
+			if !isVolumeNotFound(err) {
+				return nil, status.Errorf(codes.Internal,
+					"unable to list snapshots: %s", err.Error())
+			}
+		} else if isCSISnapshot(snap) && s.ownsVolume(snap) {
+			csiSnap := getCSISnapshot(sys.id(), snap)
+			srcSys, srcID, err := s.getSystemForID(ctx, req.GetSourceVolumeId())
+			if req.GetSourceVolumeId() == "" ||
+				(err == nil && srcSys.id() == sys.id() &&
+					snap.AncestorVolumeID == srcID) {
+				snaps = []*csi.Snapshot{csiSnap}
+			}
+		}
+	case req.GetSourceVolumeId() != "":
+		sys, srcID, err := s.getSystemForID(ctx, req.GetSourceVolumeId())
+		if err != nil {
+			break
+		}
+		// Passing an ancestor ID without asking for snapshots returns
+		// the volumes whose ancestor is the given volume
+		sioSnaps, err := sys.client.GetVolume("", "", srcID, "", false)
+		if err != nil {
+			if !isVolumeNotFound(err) {
+				return nil, status.Errorf(codes.Internal,
+					"unable to list snapshots: %s", err.Error())
+			}
+		}
+		for _, snap := range sioSnaps {
+			if isCSISnapshot(snap) && s.ownsVolume(snap) {
+				snaps = append(snaps, getCSISnapshot(sys.id(), snap))
+			}
+		}
+	default:
+		// The systems that cannot be probed are left out of the listing
+		for _, sys := range s.systems {
+			sys, err := s.requireSystem(ctx, sys)
+			if err != nil {
+				log.WithError(err).Warn("not listing snapshots of system")
+				continue
+			}
+			sioSnaps, err := sys.client.GetVolume("", "", "", "", true)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal,
+					"unable to list snapshots of system: %s, err: %s",
+					sys.SystemName, err.Error())
+			}
+			for _, snap := range sioSnaps {
+				if isCSISnapshot(snap) && s.ownsVolume(snap) {
+					snaps = append(snaps, getCSISnapshot(sys.id(), snap))
+				}
+			}
 		}
-	} else {
-		lvols = cacheLen
 	}
 
-	if startToken > lvols {
-		return nil, status.Errorf(
-			codes.Aborted,
-			"startingToken=%d > len(vols)=%d",
-			startToken, lvols)
+	if offset > len(snaps) {
+		return nil, status.Errorf(codes.Aborted,
+			"startingToken=%d > len(snapshots)=%d", offset, len(snaps))
 	}
 
 	// Discern the number of remaining entries.
-	rem := lvols - startToken
+	rem := len(snaps) - offset
 
 	// If maxEntries is 0 or greater than the number of remaining entries then
 	// set maxEntries to the number of remaining entries.
+	maxEntries := int(req.MaxEntries)
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"maxEntries=%d < 0", maxEntries)
+	}
 	if maxEntries == 0 || maxEntries > rem {
 		maxEntries = rem
 	}
 
-	var (
-		entries = make(
-			[]*csi.ListVolumesResponse_Entry,
-			maxEntries)
-		source []*siotypes.Volume
-	)
-
-	if startToken == 0 && req.MaxEntries == 0 {
-		// Use the just populated sioVols
-		source = sioVols
-	} else {
-		// Return only the requested vols from the cache
-		cacheVols := make([]*siotypes.Volume, maxEntries)
-		// Copy vols from cache so we don't keep lock entire time
-		func() {
-			s.volCacheRWL.RLock()
-			defer s.volCacheRWL.RUnlock()
-			j := startToken
-			for i := 0; i < len(entries); i++ {
-				cacheVols[i] = s.volCache[i]
-				j++
-			}
-		}()
-		source = cacheVols
-	}
-
-	for i, vol := range source {
-		entries[i] = &csi.ListVolumesResponse_Entry{
-			Volume: getCSIVolume(vol),
+	entries := make([]*csi.ListSnapshotsResponse_Entry, maxEntries)
+	for i, snap := range snaps[offset : offset+maxEntries] {
+		entries[i] = &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snap,
 		}
 	}
 
 	var nextToken string
-	if n := startToken + len(source); n < lvols {
-		nextToken = fmt.Sprintf("%d", n)
+	if n := offset + maxEntries; n < len(snaps) {
+		// The listing is kept, so that the following pages are taken
+		// from the same list of snapshots
+		if id == "" {
+			id = s.volListings.add(snaps)
+		}
+		nextToken = formatListToken(id, n)
 	}
 
-	return &csi.ListVolumesResponse{
+	return &csi.ListSnapshotsResponse{
 		Entries:   entries,
 		NextToken: nextToken,
 	}, nil
 }
 
-func (s *service) GetCapacity(
+// CreateSnapshotGroup atomically snapshots a set of volumes, creating a
+// crash-consistent ScaleIO snapshot group. Every snapshot records the ID of
+// the group, so the group can later be listed and deleted as a whole.
+func (s *service) CreateSnapshotGroup(
 	ctx context.Context,
-	req *csi.GetCapacityRequest) (
-	*csi.GetCapacityResponse, error) {
+	req *CreateSnapshotGroupRequest) (
+	*CreateSnapshotGroupResponse, error) {
 
 	if err := s.requireProbe(ctx); err != nil {
 		return nil, err
 	}
 
-	var statsFunc func() (*siotypes.Statistics, error)
+	name := req.Name
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"'name' cannot be empty")
+	}
+	if len(req.SourceVolumeIds) == 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"source volume IDs are required")
+	}
 
-	// Default to get Capacity of system
-	statsFunc = s.system.GetStatistics
+	// A snapshot group can only be created within a single system
+	var sys *scaleioSystem
+	srcIDs := make([]string, len(req.SourceVolumeIds))
+	seen := map[string]bool{}
+	for i, id := range req.SourceVolumeIds {
+		srcSys, srcID, err := s.getSystemForID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if sys == nil {
+			sys = srcSys
+		} else if srcSys.id() != sys.id() {
+			return nil, status.Error(codes.InvalidArgument,
+				"source volumes must be in the same ScaleIO system")
+		}
+		if seen[srcID] {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"duplicate source volume ID: %s", id)
+		}
+		seen[srcID] = true
+		srcIDs[i] = srcID
+	}
 
-	params := req.GetParameters()
-	if len(params) > 0 {
-		// if storage pool is given, get capacity of storage pool
-		if spname, ok := params[KeyStoragePool]; ok {
-			sp, err := s.adminClient.FindStoragePool("", spname, "")
-			if err != nil {
-				return nil, status.Errorf(codes.Internal,
-					"unable to look up storage pool: %s, err: %s",
-					spname, err.Error())
+	fields := map[string]interface{}{
+		"name":            name,
+		"sourceVolumeIDs": srcIDs,
+	}
+
+	// The first member of the group is looked up by name to determine if
+	// the group has already been created
+	if id, err := sys.client.FindVolumeID(
+		s.getSnapshotGroupMemberName(name, 0)); err == nil {
+
+		snap, err := sys.getVolByID(id)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable,
+				"error retrieving snapshot details: %s", err.Error())
+		}
+		members, err := sys.getSnapshotGroup(snap.ConsistencyGroupID)
+		if err != nil {
+			return nil, err
+		}
+		ordered, ok := orderSnapshotGroup(srcIDs, members)
+		if !ok {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"snapshot group: %s exists, but with different sources",
+				name)
+		}
+		log.WithFields(fields).Debug("snapshot group already exists")
+		return newCreateSnapshotGroupResponse(
+			sys.id(), snap.ConsistencyGroupID, ordered), nil
+	}
+
+	for _, id := range srcIDs {
+		src, err := sys.getVolByID(id)
+		if err != nil {
+			if isVolumeNotFound(err) {
+				return nil, status.Errorf(codes.NotFound,
+					"source volume: %s not found", id)
 			}
-			spc := goscaleio.NewStoragePoolEx(s.adminClient, sp)
-			statsFunc = spc.GetStatistics
+			return nil, status.Errorf(codes.Internal,
+				"failure checking source volume status: %s", err.Error())
+		}
+		if err := s.requireOwnership(src, "volume"); err != nil {
+			return nil, err
 		}
 	}
-	stats, err := statsFunc()
+
+	log.WithFields(fields).Info("creating snapshot group")
+
+	snapParam := &siotypes.SnapshotVolumesParam{
+		SnapshotDefs: make([]*siotypes.SnapshotDef, len(srcIDs)),
+	}
+	for i, id := range srcIDs {
+		snapParam.SnapshotDefs[i] = &siotypes.SnapshotDef{
+			VolumeID:     id,
+			SnapshotName: s.getSnapshotGroupMemberName(name, i),
+		}
+	}
+	snapResp, err := sys.system.CreateSnapshotConsistencyGroup(snapParam)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
-			"unable to get system stats: %s", err.Error())
+			"error when creating snapshot group: %s", err.Error())
 	}
-	return &csi.GetCapacityResponse{
-		AvailableCapacity: int64(stats.CapacityAvailableForVolumeAllocationInKb * bytesInKiB),
-	}, nil
-}
 
-func (s *service) ControllerGetCapabilities(
-	ctx context.Context,
-	req *csi.ControllerGetCapabilitiesRequest) (
-	*csi.ControllerGetCapabilitiesResponse, error) {
+	members := make([]*siotypes.Volume, len(snapResp.VolumeIDList))
+	for i, id := range snapResp.VolumeIDList {
+		members[i], err = sys.getVolByID(id)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable,
+				"error retrieving snapshot details: %s", err.Error())
+		}
+	}
+	ordered, ok := orderSnapshotGroup(srcIDs, members)
+	if !ok {
+		return nil, status.Errorf(codes.Internal,
+			"snapshot group: %s does not match requested sources",
+			snapResp.SnapshotGroupID)
+	}
 
-	return &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
-				},
-			},
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-					},
-				},
-			},
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-					},
-				},
-			},
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-					},
-				},
-			},
-		},
-	}, nil
+	return newCreateSnapshotGroupResponse(
+		sys.id(), snapResp.SnapshotGroupID, ordered), nil
 }
 
-func (s *service) controllerProbe(ctx context.Context) error {
+// ListSnapshotGroup lists the snapshots that are members of a snapshot group
+func (s *service) ListSnapshotGroup(
+	ctx context.Context,
+	req *ListSnapshotGroupRequest) (
+	*ListSnapshotGroupResponse, error) {
 
-	// Check that we have the details needed to login to the Gateway
-	if s.opts.Endpoint == "" {
-		return status.Error(codes.FailedPrecondition,
-			"missing ScaleIO Gateway endpoint")
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
 	}
-	if s.opts.User == "" {
-		return status.Error(codes.FailedPrecondition,
-			"missing ScaleIO MDM user")
+
+	if req.SnapshotGroupId == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"snapshot group ID is required")
 	}
-	if s.opts.Password == "" {
-		return status.Error(codes.FailedPrecondition,
-			"missing ScaleIO MDM password")
+
+	sys, groupID, err := s.getSystemForID(ctx, req.SnapshotGroupId)
+	if err != nil {
+		return nil, err
 	}
-	if s.opts.SystemName == "" {
-		return status.Error(codes.FailedPrecondition,
-			"missing ScaleIO system name")
+
+	members, err := sys.getSnapshotGroup(groupID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create our ScaleIO API client, if needed
-	if s.adminClient == nil {
-		c, err := goscaleio.NewClientWithArgs(
-			s.opts.Endpoint, "", s.opts.Insecure, true)
-		if err != nil {
-			return status.Errorf(codes.FailedPrecondition,
-				"unable to create ScaleIO client: %s", err.Error())
+	rep := &ListSnapshotGroupResponse{
+		Snapshots: make([]*csi.Snapshot, 0, len(members)),
+	}
+	for _, snap := range members {
+		if s.ownsVolume(snap) {
+			rep.Snapshots = append(
+				rep.Snapshots, getCSISnapshot(sys.id(), snap))
 		}
-		s.adminClient = c
 	}
+	return rep, nil
+}
 
-	if s.adminClient.Token == "" {
-		_, err := s.adminClient.Authenticate(&goscaleio.ConfigConnect{
-			Endpoint: s.opts.Endpoint,
-			Username: s.opts.User,
-			Password: s.opts.Password,
-		})
-		if err != nil {
-			return status.Errorf(codes.FailedPrecondition,
-				"unable to login to ScaleIO Gateway: %s", err.Error())
+// DeleteSnapshotGroup deletes all of the snapshots that are members of a
+// snapshot group
+func (s *service) DeleteSnapshotGroup(
+	ctx context.Context,
+	req *DeleteSnapshotGroupRequest) (
+	*DeleteSnapshotGroupResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.SnapshotGroupId == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"snapshot group ID is required")
+	}
+
+	sys, groupID, err := s.getSystemForID(ctx, req.SnapshotGroupId)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := sys.getSnapshotGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		log.Debug("snapshot group already deleted")
+		return &DeleteSnapshotGroupResponse{}, nil
+	}
 
+	// Don't delete any member of the group if one of them is in use, or
+	// is not managed by the plugin
+	for _, snap := range members {
+		if err := s.requireOwnership(snap, "snapshot"); err != nil {
+			return nil, err
+		}
+		if len(snap.MappedSdcInfo) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"snapshot: %s in use by %s",
+				snap.ID, snap.MappedSdcInfo[0].SdcID)
 		}
 	}
 
-	if s.system == nil {
-		system, err := s.adminClient.FindSystem(
-			"", s.opts.SystemName, "")
-		if err != nil {
-			return status.Errorf(codes.FailedPrecondition,
-				"unable to find matching ScaleIO system name: %s",
-				err.Error())
+	for _, snap := range members {
+		tgtVol := goscaleio.NewVolume(sys.client)
+		tgtVol.Volume = snap
+		if err := tgtVol.RemoveVolume(removeModeOnlyMe); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error removing snapshot: %s, err: %s",
+				snap.ID, err.Error())
 		}
-		s.system = system
 	}
 
-	return nil
+	return &DeleteSnapshotGroupResponse{}, nil
 }
 
-func (s *service) requireProbe(ctx context.Context) error {
-	if s.adminClient == nil {
-		if !s.opts.AutoProbe {
-			return status.Error(codes.FailedPrecondition,
-				"Controller Service has not been probed")
-		}
-		log.Debug("probing controller service automatically")
-		if err := s.controllerProbe(ctx); err != nil {
-			return status.Errorf(codes.FailedPrecondition,
-				"failed to probe/init plugin: %s", err.Error())
+// getSnapshotGroup returns the snapshots that are members of the given
+// ScaleIO snapshot group
+func (sys *scaleioSystem) getSnapshotGroup(
+	groupID string) ([]*siotypes.Volume, error) {
+
+	snaps, err := sys.client.GetVolume("", "", "", "", true)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to list snapshots: %s", err.Error())
+	}
+
+	members := make([]*siotypes.Volume, 0)
+	for _, snap := range snaps {
+		if snap.ConsistencyGroupID == groupID {
+			members = append(members, snap)
 		}
 	}
-	return nil
+	return members, nil
 }
 
-func (s *service) CreateSnapshot(
-	ctx context.Context,
-	req *csi.CreateSnapshotRequest) (
-	*csi.CreateSnapshotResponse, error) {
+// getSnapshotGroupMemberName returns the name of the snapshot of the Nth
+// source volume of a snapshot group. The members are named like other
+// snapshots, as if their CO name was the name of the group followed by N.
+func (s *service) getSnapshotGroupMemberName(name string, n int) string {
+	return s.getSnapshotName(fmt.Sprintf("%s-%d", name, n))
+}
+
+// orderSnapshotGroup returns the members of a snapshot group in the order of
+// the given source volume IDs. The returned flag is false if the members are
+// not exactly one snapshot of each source volume.
+func orderSnapshotGroup(
+	srcIDs []string,
+	members []*siotypes.Volume) ([]*siotypes.Volume, bool) {
+
+	if len(srcIDs) != len(members) {
+		return nil, false
+	}
+
+	byAncestor := make(map[string]*siotypes.Volume, len(members))
+	for _, snap := range members {
+		byAncestor[snap.AncestorVolumeID] = snap
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	ordered := make([]*siotypes.Volume, len(srcIDs))
+	for i, id := range srcIDs {
+		snap, ok := byAncestor[id]
+		if !ok {
+			return nil, false
+		}
+		ordered[i] = snap
+	}
+	return ordered, true
 }
 
-func (s *service) DeleteSnapshot(
-	ctx context.Context,
-	req *csi.DeleteSnapshotRequest) (
-	*csi.DeleteSnapshotResponse, error) {
+func newCreateSnapshotGroupResponse(
+	systemID, groupID string,
+	members []*siotypes.Volume) *CreateSnapshotGroupResponse {
 
-	return nil, status.Error(codes.Unimplemented, "")
+	rep := &CreateSnapshotGroupResponse{
+		SnapshotGroupId: newVolumeID(systemID, groupID),
+		Snapshots:       make([]*csi.Snapshot, len(members)),
+	}
+	for i, snap := range members {
+		rep.Snapshots[i] = getCSISnapshot(systemID, snap)
+	}
+	return rep
 }
 
-func (s *service) ListSnapshots(
+// ControllerExpandVolume grows a volume to satisfy the requested capacity.
+// The new size is rounded up to a multiple of VolSizeMultipleGiB, as it is
+// for volume creation. Volumes are never shrunk.
+func (s *service) ControllerExpandVolume(
 	ctx context.Context,
-	req *csi.ListSnapshotsRequest) (
-	*csi.ListSnapshotsResponse, error) {
+	req *ControllerExpandVolumeRequest) (
+	*ControllerExpandVolumeResponse, error) {
+
+	if err := s.requireProbe(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"volumeID is required")
+	}
+
+	cr := req.CapacityRange
+	if cr.GetRequiredBytes() == 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"required_bytes is required")
+	}
+	sizeInKiB, err := validateVolSize(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	sys, id, err := s.getSystemForID(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := sys.getVolByID(id)
+	if err != nil {
+		if isVolumeNotFound(err) {
+			return nil, status.Error(codes.NotFound,
+				"volume not found")
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failure checking volume status before expansion: %s",
+			err.Error())
+	}
+
+	if err := s.requireOwnership(vol, "volume"); err != nil {
+		return nil, err
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	// Whether the volume is mapped says nothing of whether it has a
+	// filesystem, which may also be grown when it is next published, so
+	// only block volumes are known not to require node expansion
+	nodeExpansion := req.VolumeCapability.GetBlock() == nil
+
+	curSizeInKiB := int64(vol.SizeInKb)
+	if curSizeInKiB >= sizeInKiB {
+		log.WithField("id", id).Debug("volume already at requested size")
+		return &ControllerExpandVolumeResponse{
+			CapacityBytes:         curSizeInKiB * bytesInKiB,
+			NodeExpansionRequired: nodeExpansion,
+		}, nil
+	}
+
+	log.WithFields(map[string]interface{}{
+		"id":           id,
+		"curSizeInKiB": curSizeInKiB,
+		"sizeInKiB":    sizeInKiB,
+	}).Info("expanding volume")
+
+	if err := sys.setVolumeSize(vol.ID, sizeInKiB/kiBytesInGiB); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error expanding volume: %s", err.Error())
+	}
+
+	return &ControllerExpandVolumeResponse{
+		CapacityBytes:         sizeInKiB * bytesInKiB,
+		NodeExpansionRequired: nodeExpansion,
+	}, nil
 }
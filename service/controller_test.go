@@ -22,6 +22,8 @@ func TestControllerGetCaps(t *testing.T) {
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME: struct{}{},
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES:             struct{}{},
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY:             struct{}{},
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT:   struct{}{},
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS:           struct{}{},
 	}
 
 	resp, err := client.ControllerGetCapabilities(ctx,
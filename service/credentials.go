@@ -0,0 +1,200 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// credentials are the user name and password used to log in to a Gateway
+type credentials struct {
+	user     string
+	password string
+}
+
+// credentialsSource provides the credentials used to log in to the Gateways
+// of a system. The user name and password may be read from files, such as
+// mounted secrets, that are checked for changes before every request. New
+// credentials are pending until a Gateway accepts them: logins try them
+// first, and fall back to the previous credentials while they are rejected.
+type credentialsSource struct {
+	userFile     string
+	passwordFile string
+
+	credsRWL sync.RWMutex
+	current  credentials
+	pending  *credentials
+	// gen is incremented every time new credentials are read
+	gen    uint64
+	mtimes map[string]time.Time
+}
+
+// newCredentialsSource returns a source of the given credentials. The user
+// name and password are read from the given files instead, when set.
+func newCredentialsSource(
+	user, password, userFile, passwordFile string) (*credentialsSource, error) {
+
+	cs := &credentialsSource{
+		userFile:     userFile,
+		passwordFile: passwordFile,
+		current: credentials{
+			user:     user,
+			password: password,
+		},
+	}
+
+	mtimes, err := cs.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := cs.read()
+	if err != nil {
+		return nil, err
+	}
+	cs.current = creds
+	cs.mtimes = mtimes
+
+	return cs, nil
+}
+
+// files returns the paths of the files that the credentials are read from
+func (cs *credentialsSource) files() []string {
+	var files []string
+	for _, f := range []string{cs.userFile, cs.passwordFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// modTimes returns the modification times of the credentials files
+func (cs *credentialsSource) modTimes() (map[string]time.Time, error) {
+	mtimes := map[string]time.Time{}
+	for _, f := range cs.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		mtimes[f] = fi.ModTime()
+	}
+	return mtimes, nil
+}
+
+// read returns the current credentials, with the user name and password
+// replaced by the contents of their files
+func (cs *credentialsSource) read() (credentials, error) {
+	creds := cs.get()
+	readFile := func(path string, v *string) error {
+		if path == "" {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		*v = strings.TrimRight(string(b), "\r\n")
+		return nil
+	}
+	if err := readFile(cs.userFile, &creds.user); err != nil {
+		return credentials{}, err
+	}
+	if err := readFile(cs.passwordFile, &creds.password); err != nil {
+		return credentials{}, err
+	}
+	return creds, nil
+}
+
+// get returns the credentials last accepted by a Gateway
+func (cs *credentialsSource) get() credentials {
+	cs.credsRWL.RLock()
+	defer cs.credsRWL.RUnlock()
+	return cs.current
+}
+
+// getGen returns the generation of the credentials
+func (cs *credentialsSource) getGen() uint64 {
+	cs.credsRWL.RLock()
+	defer cs.credsRWL.RUnlock()
+	return cs.gen
+}
+
+// candidates returns the credentials to log in with, in the order they
+// should be tried in, and their generation
+func (cs *credentialsSource) candidates() ([]credentials, uint64) {
+	cs.credsRWL.RLock()
+	defer cs.credsRWL.RUnlock()
+	if cs.pending != nil {
+		return []credentials{*cs.pending, cs.current}, cs.gen
+	}
+	return []credentials{cs.current}, cs.gen
+}
+
+// accept records that a Gateway accepted the given credentials. Pending
+// credentials that are accepted replace the previous ones.
+func (cs *credentialsSource) accept(creds credentials) {
+	cs.credsRWL.Lock()
+	defer cs.credsRWL.Unlock()
+	if cs.pending == nil || *cs.pending != creds {
+		return
+	}
+	cs.current = creds
+	cs.pending = nil
+	log.WithField("user", creds.user).Info(
+		"new ScaleIO Gateway credentials accepted")
+}
+
+// reload reads the credentials files if they have changed. Changed
+// credentials become pending, and the generation is incremented.
+func (cs *credentialsSource) reload() {
+	if len(cs.files()) == 0 {
+		return
+	}
+
+	mtimes, err := cs.modTimes()
+	if err != nil {
+		log.WithError(err).Warn(
+			"unable to check ScaleIO Gateway credentials files")
+		return
+	}
+	if !cs.changed(mtimes) {
+		return
+	}
+	creds, err := cs.read()
+	if err != nil {
+		log.WithError(err).Error(
+			"unable to read ScaleIO Gateway credentials files, keeping previous")
+		return
+	}
+
+	cs.credsRWL.Lock()
+	defer cs.credsRWL.Unlock()
+	cs.mtimes = mtimes
+	if creds == cs.current {
+		cs.pending = nil
+		return
+	}
+	if cs.pending != nil && creds == *cs.pending {
+		return
+	}
+	cs.pending = &creds
+	cs.gen++
+	log.WithField("files", cs.files()).Info(
+		"read new ScaleIO Gateway credentials")
+}
+
+// changed returns whether a file has changed since it was read
+func (cs *credentialsSource) changed(mtimes map[string]time.Time) bool {
+	cs.credsRWL.RLock()
+	defer cs.credsRWL.RUnlock()
+	for f, mt := range mtimes {
+		if !mt.Equal(cs.mtimes[f]) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,9 +2,15 @@ package service
 
 const (
 	// EnvEndpoint is the name of the enviroment variable used to set the
-	// HTTP endpoint of the ScaleIO Gateway
+	// HTTP endpoint of the ScaleIO Gateway. Several endpoints, of Gateways
+	// of the same system, may be given as a comma-separated list.
 	EnvEndpoint = "X_CSI_SCALEIO_ENDPOINT"
 
+	// EnvEndpointPolicy is the name of the environment variable used to set
+	// how the endpoint that serves a request is chosen when several
+	// endpoints are given: "failover" or "roundrobin"
+	EnvEndpointPolicy = "X_CSI_SCALEIO_ENDPOINTPOLICY"
+
 	// EnvUser is the name of the enviroment variable used to set the
 	// username when authenticating to the ScaleIO Gateway
 	EnvUser = "X_CSI_SCALEIO_USER"
@@ -13,15 +19,70 @@ const (
 	// user's password when authenticating to the ScaleIO Gateway
 	EnvPassword = "X_CSI_SCALEIO_PASSWORD"
 
+	// EnvUserFile is the name of the environment variable used to set the
+	// path of a file that the username is read from, instead of EnvUser
+	EnvUserFile = "X_CSI_SCALEIO_USERFILE"
+
+	// EnvPasswordFile is the name of the environment variable used to set
+	// the path of a file that the password is read from, instead of
+	// EnvPassword
+	EnvPasswordFile = "X_CSI_SCALEIO_PASSWORDFILE"
+
 	// EnvInsecure is the name of the enviroment variable used to specify
 	// that the ScaleIO Gateway's certificate chain and host name should not
 	// be verified
 	EnvInsecure = "X_CSI_SCALEIO_INSECURE"
 
+	// EnvCACerts is the name of the environment variable used to set the
+	// path of a PEM file of the CA certificates that the ScaleIO Gateway's
+	// certificate is verified with
+	EnvCACerts = "X_CSI_SCALEIO_CACERTS"
+
+	// EnvClientCert is the name of the environment variable used to set the
+	// path of a PEM file of the client certificate presented to the ScaleIO
+	// Gateway
+	EnvClientCert = "X_CSI_SCALEIO_CLIENTCERT"
+
+	// EnvClientKey is the name of the environment variable used to set the
+	// path of a PEM file of the key of the client certificate
+	EnvClientKey = "X_CSI_SCALEIO_CLIENTKEY"
+
+	// EnvCertPins is the name of the environment variable used to set a
+	// comma-separated list of the base64 encoded SHA-256 hashes of the
+	// public keys that are accepted in the ScaleIO Gateway's certificate
+	// chain
+	EnvCertPins = "X_CSI_SCALEIO_CERTPINS"
+
+	// EnvMetricsAddress is the name of the environment variable used to set
+	// the address, such as ":9100", that the Prometheus metrics are served
+	// on. The metrics are not served when it is not set.
+	EnvMetricsAddress = "X_CSI_SCALEIO_METRICSADDRESS"
+
+	// EnvOTLPEndpoint is the name of the environment variable used to set
+	// the OTLP/HTTP endpoint, such as "http://otel-collector:4318", that
+	// trace spans are exported to
+	EnvOTLPEndpoint = "X_CSI_SCALEIO_OTLPENDPOINT"
+
+	// EnvTraceFile is the name of the environment variable used to set the
+	// path of a file that trace spans are appended to, as OTLP JSON, when
+	// EnvOTLPEndpoint is not set
+	EnvTraceFile = "X_CSI_SCALEIO_TRACEFILE"
+
+	// EnvAuditFile is the name of the environment variable used to set the
+	// path of the file that the audit log of mutating operations is
+	// appended to
+	EnvAuditFile = "X_CSI_SCALEIO_AUDITFILE"
+
 	// EnvSystemName is the name of the enviroment variable used to set the
 	// name of the ScaleIO system to interact with
 	EnvSystemName = "X_CSI_SCALEIO_SYSTEMNAME"
 
+	// EnvSystemsFile is the name of the environment variable used to set
+	// the path of a JSON file that configures several ScaleIO systems, and
+	// their Gateways, to interact with. When set, the endpoint, user,
+	// password, insecure and system name environment variables are ignored.
+	EnvSystemsFile = "X_CSI_SCALEIO_SYSTEMSFILE"
+
 	// EnvSDCGUID is the name of the enviroment variable used to set the
 	// GUID of the SDC. This is only used by the Node Service, and removes
 	// a need for calling an external binary to retrieve the GUID
@@ -31,9 +92,37 @@ const (
 	// that thick provisioning should be used when creating volumes
 	EnvThick = "X_CSI_SCALEIO_THICKPROVISIONING"
 
+	// EnvVolumeNamePrefix is the name of the environment variable used to
+	// set the prefix of the names of the ScaleIO volumes and snapshots
+	// created by the plugin
+	EnvVolumeNamePrefix = "X_CSI_SCALEIO_VOLUMENAMEPREFIX"
+
+	// EnvVolumeNameTemplate is the name of the environment variable used to
+	// set the template of the names of the ScaleIO volumes created by the
+	// plugin, such as "{cluster}-{namespace}-{pvcname}"
+	EnvVolumeNameTemplate = "X_CSI_SCALEIO_VOLUMENAMETEMPLATE"
+
+	// EnvPrefixedVolumesOnly is the name of the environment variable used
+	// to specify that the plugin only lists, modifies and deletes the
+	// volumes and snapshots named with the volume name prefix
+	EnvPrefixedVolumesOnly = "X_CSI_SCALEIO_PREFIXEDVOLUMESONLY"
+
+	// EnvStoragePool is the name of the environment variable used to set
+	// the storage pool that volumes are created in when the volume create
+	// parameters name none. It may be "auto", to select the pool with the
+	// most available capacity, or a comma-separated list of candidate
+	// pools.
+	EnvStoragePool = "X_CSI_SCALEIO_STORAGEPOOL"
+
 	// EnvAutoProbe is the name of the environment variable used to specify
 	// that the controller service should automatically probe itself if it
 	// receives incoming requests before having been probed, in direct
 	// violation of the CSI spec
 	EnvAutoProbe = "X_CSI_SCALEIO_AUTOPROBE"
+
+	// EnvProtectionDomains is the name of the environment variable used to
+	// set a comma-separated list of the names of the protection domains
+	// whose SDSs the node can reach. This is only used by the Node Service,
+	// which reports the protection domains as topology segments.
+	EnvProtectionDomains = "X_CSI_SCALEIO_PROTECTIONDOMAINS"
 )
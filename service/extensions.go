@@ -0,0 +1,304 @@
+package service
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExtensionsService is the name of the gRPC service that provides the
+// ScaleIO specific operations that are not part of the CSI specification.
+// The service is served on the same endpoint as the CSI services, and its
+// methods are invoked as "/<ExtensionsService>/<Method>".
+const ExtensionsService = "com.thecodeteam.scaleio.v0.Extensions"
+
+// CreateSnapshotGroupRequest is the request of the CreateSnapshotGroup
+// extension method
+type CreateSnapshotGroupRequest struct {
+	// Name is used as the base name of the snapshots in the group. The
+	// snapshot of the Nth source volume is named "<Name>-<N>".
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// SourceVolumeIds are the IDs of the volumes to snapshot together
+	SourceVolumeIds []string `protobuf:"bytes,2,rep,name=source_volume_ids,json=sourceVolumeIds,proto3" json:"source_volume_ids,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *CreateSnapshotGroupRequest) Reset() { *m = CreateSnapshotGroupRequest{} }
+
+// String implements proto.Message
+func (m *CreateSnapshotGroupRequest) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*CreateSnapshotGroupRequest) ProtoMessage() {}
+
+// CreateSnapshotGroupResponse is the response of the CreateSnapshotGroup
+// extension method
+type CreateSnapshotGroupResponse struct {
+	// SnapshotGroupId is the ID of the ScaleIO snapshot group
+	SnapshotGroupId string `protobuf:"bytes,1,opt,name=snapshot_group_id,json=snapshotGroupId,proto3" json:"snapshot_group_id,omitempty"`
+	// Snapshots are the members of the group, in the order of the
+	// requested source volumes
+	Snapshots []*csi.Snapshot `protobuf:"bytes,2,rep,name=snapshots,proto3" json:"snapshots,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *CreateSnapshotGroupResponse) Reset() { *m = CreateSnapshotGroupResponse{} }
+
+// String implements proto.Message
+func (m *CreateSnapshotGroupResponse) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*CreateSnapshotGroupResponse) ProtoMessage() {}
+
+// ListSnapshotGroupRequest is the request of the ListSnapshotGroup
+// extension method
+type ListSnapshotGroupRequest struct {
+	SnapshotGroupId string `protobuf:"bytes,1,opt,name=snapshot_group_id,json=snapshotGroupId,proto3" json:"snapshot_group_id,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *ListSnapshotGroupRequest) Reset() { *m = ListSnapshotGroupRequest{} }
+
+// String implements proto.Message
+func (m *ListSnapshotGroupRequest) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*ListSnapshotGroupRequest) ProtoMessage() {}
+
+// ListSnapshotGroupResponse is the response of the ListSnapshotGroup
+// extension method
+type ListSnapshotGroupResponse struct {
+	Snapshots []*csi.Snapshot `protobuf:"bytes,1,rep,name=snapshots,proto3" json:"snapshots,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *ListSnapshotGroupResponse) Reset() { *m = ListSnapshotGroupResponse{} }
+
+// String implements proto.Message
+func (m *ListSnapshotGroupResponse) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*ListSnapshotGroupResponse) ProtoMessage() {}
+
+// DeleteSnapshotGroupRequest is the request of the DeleteSnapshotGroup
+// extension method
+type DeleteSnapshotGroupRequest struct {
+	SnapshotGroupId string `protobuf:"bytes,1,opt,name=snapshot_group_id,json=snapshotGroupId,proto3" json:"snapshot_group_id,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *DeleteSnapshotGroupRequest) Reset() { *m = DeleteSnapshotGroupRequest{} }
+
+// String implements proto.Message
+func (m *DeleteSnapshotGroupRequest) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*DeleteSnapshotGroupRequest) ProtoMessage() {}
+
+// DeleteSnapshotGroupResponse is the response of the DeleteSnapshotGroup
+// extension method
+type DeleteSnapshotGroupResponse struct{}
+
+// Reset implements proto.Message
+func (m *DeleteSnapshotGroupResponse) Reset() { *m = DeleteSnapshotGroupResponse{} }
+
+// String implements proto.Message
+func (m *DeleteSnapshotGroupResponse) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*DeleteSnapshotGroupResponse) ProtoMessage() {}
+
+// ControllerExpandVolumeRequest is the request of the ControllerExpandVolume
+// extension method
+type ControllerExpandVolumeRequest struct {
+	VolumeId      string             `protobuf:"bytes,1,opt,name=volume_id,json=volumeId,proto3" json:"volume_id,omitempty"`
+	CapacityRange *csi.CapacityRange `protobuf:"bytes,2,opt,name=capacity_range,json=capacityRange,proto3" json:"capacity_range,omitempty"`
+	// VolumeCapability is the capability the volume is used with, if
+	// known. Node expansion is not required for block volumes.
+	VolumeCapability *csi.VolumeCapability `protobuf:"bytes,3,opt,name=volume_capability,json=volumeCapability,proto3" json:"volume_capability,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *ControllerExpandVolumeRequest) Reset() { *m = ControllerExpandVolumeRequest{} }
+
+// String implements proto.Message
+func (m *ControllerExpandVolumeRequest) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*ControllerExpandVolumeRequest) ProtoMessage() {}
+
+// ControllerExpandVolumeResponse is the response of the
+// ControllerExpandVolume extension method
+type ControllerExpandVolumeResponse struct {
+	// CapacityBytes is the size of the volume after expansion
+	CapacityBytes int64 `protobuf:"varint,1,opt,name=capacity_bytes,json=capacityBytes,proto3" json:"capacity_bytes,omitempty"`
+	// NodeExpansionRequired indicates that NodeExpandVolume must be called
+	// on the node the volume is published to, or will be published to, to
+	// grow its filesystem. It is only false for block volumes.
+	NodeExpansionRequired bool `protobuf:"varint,2,opt,name=node_expansion_required,json=nodeExpansionRequired,proto3" json:"node_expansion_required,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *ControllerExpandVolumeResponse) Reset() { *m = ControllerExpandVolumeResponse{} }
+
+// String implements proto.Message
+func (m *ControllerExpandVolumeResponse) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*ControllerExpandVolumeResponse) ProtoMessage() {}
+
+// NodeExpandVolumeRequest is the request of the NodeExpandVolume extension
+// method
+type NodeExpandVolumeRequest struct {
+	VolumeId string `protobuf:"bytes,1,opt,name=volume_id,json=volumeId,proto3" json:"volume_id,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *NodeExpandVolumeRequest) Reset() { *m = NodeExpandVolumeRequest{} }
+
+// String implements proto.Message
+func (m *NodeExpandVolumeRequest) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*NodeExpandVolumeRequest) ProtoMessage() {}
+
+// NodeExpandVolumeResponse is the response of the NodeExpandVolume extension
+// method
+type NodeExpandVolumeResponse struct {
+	// CapacityBytes is the size of the device on the node after expansion
+	CapacityBytes int64 `protobuf:"varint,1,opt,name=capacity_bytes,json=capacityBytes,proto3" json:"capacity_bytes,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *NodeExpandVolumeResponse) Reset() { *m = NodeExpandVolumeResponse{} }
+
+// String implements proto.Message
+func (m *NodeExpandVolumeResponse) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*NodeExpandVolumeResponse) ProtoMessage() {}
+
+// ImportVolumeRequest is the request of the ImportVolume extension method
+type ImportVolumeRequest struct {
+	// Volume is the name or the ScaleIO ID of the existing volume
+	Volume string `protobuf:"bytes,1,opt,name=volume,proto3" json:"volume,omitempty"`
+	// Parameters are the volume create parameters that the volume is
+	// checked against, and whose QoS limits are recorded in its attributes
+	Parameters    map[string]string  `protobuf:"bytes,2,rep,name=parameters,proto3" json:"parameters,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	CapacityRange *csi.CapacityRange `protobuf:"bytes,3,opt,name=capacity_range,json=capacityRange,proto3" json:"capacity_range,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *ImportVolumeRequest) Reset() { *m = ImportVolumeRequest{} }
+
+// String implements proto.Message
+func (m *ImportVolumeRequest) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*ImportVolumeRequest) ProtoMessage() {}
+
+// ImportVolumeResponse is the response of the ImportVolume extension method
+type ImportVolumeResponse struct {
+	// Volume is the imported volume, as CreateVolume would return it
+	Volume *csi.Volume `protobuf:"bytes,1,opt,name=volume,proto3" json:"volume,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *ImportVolumeResponse) Reset() { *m = ImportVolumeResponse{} }
+
+// String implements proto.Message
+func (m *ImportVolumeResponse) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*ImportVolumeResponse) ProtoMessage() {}
+
+// extMethod describes a unary extension method
+type extMethod struct {
+	newReq func() proto.Message
+	invoke func(context.Context, proto.Message) (proto.Message, error)
+}
+
+// extMethods returns the extension methods, keyed by full method name
+func (s *service) extMethods() map[string]extMethod {
+	return map[string]extMethod{
+		"/" + ExtensionsService + "/CreateSnapshotGroup": {
+			newReq: func() proto.Message { return &CreateSnapshotGroupRequest{} },
+			invoke: func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.CreateSnapshotGroup(ctx, req.(*CreateSnapshotGroupRequest))
+			},
+		},
+		"/" + ExtensionsService + "/ListSnapshotGroup": {
+			newReq: func() proto.Message { return &ListSnapshotGroupRequest{} },
+			invoke: func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.ListSnapshotGroup(ctx, req.(*ListSnapshotGroupRequest))
+			},
+		},
+		"/" + ExtensionsService + "/DeleteSnapshotGroup": {
+			newReq: func() proto.Message { return &DeleteSnapshotGroupRequest{} },
+			invoke: func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.DeleteSnapshotGroup(ctx, req.(*DeleteSnapshotGroupRequest))
+			},
+		},
+		"/" + ExtensionsService + "/ControllerExpandVolume": {
+			newReq: func() proto.Message { return &ControllerExpandVolumeRequest{} },
+			invoke: func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.ControllerExpandVolume(ctx, req.(*ControllerExpandVolumeRequest))
+			},
+		},
+		"/" + ExtensionsService + "/NodeExpandVolume": {
+			newReq: func() proto.Message { return &NodeExpandVolumeRequest{} },
+			invoke: func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.NodeExpandVolume(ctx, req.(*NodeExpandVolumeRequest))
+			},
+		},
+		"/" + ExtensionsService + "/ImportVolume": {
+			newReq: func() proto.Message { return &ImportVolumeRequest{} },
+			invoke: func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.ImportVolume(ctx, req.(*ImportVolumeRequest))
+			},
+		},
+	}
+}
+
+// handleExtension is registered as the gRPC server's handler for unknown
+// services, and dispatches calls to the extension methods
+func (s *service) handleExtension(srv interface{}, stream grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal,
+			"unable to determine method of request")
+	}
+
+	m, ok := s.extMethods()[method]
+	if !ok {
+		return status.Errorf(codes.Unimplemented,
+			"unknown method: %s", method)
+	}
+
+	req := m.newReq()
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+
+	log.WithField("method", method).Debugf("extension request: %s", req)
+
+	// The interceptors of the gRPC server do not apply to unknown
+	// services, so the extension methods run them like the CSI methods
+	rep, err := s.extInterceptor(stream.Context(), req,
+		&grpc.UnaryServerInfo{Server: srv, FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return m.invoke(ctx, req.(proto.Message))
+		})
+	if err != nil {
+		log.WithField("method", method).WithError(err).Debug(
+			"extension request failed")
+		return err
+	}
+
+	return stream.SendMsg(rep)
+}
@@ -0,0 +1,306 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EndpointPolicyFailover sends every request to the first healthy
+	// Gateway endpoint, in the configured order
+	EndpointPolicyFailover = "failover"
+
+	// EndpointPolicyRoundRobin spreads requests across the healthy Gateway
+	// endpoints
+	EndpointPolicyRoundRobin = "roundrobin"
+
+	// endpointRetryInterval is how long an endpoint that failed is skipped
+	// for, unless no other endpoint is healthy
+	endpointRetryInterval = 30 * time.Second
+)
+
+// gatewayEndpoint is a Gateway endpoint, along with its health
+type gatewayEndpoint struct {
+	url *url.URL
+	// rt sends requests to the endpoint. Each endpoint has its own
+	// transport, as sessions are not shared between Gateways.
+	rt http.RoundTripper
+
+	healthRWL sync.RWMutex
+	downSince time.Time
+	failures  int
+}
+
+func (ep *gatewayEndpoint) healthy(now time.Time) bool {
+	ep.healthRWL.RLock()
+	defer ep.healthRWL.RUnlock()
+	return ep.failures == 0 ||
+		now.Sub(ep.downSince) >= endpointRetryInterval
+}
+
+func (ep *gatewayEndpoint) markDown(err error) {
+	ep.healthRWL.Lock()
+	defer ep.healthRWL.Unlock()
+	ep.failures++
+	ep.downSince = time.Now()
+	log.WithError(err).WithFields(log.Fields{
+		"endpoint": ep.url.Host,
+		"failures": ep.failures,
+	}).Warn("ScaleIO Gateway endpoint failed")
+}
+
+func (ep *gatewayEndpoint) markUp() {
+	ep.healthRWL.Lock()
+	defer ep.healthRWL.Unlock()
+	if ep.failures > 0 {
+		log.WithField("endpoint", ep.url.Host).Info(
+			"ScaleIO Gateway endpoint recovered")
+	}
+	ep.failures = 0
+}
+
+// failoverTransport is an http.RoundTripper that sends requests to one of
+// several Gateways of the same system. An endpoint that fails to respond,
+// or responds that it is unavailable, is marked as down, and the request is
+// sent to the next endpoint, unless it is not idempotent and may have reached
+// the endpoint. Endpoints that are down are only used again after
+// endpointRetryInterval, or when all endpoints are down.
+type failoverTransport struct {
+	endpoints  []*gatewayEndpoint
+	roundRobin bool
+	next       uint32
+
+	// served is the endpoint that served the last request, so that
+	// switches between endpoints are logged
+	servedRWL sync.RWMutex
+	served    *gatewayEndpoint
+}
+
+// newFailoverTransport returns a transport that sends requests to the given
+// endpoints. newRT returns the transport used to send requests to an
+// endpoint.
+func newFailoverTransport(
+	endpoints []*url.URL,
+	policy string,
+	newRT func(*url.URL) http.RoundTripper) (*failoverTransport, error) {
+
+	t := &failoverTransport{}
+
+	switch policy {
+	case "", EndpointPolicyFailover:
+	case EndpointPolicyRoundRobin:
+		t.roundRobin = true
+	default:
+		return nil, fmt.Errorf("invalid endpoint policy: %s", policy)
+	}
+
+	for _, u := range endpoints {
+		t.endpoints = append(t.endpoints, &gatewayEndpoint{
+			url: u,
+			rt:  newRT(u),
+		})
+	}
+
+	return t, nil
+}
+
+// order returns the endpoints in the order they should be tried in: the
+// healthy endpoints first, starting from the next endpoint in round-robin
+// mode, followed by the endpoints that are down
+func (t *failoverTransport) order() []*gatewayEndpoint {
+	n := len(t.endpoints)
+	start := 0
+	if t.roundRobin {
+		start = int((atomic.AddUint32(&t.next, 1) - 1) % uint32(n))
+	}
+
+	now := time.Now()
+	healthy := make([]*gatewayEndpoint, 0, n)
+	var down []*gatewayEndpoint
+	for i := 0; i < n; i++ {
+		ep := t.endpoints[(start+i)%n]
+		if ep.healthy(now) {
+			healthy = append(healthy, ep)
+		} else {
+			down = append(down, ep)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *failoverTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+
+	// The body is buffered, so that the request can be sent to another
+	// endpoint
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lastErr error
+	for _, ep := range t.order() {
+		ctx, sp := startGatewaySpan(req, ep.url.Host)
+		start := time.Now()
+		resp, err := ep.rt.RoundTrip(
+			withEndpoint(req.WithContext(ctx), body, ep.url))
+		defaultMetrics.observeGatewayRequest(
+			ep.url.Host, time.Since(start), resp, err)
+		finishGatewaySpan(sp, resp, err)
+		if err == nil && !endpointUnavailable(resp.StatusCode) {
+			ep.markUp()
+			t.setServed(ep, lastErr)
+			log.WithFields(log.Fields{
+				"endpoint": ep.url.Host,
+				"method":   req.Method,
+				"path":     req.URL.Path,
+				"status":   resp.StatusCode,
+			}).Debug("request served by ScaleIO Gateway")
+			return resp, nil
+		}
+
+		failure := err
+		if failure == nil {
+			failure = fmt.Errorf("unexpected response: %s", resp.Status)
+		}
+		// A canceled request says nothing of the health of the endpoint
+		canceled := req.Context().Err() != nil
+		if !canceled {
+			ep.markDown(failure)
+			if !canFailOver(req, err) {
+				// The endpoint may have carried out the request, so
+				// it is not sent again. The caller looks up whether
+				// it was.
+				log.WithError(failure).WithFields(log.Fields{
+					"endpoint": ep.url.Host,
+					"method":   req.Method,
+					"path":     req.URL.Path,
+				}).Warn("not failing over request that may have " +
+					"reached ScaleIO Gateway")
+				return resp, err
+			}
+		}
+		if resp != nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if canceled {
+			return nil, req.Context().Err()
+		}
+		lastErr = failure
+	}
+
+	log.WithError(lastErr).WithFields(log.Fields{
+		"method": req.Method,
+		"path":   req.URL.Path,
+	}).Warn("no ScaleIO Gateway endpoint available")
+	return nil, fmt.Errorf(
+		"no ScaleIO Gateway endpoint available, last error: %s",
+		lastErr.Error())
+}
+
+// setServed records the endpoint that served a request. A request that was
+// served after another endpoint failed is logged, as is the switch to
+// another endpoint in failover mode, where the same endpoint otherwise
+// serves every request.
+func (t *failoverTransport) setServed(ep *gatewayEndpoint, failure error) {
+	t.servedRWL.RLock()
+	prev := t.served
+	t.servedRWL.RUnlock()
+	if prev == ep && failure == nil {
+		return
+	}
+
+	t.servedRWL.Lock()
+	prev, t.served = t.served, ep
+	t.servedRWL.Unlock()
+
+	switch {
+	case failure != nil:
+		log.WithError(failure).WithField("endpoint", ep.url.Host).Info(
+			"request failed over to ScaleIO Gateway endpoint")
+	case prev != nil && prev != ep && !t.roundRobin:
+		log.WithFields(log.Fields{
+			"endpoint":         ep.url.Host,
+			"previousEndpoint": prev.url.Host,
+		}).Info("switched ScaleIO Gateway endpoint")
+	}
+}
+
+// canFailOver returns whether a request that failed with the given error,
+// or with an unavailable status if the error is nil, may be sent to another
+// endpoint. Requests that are not idempotent, such as the POSTs that create
+// or map volumes, are only sent again when they never reached the endpoint.
+func canFailOver(req *http.Request, err error) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPatch:
+		return isDialError(err)
+	}
+	return true
+}
+
+// isDialError returns whether an error shows that no connection could be
+// made to the endpoint, such as when the connection is refused
+func isDialError(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	oe, ok := err.(*net.OpError)
+	return ok && oe.Op == "dial"
+}
+
+// endpointUnavailable returns whether a response status code indicates that
+// the Gateway cannot serve requests
+func endpointUnavailable(code int) bool {
+	return code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// withEndpoint returns a copy of the request, with the given body, that is
+// sent to the given endpoint
+func withEndpoint(req *http.Request, body []byte, u *url.URL) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	ru := *req.URL
+	ru.Scheme = u.Scheme
+	ru.Host = u.Host
+	r.URL = &ru
+	r.Host = ""
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return r
+}
+
+// parseEndpoints parses a comma-separated list of Gateway endpoints
+func parseEndpoints(eps string) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, ep := range strings.Split(eps, ",") {
+		if ep = strings.TrimSpace(ep); ep == "" {
+			continue
+		}
+		u, err := url.ParseRequestURI(ep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint: %s: %s", ep, err.Error())
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// volumeAction invokes an action of the ScaleIO Gateway REST API on the given
+// volume. It is used for the volume actions that goscaleio does not provide.
+func (sys *scaleioSystem) volumeAction(
+	volID, action string, param interface{}) error {
+
+	body, err := json.Marshal(param)
+	if err != nil {
+		return fmt.Errorf("error marshaling: %s", err.Error())
+	}
+
+	endpoint := sys.client.SIOEndpoint
+	endpoint.Path = fmt.Sprintf(
+		"/api/instances/Volume::%s/action/%s", volID, action)
+
+	req := sys.client.NewRequest(
+		map[string]string{}, http.MethodPost, endpoint, bytes.NewReader(body))
+	req.SetBasicAuth("", sys.client.Token)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := sys.client.Http.Do(req)
+	if err != nil {
+		return fmt.Errorf("problem getting response: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	return getResponseError(resp)
+}
+
+// getVolumes returns all of the volumes of the system, including the ScaleIO
+// snapshots. goscaleio only returns either the volumes with a given ancestor,
+// or the snapshots.
+func (sys *scaleioSystem) getVolumes() ([]*siotypes.Volume, error) {
+
+	endpoint := sys.client.SIOEndpoint
+	endpoint.Path = "/api/types/Volume/instances"
+
+	req := sys.client.NewRequest(
+		map[string]string{}, http.MethodGet, endpoint, nil)
+	req.SetBasicAuth("", sys.client.Token)
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := sys.client.Http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("problem getting response: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, getResponseError(resp)
+	}
+
+	var vols []*siotypes.Volume
+	if err := json.NewDecoder(resp.Body).Decode(&vols); err != nil {
+		return nil, fmt.Errorf("error decoding volumes: %s", err.Error())
+	}
+	return vols, nil
+}
+
+// getResponseError returns the error of a failed Gateway response
+func getResponseError(resp *http.Response) error {
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %s", err.Error())
+	}
+	errBody := &siotypes.Error{}
+	if err := json.Unmarshal(b, errBody); err != nil || errBody.Message == "" {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return fmt.Errorf("%s", errBody.Message)
+}
+
+// setVolumeSizeParam is the parameter of the setVolumeSize volume action
+type setVolumeSizeParam struct {
+	SizeInGB string `json:"sizeInGB"`
+}
+
+// setVolumeSize sets the size of a volume, in GiB
+func (sys *scaleioSystem) setVolumeSize(volID string, sizeInGiB int64) error {
+	return sys.volumeAction(volID, "setVolumeSize", &setVolumeSizeParam{
+		SizeInGB: fmt.Sprintf("%d", sizeInGiB),
+	})
+}
+
+// setVolumeNameParam is the parameter of the setVolumeName volume action
+type setVolumeNameParam struct {
+	NewName string `json:"newName"`
+}
+
+// setVolumeName renames a volume
+func (sys *scaleioSystem) setVolumeName(volID, name string) error {
+	return sys.volumeAction(volID, "setVolumeName", &setVolumeNameParam{
+		NewName: name,
+	})
+}
+
+// setMappedSdcLimitsParam is the parameter of the setMappedSdcLimits volume
+// action
+type setMappedSdcLimitsParam struct {
+	SdcID                string `json:"sdcId"`
+	IopsLimit            string `json:"iopsLimit"`
+	BandwidthLimitInKbps string `json:"bandwidthLimitInKbps"`
+}
+
+// setMappedSdcLimits sets the QoS limits of the mapping of a volume to an SDC
+func (sys *scaleioSystem) setMappedSdcLimits(
+	volID, sdcID string, qos volumeQoS) error {
+
+	log.WithFields(log.Fields{
+		"volumeID": volID,
+		"sdcID":    sdcID,
+		"iops":     qos.iops,
+		"bwInMBps": qos.bwInMBps,
+	}).Debug("setting limits of volume mapping")
+
+	return sys.volumeAction(volID, "setMappedSdcLimits", &setMappedSdcLimitsParam{
+		SdcID:     sdcID,
+		IopsLimit: fmt.Sprintf("%d", qos.iops),
+		// ScaleIO limits bandwidth in KiB/s, in multiples of 1024
+		BandwidthLimitInKbps: fmt.Sprintf("%d", qos.bwInMBps*1024),
+	})
+}
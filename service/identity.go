@@ -39,6 +39,13 @@ func (s *service) GetPluginCapabilities(
 			},
 		}
 	}
+	rep.Capabilities = append(rep.Capabilities, &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	})
 	return &rep, nil
 }
 
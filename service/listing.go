@@ -0,0 +1,152 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// volListingTTL is how long a volume or snapshot listing is kept after
+	// a page of it was last returned
+	volListingTTL = 5 * time.Minute
+
+	// maxVolListings is the number of volume and snapshot listings that are
+	// kept at once. When it is reached, the listing that would expire first is
+	// dropped to make room for a new one.
+	maxVolListings = 32
+)
+
+// volListing is the list of volumes or snapshots, as a []*csi.Volume or a
+// []*csi.Snapshot, that a paginated ListVolumes or ListSnapshots returns pages
+// of. The list is taken when the first page is requested, so that the
+// following pages are consistent with it, whatever volumes or snapshots are
+// created or deleted in the meantime.
+type volListing struct {
+	entries interface{}
+	expires time.Time
+}
+
+// volListings holds the volume and snapshot listings that are being paged
+// through, keyed by listing ID
+type volListings struct {
+	listingsL sync.Mutex
+	listings  map[string]*volListing
+}
+
+func newVolListings() *volListings {
+	return &volListings{
+		listings: map[string]*volListing{},
+	}
+}
+
+// add stores a listing, and returns its ID
+func (vl *volListings) add(entries interface{}) string {
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+
+	vl.listingsL.Lock()
+	defer vl.listingsL.Unlock()
+
+	now := time.Now()
+	vl.expire(now)
+	if len(vl.listings) >= maxVolListings {
+		vl.evict()
+	}
+	vl.listings[id] = &volListing{
+		entries: entries,
+		expires: now.Add(volListingTTL),
+	}
+	return id
+}
+
+// get returns the entries of a listing, and extends its expiry
+func (vl *volListings) get(id string) (interface{}, bool) {
+	vl.listingsL.Lock()
+	defer vl.listingsL.Unlock()
+
+	now := time.Now()
+	vl.expire(now)
+	l, ok := vl.listings[id]
+	if !ok {
+		return nil, false
+	}
+	l.expires = now.Add(volListingTTL)
+	return l.entries, true
+}
+
+// resume returns the listing ID and offset of a starting token, and the
+// entries of the listing. The returned errors are Aborted, as the listing has
+// to be restarted.
+func (vl *volListings) resume(
+	token string) (string, int, interface{}, error) {
+
+	id, offset, err := parseListToken(token)
+	if err != nil {
+		return "", 0, nil, status.Errorf(codes.Aborted,
+			"unable to parse startingToken: %s", err.Error())
+	}
+	entries, ok := vl.get(id)
+	if !ok {
+		return "", 0, nil, status.Errorf(codes.Aborted,
+			"startingToken: %s has expired", token)
+	}
+	return id, offset, entries, nil
+}
+
+// expire drops the listings that have expired. The lock must be held.
+func (vl *volListings) expire(now time.Time) {
+	for id, l := range vl.listings {
+		if !now.Before(l.expires) {
+			delete(vl.listings, id)
+		}
+	}
+}
+
+// evict drops the listing that would expire first. The lock must be held.
+func (vl *volListings) evict() {
+	var (
+		oldestID string
+		oldest   time.Time
+	)
+	for id, l := range vl.listings {
+		if oldestID == "" || l.expires.Before(oldest) {
+			oldestID, oldest = id, l.expires
+		}
+	}
+	delete(vl.listings, oldestID)
+}
+
+// formatListToken returns the opaque token of the page of a listing that
+// starts at the given offset
+func formatListToken(id string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%s:%d", id, offset)))
+}
+
+// parseListToken returns the listing ID and offset of a token returned by
+// formatListToken
+func parseListToken(token string) (string, int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid token: %s", token)
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, fmt.Errorf("invalid token: %s", token)
+	}
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil || offset < 0 {
+		return "", 0, fmt.Errorf("invalid token: %s", token)
+	}
+	return parts[0], offset, nil
+}
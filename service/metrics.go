@@ -0,0 +1,376 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akutz/gofsutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/thecodeteam/goscaleio"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// metricsPath is the path that the metrics are served at
+	metricsPath = "/metrics"
+
+	metricsNamespace = "csi_scaleio"
+)
+
+// metricsBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms
+var metricsBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// defaultMetrics are the metrics of the plugin
+var defaultMetrics = newMetrics()
+
+// metrics holds the metrics of the plugin, which are exposed in the
+// Prometheus text format
+type metrics struct {
+	rpcRequests   *counterVec
+	rpcDuration   *histogramVec
+	gwRequests    *counterVec
+	gwDuration    *histogramVec
+	cacheRequests *counterVec
+
+	// nodeVolumes returns the number of volumes mapped to and mounted on
+	// the node. It is nil when the Node Service is not served.
+	nodeVolumesRWL sync.RWMutex
+	nodeVolumes    func() (int, int, error)
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rpcRequests: newCounterVec(
+			metricsNamespace+"_rpc_requests_total",
+			"Number of CSI RPCs handled, by method and status code.",
+			"service", "method", "code"),
+		rpcDuration: newHistogramVec(
+			metricsNamespace+"_rpc_duration_seconds",
+			"Latency of CSI RPCs, by method.",
+			"service", "method"),
+		gwRequests: newCounterVec(
+			metricsNamespace+"_gateway_requests_total",
+			"Number of requests sent to ScaleIO Gateways, by endpoint and "+
+				"HTTP status code, or \"error\" if no response was received.",
+			"endpoint", "code"),
+		gwDuration: newHistogramVec(
+			metricsNamespace+"_gateway_request_duration_seconds",
+			"Latency of requests sent to ScaleIO Gateways, by endpoint.",
+			"endpoint"),
+		cacheRequests: newCounterVec(
+			metricsNamespace+"_cache_requests_total",
+			"Number of cache lookups, by cache and result (hit or miss).",
+			"cache", "result"),
+	}
+}
+
+// MetricsInterceptor is a gRPC server interceptor that records the count,
+// latency and status codes of the RPCs served by the plugin
+func MetricsInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	return defaultMetrics.intercept(ctx, req, info, handler)
+}
+
+func (m *metrics) intercept(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	start := time.Now()
+	rep, err := handler(ctx, req)
+
+	svc, method := splitFullMethod(info.FullMethod)
+	m.rpcDuration.observe(time.Since(start), svc, method)
+	m.rpcRequests.inc(svc, method, status.Code(err).String())
+
+	return rep, err
+}
+
+// splitFullMethod returns the short service name and the method name of a
+// full gRPC method name, such as "/csi.v0.Controller/CreateVolume"
+func splitFullMethod(fullMethod string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(fullMethod, "/"), "/", 2)
+	if len(parts) != 2 {
+		return "", fullMethod
+	}
+	svc := parts[0]
+	if i := strings.LastIndex(svc, "."); i >= 0 {
+		svc = svc[i+1:]
+	}
+	return svc, parts[1]
+}
+
+// observeGatewayRequest records a request sent to a Gateway endpoint
+func (m *metrics) observeGatewayRequest(
+	endpoint string, d time.Duration, resp *http.Response, err error) {
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	m.gwDuration.observe(d, endpoint)
+	m.gwRequests.inc(endpoint, code)
+}
+
+// observeCacheLookup records a lookup in one of the caches
+func (m *metrics) observeCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheRequests.inc(cache, result)
+}
+
+func (m *metrics) setNodeVolumes(f func() (int, int, error)) {
+	m.nodeVolumesRWL.Lock()
+	defer m.nodeVolumesRWL.Unlock()
+	m.nodeVolumes = f
+}
+
+// write writes the metrics in the Prometheus text format
+func (m *metrics) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m.rpcRequests.write(bw)
+	m.rpcDuration.write(bw)
+	m.gwRequests.write(bw)
+	m.gwDuration.write(bw)
+	m.cacheRequests.write(bw)
+
+	m.nodeVolumesRWL.RLock()
+	f := m.nodeVolumes
+	m.nodeVolumesRWL.RUnlock()
+	if f != nil {
+		if mapped, mounted, err := f(); err != nil {
+			log.WithError(err).Warn("unable to count node volumes for metrics")
+		} else {
+			writeGauge(bw, metricsNamespace+"_node_volumes_mapped",
+				"Number of ScaleIO volumes mapped to the node.", mapped)
+			writeGauge(bw, metricsNamespace+"_node_volumes_mounted",
+				"Number of ScaleIO volumes mounted on the node.", mounted)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP implements http.Handler
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := m.write(w); err != nil {
+		log.WithError(err).Debug("error writing metrics")
+	}
+}
+
+// serveMetrics serves the metrics over HTTP at the given address
+func serveMetrics(addr string, m *metrics) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for metrics on %s: %s",
+			addr, err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, m)
+	go func() {
+		if err := http.Serve(lis, mux); err != nil {
+			log.WithError(err).Error("metrics server stopped")
+		}
+	}()
+
+	log.WithField("address", lis.Addr().String()).Info("serving metrics")
+	return nil
+}
+
+// countNodeVolumes returns the number of ScaleIO volumes mapped to the node,
+// and the number of those mounted
+func countNodeVolumes() (int, int, error) {
+	localVols, err := goscaleio.GetLocalVolumeMap()
+	if err != nil {
+		return 0, 0, err
+	}
+	devs := map[string]bool{}
+	for _, v := range localVols {
+		devs[v.SdcDevice] = true
+	}
+
+	mnts, err := gofsutil.GetMounts(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	mounted := map[string]bool{}
+	for _, m := range mnts {
+		dev := m.Device
+		if dev == "devtmpfs" {
+			dev = m.Source
+		}
+		if devs[dev] {
+			mounted[dev] = true
+		}
+	}
+
+	return len(localVols), len(mounted), nil
+}
+
+// counterVec is a counter partitioned by labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	valuesRWL sync.RWMutex
+	values    map[string]uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]uint64{},
+	}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.valuesRWL.Lock()
+	defer c.valuesRWL.Unlock()
+	c.values[key]++
+}
+
+func (c *counterVec) get(labelValues ...string) uint64 {
+	key := formatLabels(c.labels, labelValues)
+	c.valuesRWL.RLock()
+	defer c.valuesRWL.RUnlock()
+	return c.values[key]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.valuesRWL.RLock()
+	defer c.valuesRWL.RUnlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n",
+		c.name, helpEscaper.Replace(c.help), c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, key, c.values[key])
+	}
+}
+
+// histogram is the state of a histogram for a set of label values
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram of durations partitioned by labels
+type histogramVec struct {
+	name   string
+	help   string
+	labels []string
+
+	valuesRWL sync.RWMutex
+	values    map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]*histogram{},
+	}
+}
+
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	v := d.Seconds()
+
+	h.valuesRWL.Lock()
+	defer h.valuesRWL.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(metricsBuckets))}
+		h.values[key] = hist
+	}
+	for i, le := range metricsBuckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.valuesRWL.RLock()
+	defer h.valuesRWL.RUnlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n",
+		h.name, helpEscaper.Replace(h.help), h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, le := range metricsBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, key,
+				strconv.FormatFloat(le, 'g', -1, 64), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, key, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, key,
+			strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, key, hist.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		name, helpEscaper.Replace(help), name, name, v)
+}
+
+// formatLabels formats label names and values as they appear in the
+// Prometheus text format
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = n + `="` + labelValueEscaper.Replace(v) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// helpEscaper escapes the docstrings of the HELP lines, in which quotes are
+// not escaped
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
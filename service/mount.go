@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/akutz/gofsutil"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
@@ -51,14 +54,139 @@ func GetDevice(path string) (*Device, error) {
 	}, nil
 }
 
+// stageVolume uses the parameters in req to mount the underlying block device
+// to the requested staging path. Filesystems are formatted, if needed, and
+// mounted only once per node, at the staging path, from which they are then
+// bind mounted to each publish target.
+//
+// Block volumes are bind mounted directly from the device when they are
+// published, so there is nothing to stage for them.
+func stageVolume(
+	req *csi.NodeStageVolumeRequest,
+	device string) error {
+
+	id := req.GetVolumeId()
+
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return status.Error(codes.InvalidArgument,
+			"staging target path required")
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return status.Error(codes.InvalidArgument,
+			"volume capability required")
+	}
+
+	accMode := volCap.GetAccessMode()
+	if accMode == nil {
+		return status.Error(codes.InvalidArgument,
+			"volume access mode required")
+	}
+
+	// make sure device is valid
+	sysDevice, err := GetDevice(device)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"error getting block device for volume: %s, err: %s",
+			id, err.Error())
+	}
+
+	if volCap.GetBlock() != nil {
+		return nil
+	}
+	mntVol := volCap.GetMount()
+	if mntVol == nil {
+		return status.Error(codes.InvalidArgument,
+			"volume access type required")
+	}
+
+	f := log.Fields{
+		"id":          id,
+		"volumePath":  sysDevice.FullPath,
+		"device":      sysDevice.RealDev,
+		"stagingPath": stagingPath,
+	}
+
+	ctx := context.Background()
+
+	// Check if device is already mounted
+	devMnts, err := getDevMounts(sysDevice)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"could not reliably determine existing mount status: %s",
+			err.Error())
+	}
+
+	if len(devMnts) > 0 {
+		// Device is already mounted. Need to ensure that it is already
+		// mounted to the staging path, with correct rw/ro perms
+		for _, m := range devMnts {
+			if m.Path == stagingPath {
+				rwo := "rw"
+				if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
+					rwo = "ro"
+				}
+				if !contains(m.Opts, rwo) {
+					return status.Error(codes.AlreadyExists,
+						"access mode conflicts with existing mounts")
+				}
+				log.WithFields(f).Debug("volume already staged")
+				return nil
+			}
+		}
+		return status.Error(codes.Internal,
+			"device already in use and mounted elsewhere")
+	}
+
+	// Make sure staging path exists, and that nothing else is mounted there
+	if _, err := mkdir(stagingPath); err != nil {
+		return status.Errorf(codes.Internal,
+			"Unable to create staging path: %s", err.Error())
+	}
+	mnts, err := gofsutil.GetMounts(ctx)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"could not reliably determine existing mount status: %s",
+			err.Error())
+	}
+	for _, m := range mnts {
+		if m.Path == stagingPath {
+			log.WithFields(f).WithField("mountedDevice", m.Device).Error(
+				"staging path already in use by device")
+			return status.Error(codes.Internal,
+				"Unable to use staging path")
+		}
+	}
+
+	// Imported volumes hold data written outside of the CO, so they are
+	// never formatted: their filesystem is checked, and they are mounted
+	// without FormatAndMount
+	imported := req.GetVolumeAttributes()[AttributeKeyImported] == "true"
+	if imported {
+		if err := checkImportedFS(
+			ctx, sysDevice.FullPath, mntVol.GetFsType()); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(f).Debug("attempting mount to staging path")
+
+	return handleStagingFSMount(
+		ctx, accMode, sysDevice, mntVol.GetMountFlags(),
+		mntVol.GetFsType(), stagingPath, imported)
+}
+
 // publishVolume uses the parameters in req to bindmount the underlying block
-// device to the requested target path. A private mount is performed first
-// within the given privDir directory.
+// device to the requested target path. Filesystems are bind mounted from the
+// staging path, where they were mounted by stageVolume, and block volumes are
+// bind mounted from the device itself.
 //
 // publishVolume handles both Mount and Block access types
 func publishVolume(
 	req *csi.NodePublishVolumeRequest,
-	privDir, device string) error {
+	device string) error {
 
 	id := req.GetVolumeId()
 
@@ -101,11 +229,6 @@ func publishVolume(
 			"failed to stat target, err: %s", err.Error())
 	}
 
-	// make sure privDir exists and is a directory
-	if _, err := mkdir(privDir); err != nil {
-		return err
-	}
-
 	isBlock := false
 	typeSet := false
 	if blockVol := volCap.GetBlock(); blockVol != nil {
@@ -135,20 +258,26 @@ func publishVolume(
 			"target: %s wrong type (file vs dir) Access Type", target)
 	}
 
-	// Path to mount device to
-	privTgt := getPrivateMountPoint(privDir, id)
+	// Path to bind mount to the target
+	source := sysDevice.FullPath
+	if !isBlock {
+		source = req.GetStagingTargetPath()
+		if source == "" {
+			return status.Error(codes.InvalidArgument,
+				"staging target path required")
+		}
+	}
 
 	f := log.Fields{
-		"id":           id,
-		"volumePath":   sysDevice.FullPath,
-		"device":       sysDevice.RealDev,
-		"target":       target,
-		"privateMount": privTgt,
+		"id":         id,
+		"volumePath": sysDevice.FullPath,
+		"device":     sysDevice.RealDev,
+		"target":     target,
+		"source":     source,
 	}
 
 	ctx := context.Background()
 
-	// Check if device is already mounted
 	devMnts, err := getDevMounts(sysDevice)
 	if err != nil {
 		return status.Errorf(codes.Internal,
@@ -156,113 +285,39 @@ func publishVolume(
 			err.Error())
 	}
 
-	if len(devMnts) == 0 {
-		// Device isn't mounted anywhere, do the private mount
-		log.WithFields(f).Debug("attempting mount to private area")
-
-		// Make sure private mount point exists
-		var created bool
-		if isBlock {
-			created, err = mkfile(privTgt)
-		} else {
-			created, err = mkdir(privTgt)
-		}
-		if err != nil {
-			return status.Errorf(codes.Internal,
-				"Unable to create private mount point: %s",
-				err.Error())
-		}
-		if !created {
-			log.WithFields(f).Debug("private mount target already exists")
-
-			// The place where our device is supposed to be mounted
-			// already exists, but we also know that our device is not mounted anywhere
-			// Either something didn't clean up correctly, or something else is mounted
-			// If the private mount is not in use, it's okay to re-use it. But make sure
-			// it's not in use first
-
-			mnts, err := gofsutil.GetMounts(ctx)
-			if err != nil {
-				return status.Errorf(codes.Internal,
-					"could not reliably determine existing mount status: %s",
-					err.Error())
-			}
-			for _, m := range mnts {
-				if m.Path == privTgt {
-					log.WithFields(f).WithField("mountedDevice", m.Device).Error(
-						"mount point already in use by device")
-					return status.Error(codes.Internal,
-						"Unable to use private mount point")
-				}
-			}
-		}
-
-		if !isBlock {
-			fs := mntVol.GetFsType()
-			mntFlags := mntVol.GetMountFlags()
-
-			if err := handlePrivFSMount(
-				ctx, accMode, sysDevice, mntFlags, fs, privTgt); err != nil {
-				return err
-			}
-		} else {
-			if err := gofsutil.BindMount(ctx, sysDevice.FullPath, privTgt); err != nil {
-				return status.Errorf(codes.Internal,
-					"failure bind-mounting block device to private mount: %s", err.Error())
-			}
-		}
-
-	} else {
-		// Device is already mounted. Need to ensure that it is already
-		// mounted to the expected private mount, with correct rw/ro perms
-		mounted := false
+	// Filesystems must have been staged before being published
+	if !isBlock {
+		staged := false
 		for _, m := range devMnts {
-			if m.Path == privTgt {
-				mounted = true
-				rwo := "rw"
-				if ro {
-					rwo = "ro"
-				}
-				if contains(m.Opts, rwo) {
-					log.WithFields(f).Debug(
-						"private mount already in place")
-					break
-				} else {
-					return status.Error(codes.InvalidArgument,
-						"access mode conflicts with existing mounts")
-				}
+			if m.Path == source {
+				staged = true
+				break
 			}
 		}
-		if !mounted {
-			return status.Error(codes.Internal,
-				"device already in use and mounted elsewhere")
+		if !staged {
+			return status.Errorf(codes.FailedPrecondition,
+				"volume: %s not staged to: %s", id, source)
 		}
 	}
 
-	// Private mount in place, now bind mount to target path
-
-	// If mounts already existed for this device, check if mount to
-	// target path was already there
-	if len(devMnts) > 0 {
-		for _, m := range devMnts {
-			if m.Path == target {
-				// volume already published to target
-				// if mount options look good, do nothing
-				rwo := "rw"
-				if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
-					rwo = "ro"
-				}
-				if !contains(m.Opts, rwo) {
-					return status.Error(codes.Internal,
-						"volume previously published with different options")
+	// Check if volume was already published to target
+	for _, m := range devMnts {
+		if m.Path == target {
+			// volume already published to target
+			// if mount options look good, do nothing
+			rwo := "rw"
+			if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || ro {
+				rwo = "ro"
+			}
+			if !contains(m.Opts, rwo) {
+				return status.Error(codes.AlreadyExists,
+					"volume previously published with different options")
 
-				}
-				// Existing mount satisfies request
-				log.WithFields(f).Debug("volume already published to target")
-				return nil
 			}
+			// Existing mount satisfies request
+			log.WithFields(f).Debug("volume already published to target")
+			return nil
 		}
-
 	}
 
 	var mntFlags []string
@@ -270,11 +325,11 @@ func publishVolume(
 		mntFlags = make([]string, 0)
 	} else {
 		mntFlags = mntVol.GetMountFlags()
-		if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
+		if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || ro {
 			mntFlags = append(mntFlags, "ro")
 		}
 	}
-	if err := gofsutil.BindMount(ctx, privTgt, target, mntFlags...); err != nil {
+	if err := gofsutil.BindMount(ctx, source, target, mntFlags...); err != nil {
 		return status.Errorf(codes.Internal,
 			"error publish volume to target path: %s",
 			err.Error())
@@ -283,26 +338,50 @@ func publishVolume(
 	return nil
 }
 
-func handlePrivFSMount(
+// checkImportedFS checks that the device of an imported volume has a
+// filesystem of the requested type, if any
+func checkImportedFS(ctx context.Context, device, fsType string) error {
+	format, err := gofsutil.GetDiskFormat(ctx, device)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"unable to check filesystem of imported volume: %s", err.Error())
+	}
+	if format == "" {
+		return status.Error(codes.FailedPrecondition,
+			"imported volume has no filesystem, and is not formatted")
+	}
+	if fsType != "" && format != fsType {
+		return status.Errorf(codes.FailedPrecondition,
+			"imported volume has %s filesystem, not %s", format, fsType)
+	}
+	return nil
+}
+
+func handleStagingFSMount(
 	ctx context.Context,
 	accMode *csi.VolumeCapability_AccessMode,
 	sysDevice *Device,
 	mntFlags []string,
-	fs, privTgt string) error {
+	fs, stagingPath string,
+	noFormat bool) error {
 
 	// If read-only access mode, we don't allow formatting
 	if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
 		mntFlags = append(mntFlags, "ro")
-		if err := gofsutil.Mount(ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
+		if err := gofsutil.Mount(ctx, sysDevice.FullPath, stagingPath, fs, mntFlags...); err != nil {
 			return status.Errorf(codes.Internal,
-				"error performing private mount: %s",
+				"error performing staging mount: %s",
 				err.Error())
 		}
 		return nil
 	} else if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-		if err := gofsutil.FormatAndMount(ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
+		mount := gofsutil.FormatAndMount
+		if noFormat {
+			mount = gofsutil.Mount
+		}
+		if err := mount(ctx, sysDevice.FullPath, stagingPath, fs, mntFlags...); err != nil {
 			return status.Errorf(codes.Internal,
-				"error performing private mount: %s",
+				"error performing staging mount: %s",
 				err.Error())
 		}
 		return nil
@@ -310,10 +389,6 @@ func handlePrivFSMount(
 	return status.Error(codes.Internal, "Invalid access mode")
 }
 
-func getPrivateMountPoint(privDir string, name string) string {
-	return filepath.Join(privDir, name)
-}
-
 func contains(list []string, item string) bool {
 	for _, x := range list {
 		if x == item {
@@ -323,27 +398,6 @@ func contains(list []string, item string) bool {
 	return false
 }
 
-// mkfile creates a file specified by the path if needed.
-// return pair is a bool flag of whether file was created, and an error
-func mkfile(path string) (bool, error) {
-	st, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		file, err := os.OpenFile(path, os.O_CREATE, 0755)
-		if err != nil {
-			log.WithField("dir", path).WithError(
-				err).Error("Unable to create dir")
-			return false, err
-		}
-		file.Close()
-		log.WithField("path", path).Debug("created file")
-		return true, nil
-	}
-	if st.IsDir() {
-		return false, fmt.Errorf("existing path is a directory")
-	}
-	return false, nil
-}
-
 // mkdir creates the directory specified by path if needed.
 // return pair is a bool flag of whether dir was created, and an error
 func mkdir(path string) (bool, error) {
@@ -363,16 +417,9 @@ func mkdir(path string) (bool, error) {
 	return false, nil
 }
 
-// unpublishVolume removes the bind mount to the target path, and also removes
-// the mount to the private mount directory if the volume is no longer in use.
-// It determines this by checking to see if the volume is mounted anywhere else
-// other than the private mount.
+// unpublishVolume removes the bind mount to the target path
 func unpublishVolume(
-	req *csi.NodeUnpublishVolumeRequest,
-	privDir, device string) error {
-
-	ctx := context.Background()
-	id := req.GetVolumeId()
+	req *csi.NodeUnpublishVolumeRequest) error {
 
 	target := req.GetTargetPath()
 	if target == "" {
@@ -380,16 +427,27 @@ func unpublishVolume(
 			"target path required")
 	}
 
-	// make sure device is valid
-	sysDevice, err := GetDevice(device)
-	if err != nil {
-		return status.Errorf(codes.Internal,
-			"error getting block device for volume: %s, err: %s",
-			id, err.Error())
+	return unmountPath(target)
+}
+
+// unstageVolume removes the mount of the volume to the staging path. The CO
+// is responsible for unpublishing the volume from all of its targets first.
+func unstageVolume(
+	req *csi.NodeUnstageVolumeRequest) error {
+
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return status.Error(codes.InvalidArgument,
+			"staging target path required")
 	}
 
-	// Path to mount device to
-	privTgt := getPrivateMountPoint(privDir, id)
+	return unmountPath(stagingPath)
+}
+
+// unmountPath unmounts whatever is mounted to path, if anything
+func unmountPath(path string) error {
+
+	ctx := context.Background()
 
 	mnts, err := gofsutil.GetMounts(ctx)
 	if err != nil {
@@ -398,54 +456,18 @@ func unpublishVolume(
 			err.Error())
 	}
 
-	tgtMnt := false
-	privMnt := false
 	for _, m := range mnts {
-		if m.Source == sysDevice.RealDev || m.Device == sysDevice.RealDev {
-			if m.Path == privTgt {
-				privMnt = true
-			} else if m.Path == target {
-				tgtMnt = true
+		if m.Path == path {
+			if err := gofsutil.Unmount(ctx, path); err != nil {
+				return status.Errorf(codes.Internal,
+					"Error unmounting: %s, err: %s", path, err.Error())
 			}
+			log.WithField("path", path).Debug("unmounted")
+			return nil
 		}
 	}
 
-	if tgtMnt {
-		if err := gofsutil.Unmount(ctx, target); err != nil {
-			return status.Errorf(codes.Internal,
-				"Error unmounting target: %s", err.Error())
-		}
-	}
-
-	if privMnt {
-		if err := unmountPrivMount(ctx, sysDevice, privTgt); err != nil {
-			return status.Errorf(codes.Internal,
-				"Error unmounting private mount: %s", err.Error())
-		}
-	}
-
-	return nil
-}
-
-func unmountPrivMount(
-	ctx context.Context,
-	dev *Device,
-	target string) error {
-
-	mnts, err := getDevMounts(dev)
-	if err != nil {
-		return err
-	}
-
-	// remove private mount if we can
-	if len(mnts) == 1 && mnts[0].Path == target {
-		if err := gofsutil.Unmount(ctx, target); err != nil {
-			return err
-		}
-		log.WithField("directory", target).Debug(
-			"removing directory")
-		os.Remove(target)
-	}
+	log.WithField("path", path).Debug("already unmounted")
 	return nil
 }
 
@@ -466,3 +488,86 @@ func getDevMounts(
 	}
 	return devMnts, nil
 }
+
+// expandVolume grows the filesystem on the given device to the size of the
+// device, and returns the size of the device in bytes. The filesystem is
+// grown through its staging mount. If the device is not mounted as a
+// filesystem, only its size is returned.
+func expandVolume(id, device string) (int64, error) {
+
+	ctx := context.Background()
+
+	// make sure device is valid
+	sysDevice, err := GetDevice(device)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal,
+			"error getting block device for volume: %s, err: %s",
+			id, err.Error())
+	}
+
+	devMnts, err := getDevMounts(sysDevice)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal,
+			"could not reliably determine existing mount status: %s",
+			err.Error())
+	}
+
+	f := log.Fields{
+		"id":     id,
+		"device": sysDevice.RealDev,
+	}
+
+	// The filesystem can be grown through any of its mounts, which are the
+	// staging mount and the bind mounts from it. Block volumes are bind
+	// mounted from devtmpfs, and have no filesystem to grow.
+	for _, m := range devMnts {
+		if m.Device != sysDevice.RealDev {
+			continue
+		}
+		log.WithFields(f).WithFields(log.Fields{
+			"fsType": m.Type,
+			"path":   m.Path,
+		}).Info("growing filesystem")
+		if err := growFS(ctx, m.Type, sysDevice.RealDev, m.Path); err != nil {
+			return 0, status.Errorf(codes.Internal,
+				"error growing filesystem: %s", err.Error())
+		}
+		break
+	}
+
+	size, err := getDeviceSize(sysDevice.RealDev)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal,
+			"error getting size of device: %s", err.Error())
+	}
+	return size, nil
+}
+
+// growFS grows the filesystem of the given type, on the given device mounted
+// at the given path, to fill the device
+func growFS(ctx context.Context, fsType, device, path string) error {
+	var cmd *exec.Cmd
+	switch fsType {
+	case "ext3", "ext4":
+		cmd = exec.CommandContext(ctx, "resize2fs", device)
+	case "xfs":
+		cmd = exec.CommandContext(ctx, "xfs_growfs", path)
+	default:
+		return fmt.Errorf("unsupported filesystem type: %s", fsType)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(),
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// getDeviceSize returns the size of the given block device in bytes
+func getDeviceSize(device string) (int64, error) {
+	out, err := exec.Command("blockdev", "--getsize64", device).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err.Error(),
+			strings.TrimSpace(string(out)))
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// KeyVolumeNameTemplate is the key used to get the template of the name
+	// of the ScaleIO volume from the volume create parameters map. It
+	// replaces the configured template.
+	KeyVolumeNameTemplate = "volumenametemplate"
+
+	// volumeNameTemplateName is the template variable replaced by the CO
+	// name of the volume
+	volumeNameTemplateName = "name"
+
+	// maxVolumeNameLen is the maximum length of the name of a ScaleIO
+	// volume
+	maxVolumeNameLen = 31
+
+	// volumeNameHashLen is the number of hex digits of the hash of a CO name
+	// that is appended to the ScaleIO volume name when the CO name cannot be
+	// used as is
+	volumeNameHashLen = 12
+
+	// volumeNameMarkLen is the number of hex digits of the mark that follows
+	// the hash. The mark is a keyed hash of the rest of the name, which
+	// shows that the name was generated by the plugin.
+	volumeNameMarkLen = 4
+
+	// volumeNameMarkKey is the key of the marks of the names generated by
+	// the plugin
+	volumeNameMarkKey = "csi-scaleio"
+
+	// maxVolumeNamePrefixLen is the maximum length of the prefix of the
+	// ScaleIO volume names, which leaves room for at least a few characters
+	// of the CO name before the hash
+	maxVolumeNamePrefixLen = 10
+
+	// volumeNameHashSeparator separates the hash of a CO name from the rest
+	// of the ScaleIO volume name
+	volumeNameHashSeparator = "-"
+
+	// snapshotNameHashSeparator separates the hash of a CO name from the
+	// rest of the name of a ScaleIO snapshot created by CreateSnapshot or
+	// CreateSnapshotGroup. Together with the mark, it tells CSI snapshots
+	// apart from the volumes created from a snapshot or cloned, which are
+	// ScaleIO snapshots too.
+	snapshotNameHashSeparator = "_"
+
+	// volumeNamePrefixSeparator separates the prefix from the rest of the
+	// ScaleIO volume name. It may not be used in the prefix, so that a
+	// prefix never matches the names of another prefix.
+	volumeNamePrefixSeparator = "."
+)
+
+// volumeNameTemplateVars are the template variables that stand for the
+// volume create parameters set by the Kubernetes external provisioner
+var volumeNameTemplateVars = map[string]string{
+	"pvcname":   "csi.storage.k8s.io/pvc/name",
+	"namespace": "csi.storage.k8s.io/pvc/namespace",
+	"pvname":    "csi.storage.k8s.io/pv/name",
+}
+
+// getVolumeName returns the name of the ScaleIO volume or snapshot for a CO
+// name, using the configured prefix
+func (s *service) getVolumeName(name string) string {
+	return getVolumeName(s.opts.VolumeNamePrefix, name)
+}
+
+// getSnapshotName returns the name of the ScaleIO snapshot for a CO snapshot
+// name, using the configured prefix
+func (s *service) getSnapshotName(name string) string {
+	return getSnapshotName(s.opts.VolumeNamePrefix, name)
+}
+
+// getCreateVolumeName returns the name of the ScaleIO volume for a volume
+// create request. When a name template is configured or given in the
+// parameters, the expanded template takes the place of the CO name, and the
+// hash of the CO name is always appended, as different CO names may expand to
+// the same name. It is also always appended to the names of the volumes
+// created from a source, which are marked as CSI volumes that way.
+func (s *service) getCreateVolumeName(
+	name string, params map[string]string, fromSource bool) (string, error) {
+
+	tmpl := s.opts.VolumeNameTemplate
+	if t, ok := params[KeyVolumeNameTemplate]; ok {
+		tmpl = t
+	}
+	if tmpl == "" {
+		if fromSource {
+			return getMarkedVolumeName(s.opts.VolumeNamePrefix, name), nil
+		}
+		return s.getVolumeName(name), nil
+	}
+
+	base, err := expandVolumeNameTemplate(tmpl,
+		func(key string) (string, bool) {
+			if key == volumeNameTemplateName {
+				return name, true
+			}
+			if v, ok := params[key]; ok {
+				return v, true
+			}
+			v, ok := params[volumeNameTemplateVars[key]]
+			return v, ok
+		})
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid volume name template: %s", err.Error())
+	}
+
+	return getHashedVolumeName(
+		volumeNamePrefix(s.opts.VolumeNamePrefix)+sanitizeVolumeName(base),
+		volumeNameHashSeparator, name), nil
+}
+
+// expandVolumeNameTemplate replaces the variables of a template, such as
+// "{cluster}-{namespace}-{pvcname}", by their values
+func expandVolumeNameTemplate(
+	tmpl string, value func(string) (string, bool)) (string, error) {
+
+	var b bytes.Buffer
+	for {
+		i := strings.IndexAny(tmpl, "{}")
+		if i < 0 {
+			b.WriteString(tmpl)
+			return b.String(), nil
+		}
+		if tmpl[i] == '}' {
+			return "", fmt.Errorf("unexpected '}' at: %s", tmpl[i:])
+		}
+		j := strings.IndexAny(tmpl[i+1:], "{}")
+		if j < 0 || tmpl[i+1+j] != '}' {
+			return "", fmt.Errorf("unclosed '{' at: %s", tmpl[i:])
+		}
+		key := tmpl[i+1 : i+1+j]
+		if key == "" {
+			return "", fmt.Errorf("empty variable at: %s", tmpl[i:])
+		}
+		v, ok := value(key)
+		if !ok {
+			return "", fmt.Errorf("no value for: {%s}", key)
+		}
+		b.WriteString(tmpl[:i])
+		b.WriteString(v)
+		tmpl = tmpl[i+1+j+1:]
+	}
+}
+
+// validateVolumeNameTemplate checks the syntax of a volume name template
+func validateVolumeNameTemplate(tmpl string) error {
+	_, err := expandVolumeNameTemplate(tmpl,
+		func(string) (string, bool) { return "", true })
+	return err
+}
+
+// ownsVolume returns whether a volume is named with the configured prefix.
+// When the plugin only manages prefixed volumes, it does not list, modify or
+// delete the others, which may belong to other clusters sharing the system.
+func (s *service) ownsVolume(vol *siotypes.Volume) bool {
+	return !s.opts.PrefixedVolumesOnly ||
+		strings.HasPrefix(vol.Name, volumeNamePrefix(s.opts.VolumeNamePrefix))
+}
+
+// getImportPrefix returns the prefix that imported volumes are renamed with,
+// so that they are managed by the plugin, or "" if they keep their names
+func (s *service) getImportPrefix() string {
+	if !s.opts.PrefixedVolumesOnly {
+		return ""
+	}
+	return s.opts.VolumeNamePrefix
+}
+
+// requireOwnership returns a FailedPrecondition error if the plugin does not
+// manage the given volume or snapshot
+func (s *service) requireOwnership(vol *siotypes.Volume, kind string) error {
+	if s.ownsVolume(vol) {
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition,
+		"%s: %s is not named with prefix: %s, and is not managed by this plugin",
+		kind, vol.Name, s.opts.VolumeNamePrefix)
+}
+
+// volumeNamePrefix returns the start of the names of the ScaleIO volumes
+// named with the given prefix
+func volumeNamePrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return prefix + volumeNamePrefixSeparator
+}
+
+// getVolumeName returns the name of the ScaleIO volume or snapshot for a CO
+// name, as translated by translateVolumeName.
+func getVolumeName(prefix, name string) string {
+	return translateVolumeName(prefix, name)
+}
+
+// translateVolumeName returns the prefix, and its separator, followed by the
+// CO name, when that is a valid ScaleIO name that is not marked as the name
+// of a CSI snapshot. Otherwise, the invalid characters of the CO name are
+// replaced, and it is truncated so that a hash of the CO name, and its mark,
+// can be appended. The name only depends on the prefix and the CO name, so a
+// request that is retried finds the volume created by the first attempt.
+func translateVolumeName(prefix, name string) string {
+	prefix = volumeNamePrefix(prefix)
+	n := prefix + name
+	if len(n) <= maxVolumeNameLen && isValidVolumeName(n) &&
+		!isSnapshotName(n) {
+		return n
+	}
+
+	return getHashedVolumeName(
+		prefix+sanitizeVolumeName(name), volumeNameHashSeparator, name)
+}
+
+// getMarkedVolumeName returns the name of a ScaleIO volume that is a ScaleIO
+// snapshot, such as a volume created from a snapshot, cloned or imported. It
+// is translated like the name of any volume, except that the hash of the CO
+// name, and its mark, are always appended, which marks it as a CSI volume.
+func getMarkedVolumeName(prefix, name string) string {
+	return getHashedVolumeName(
+		volumeNamePrefix(prefix)+sanitizeVolumeName(name),
+		volumeNameHashSeparator, name)
+}
+
+// getSnapshotName returns the name of the ScaleIO snapshot for a CO snapshot
+// name. It is translated like the name of a volume, except that the hash of
+// the CO name, and its mark, are always appended, after
+// snapshotNameHashSeparator, which marks the name as that of a CSI snapshot.
+func getSnapshotName(prefix, name string) string {
+	return getHashedVolumeName(
+		volumeNamePrefix(prefix)+sanitizeVolumeName(name),
+		snapshotNameHashSeparator, name)
+}
+
+// getHashedVolumeName returns the given base name, truncated and suffixed
+// with the separator, a hash of the CO name and the mark of the name
+func getHashedVolumeName(base, sep, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:volumeNameHashLen]
+
+	max := maxVolumeNameLen - len(sep) - len(hash) - volumeNameMarkLen
+	if len(base) > max {
+		base = base[:max]
+	}
+	n := base + sep + hash
+	return n + getVolumeNameMark(n)
+}
+
+// getVolumeNameMark returns the mark that the plugin appends to a name
+func getVolumeNameMark(name string) string {
+	sum := sha256.Sum256([]byte(volumeNameMarkKey + name))
+	return hex.EncodeToString(sum[:])[:volumeNameMarkLen]
+}
+
+// isMarkedName returns whether a name was generated by the plugin with the
+// given separator before the hash of the CO name, which its mark verifies
+func isMarkedName(name, sep string) bool {
+	i := len(name) - volumeNameMarkLen - volumeNameHashLen - len(sep)
+	if i < 0 || name[i:i+len(sep)] != sep {
+		return false
+	}
+	n := len(name) - volumeNameMarkLen
+	return name[n:] == getVolumeNameMark(name[:n])
+}
+
+// isSnapshotName returns whether a name is marked as the name of a CSI
+// snapshot
+func isSnapshotName(name string) bool {
+	return isMarkedName(name, snapshotNameHashSeparator)
+}
+
+// isCSISnapshot returns whether a ScaleIO volume is a CSI snapshot, which is
+// a ScaleIO snapshot whose name the plugin marked as that of a snapshot
+func isCSISnapshot(vol *siotypes.Volume) bool {
+	return vol.AncestorVolumeID != "" && isSnapshotName(vol.Name)
+}
+
+// isCSIVolume returns whether a ScaleIO volume is a CSI volume. A ScaleIO
+// snapshot, such as a volume created from a CSI snapshot or cloned, is only
+// a CSI volume when the plugin marked its name as that of a volume, so the
+// snapshots taken outside of the plugin are neither CSI volumes nor CSI
+// snapshots.
+func isCSIVolume(vol *siotypes.Volume) bool {
+	return vol.AncestorVolumeID == "" ||
+		isMarkedName(vol.Name, volumeNameHashSeparator)
+}
+
+// isValidVolumeNameChar returns whether a character may be used in the name
+// of a ScaleIO volume
+func isValidVolumeNameChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.'
+}
+
+// isValidVolumeName returns whether a name only has characters that may be
+// used in the name of a ScaleIO volume
+func isValidVolumeName(name string) bool {
+	for _, c := range name {
+		if !isValidVolumeNameChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeVolumeName replaces the characters of a name that may not be used
+// in the name of a ScaleIO volume
+func sanitizeVolumeName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if isValidVolumeNameChar(c) {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// validateVolumeNamePrefix checks that a prefix may be used for the names of
+// ScaleIO volumes
+func validateVolumeNamePrefix(prefix string) error {
+	if len(prefix) > maxVolumeNamePrefixLen {
+		return fmt.Errorf(
+			"volume name prefix: %s is longer than %d characters",
+			prefix, maxVolumeNamePrefixLen)
+	}
+	if !isValidVolumeName(prefix) ||
+		strings.Contains(prefix, volumeNamePrefixSeparator) {
+		return fmt.Errorf(
+			"volume name prefix: %s may only contain letters, digits, "+
+				"'-' and '_'", prefix)
+	}
+	return nil
+}
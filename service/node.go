@@ -3,6 +3,7 @@ package service
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
@@ -24,7 +25,18 @@ func (s *service) NodeStageVolume(
 	req *csi.NodeStageVolumeRequest) (
 	*csi.NodeStageVolumeResponse, error) {
 
-	return nil, status.Error(codes.Unimplemented, "")
+	id := req.GetVolumeId()
+
+	sdcMappedVol, err := s.getMappedVol(id, req.GetPublishInfo())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stageVolume(req, sdcMappedVol.SdcDevice); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (s *service) NodeUnstageVolume(
@@ -32,7 +44,11 @@ func (s *service) NodeUnstageVolume(
 	req *csi.NodeUnstageVolumeRequest) (
 	*csi.NodeUnstageVolumeResponse, error) {
 
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := unstageVolume(req); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (s *service) NodePublishVolume(
@@ -42,12 +58,12 @@ func (s *service) NodePublishVolume(
 
 	id := req.GetVolumeId()
 
-	sdcMappedVol, err := getMappedVol(id)
+	sdcMappedVol, err := s.getMappedVol(id, req.GetPublishInfo())
 	if err != nil {
 		return nil, err
 	}
 
-	if err := publishVolume(req, s.privDir, sdcMappedVol.SdcDevice); err != nil {
+	if err := publishVolume(req, sdcMappedVol.SdcDevice); err != nil {
 		return nil, err
 	}
 
@@ -59,21 +75,74 @@ func (s *service) NodeUnpublishVolume(
 	req *csi.NodeUnpublishVolumeRequest) (
 	*csi.NodeUnpublishVolumeResponse, error) {
 
-	id := req.GetVolumeId()
+	if err := unpublishVolume(req); err != nil {
+		return nil, err
+	}
 
-	sdcMappedVol, err := getMappedVol(id)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeExpandVolume rescans the SDC so that it detects the new size of a
+// volume that has been expanded by ControllerExpandVolume, and grows the
+// filesystem of the volume if it is mounted on this node
+func (s *service) NodeExpandVolume(
+	ctx context.Context,
+	req *NodeExpandVolumeRequest) (
+	*NodeExpandVolumeResponse, error) {
+
+	id := req.VolumeId
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"volumeID is required")
+	}
+
+	sdcMappedVol, err := s.getMappedVol(id, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := unpublishVolume(req, s.privDir, sdcMappedVol.SdcDevice); err != nil {
+	if err := rescanSDC(); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error rescanning SDC: %s", err.Error())
+	}
+
+	size, err := expandVolume(id, sdcMappedVol.SdcDevice)
+	if err != nil {
 		return nil, err
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return &NodeExpandVolumeResponse{
+		CapacityBytes: size,
+	}, nil
 }
 
-func getMappedVol(id string) (*goscaleio.SdcMappedVolume, error) {
+// rescanSDC has the SDC refresh its view of the volumes mapped to it, which
+// includes their sizes
+func rescanSDC() error {
+	out, err := exec.Command(drvCfg, "--rescan").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(),
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// getMappedVol returns the ScaleIO volume mapped to this node with the given
+// volume ID. Volume IDs only identify a volume within a ScaleIO system, so
+// the volume is also matched by the ID of the MDM, and thereby the system, it
+// is mapped from. The MDM ID is taken from the volume ID, or else from the
+// publish info set by the controller, or else it is the only MDM the SDC is
+// connected to. MDM IDs learnt from the publish info are cached, for requests
+// that do not carry it.
+func (s *service) getMappedVol(
+	id string,
+	publishInfo map[string]string) (*goscaleio.SdcMappedVolume, error) {
+
+	mdmID, volID := splitVolumeID(id)
+	if mdmID == "" {
+		mdmID = s.getVolumeMdmID(id, publishInfo)
+	}
+
 	// get source path of volume/device
 	localVols, err := goscaleio.GetLocalVolumeMap()
 	if err != nil {
@@ -81,18 +150,64 @@ func getMappedVol(id string) (*goscaleio.SdcMappedVolume, error) {
 			"unable to get locally mapped ScaleIO volumes: %s",
 			err.Error())
 	}
-	var sdcMappedVol *goscaleio.SdcMappedVolume
+	return findMappedVol(localVols, id, mdmID, volID)
+}
+
+// getVolumeMdmID returns the MDM ID of a volume whose ID does not include
+// one, or an empty string if it is not known
+func (s *service) getVolumeMdmID(
+	id string,
+	publishInfo map[string]string) string {
+
+	f := func() string {
+		s.volMdmIDsRWL.Lock()
+		defer s.volMdmIDsRWL.Unlock()
+
+		if mdmID := publishInfo[PublishInfoKeyMdmID]; mdmID != "" {
+			s.volMdmIDs[id] = mdmID
+			return mdmID
+		}
+		return s.volMdmIDs[id]
+	}
+	if mdmID := f(); mdmID != "" {
+		return mdmID
+	}
+
+	if ids, err := s.getMdmIDs(); err == nil && len(ids) == 1 {
+		return ids[0]
+	}
+	return ""
+}
+
+// findMappedVol finds the volume with the given ScaleIO volume ID, mapped
+// from the MDM with the given ID, in localVols. If the MDM ID is empty, the
+// volume ID must be unique among the mapped volumes.
+func findMappedVol(
+	localVols []*goscaleio.SdcMappedVolume,
+	id, mdmID, volID string) (*goscaleio.SdcMappedVolume, error) {
+
+	var matches []*goscaleio.SdcMappedVolume
 	for _, v := range localVols {
-		if v.VolumeID == id {
-			sdcMappedVol = v
-			break
+		if v.VolumeID == volID && (mdmID == "" || v.MdmID == mdmID) {
+			matches = append(matches, v)
 		}
 	}
-	if sdcMappedVol == nil {
+
+	switch len(matches) {
+	case 0:
 		return nil, status.Errorf(codes.Unavailable,
 			"volume: %s not published to node", id)
+	case 1:
+		return matches[0], nil
+	default:
+		mdmIDs := make([]string, len(matches))
+		for i, v := range matches {
+			mdmIDs[i] = v.MdmID
+		}
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume: %s is ambiguous, it is mapped to node from MDMs: %s",
+			id, strings.Join(mdmIDs, ", "))
 	}
-	return sdcMappedVol, nil
 }
 
 func (s *service) NodeGetId(
@@ -139,13 +254,6 @@ func (s *service) nodeProbe(ctx context.Context) error {
 			"scini kernel module not loaded")
 	}
 
-	// make sure privDir is pre-created
-	if _, err := mkdir(s.privDir); err != nil {
-		return status.Errorf(codes.Internal,
-			"plugin private dir: %s creation error: %s",
-			s.privDir, err.Error())
-	}
-
 	return nil
 }
 
@@ -175,7 +283,17 @@ func (s *service) NodeGetCapabilities(
 	req *csi.NodeGetCapabilitiesRequest) (
 	*csi.NodeGetCapabilitiesResponse, error) {
 
-	return &csi.NodeGetCapabilitiesResponse{}, nil
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			&csi.NodeServiceCapability{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
 }
 
 func (s *service) NodeGetInfo(
@@ -193,7 +311,17 @@ func (s *service) NodeGetInfo(
 			return nil, err
 		}
 	}
+
+	// The node is registered without topology when the SDC cannot report
+	// its MDMs, rather than not at all
+	topo, err := s.getNodeTopology()
+	if err != nil {
+		log.WithError(err).Warn(
+			"unable to get node topology, reporting node without topology")
+	}
+
 	return &csi.NodeGetInfoResponse{
-		NodeId: s.opts.SdcGUID,
+		NodeId:             s.opts.SdcGUID,
+		AccessibleTopology: topo,
 	}, nil
 }
@@ -0,0 +1,36 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeGetCaps(t *testing.T) {
+
+	ctx := context.Background()
+
+	gclient, stop := startServer(ctx, t)
+	defer stop()
+
+	client := csi.NewNodeClient(gclient)
+
+	rpcs := map[csi.NodeServiceCapability_RPC_Type]struct{}{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME: struct{}{},
+	}
+
+	resp, err := client.NodeGetCapabilities(ctx,
+		&csi.NodeGetCapabilitiesRequest{})
+
+	assert.NoError(t, err)
+	caps := resp.GetCapabilities()
+	assert.Len(t, caps, len(rpcs))
+
+	for _, cap := range caps {
+		assert.Contains(t, rpcs, cap.GetRpc().GetType())
+		delete(rpcs, cap.GetRpc().GetType())
+	}
+	assert.Empty(t, rpcs)
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	"github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// StoragePoolAuto is the storage pool name that places a volume in the
+	// storage pool of the system, or of the protection domain if one is
+	// given, with the most capacity available for volume allocation
+	StoragePoolAuto = "auto"
+
+	// storagePoolListSeparator separates the names of the candidate
+	// storage pools of a volume. The volume is placed in the candidate
+	// with the most capacity available for volume allocation.
+	storagePoolListSeparator = ","
+)
+
+// isSelection returns whether the reference names candidate storage pools to
+// select one from, rather than a single pool
+func (r poolRef) isSelection() bool {
+	return r.name == StoragePoolAuto ||
+		strings.Contains(r.name, storagePoolListSeparator)
+}
+
+// getCandidatePools returns the storage pools named by a selection: all the
+// pools of the system or of the protection domain for StoragePoolAuto, or
+// else the listed pools
+func (sys *scaleioSystem) getCandidatePools(
+	r poolRef) ([]*siotypes.StoragePool, error) {
+
+	if r.id != "" {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"`%s` cannot be used with a selection of storage pools: %s",
+			KeyStoragePoolID, r.name)
+	}
+
+	if r.name != StoragePoolAuto {
+		var pools []*siotypes.StoragePool
+		for _, name := range strings.Split(r.name, storagePoolListSeparator) {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			pool, err := sys.getStoragePool(
+				poolRef{name: name, pdName: r.pdName})
+			if err != nil {
+				return nil, err
+			}
+			pools = append(pools, pool)
+		}
+		if len(pools) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"no storage pool named in: %s", r.name)
+		}
+		return pools, nil
+	}
+
+	if r.pdName == "" {
+		pools, err := sys.client.GetStoragePool("")
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"unable to list storage pools, err: %s", err.Error())
+		}
+		return pools, nil
+	}
+
+	pd, err := sys.system.FindProtectionDomain("", r.pdName, "")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to look up protection domain: %s, err: %s",
+			r.pdName, err.Error())
+	}
+	pools, err := goscaleio.NewProtectionDomainEx(
+		sys.client, pd).GetStoragePool("")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to list storage pools of protection domain: %s, err: %s",
+			r.pdName, err.Error())
+	}
+	return pools, nil
+}
+
+// getAvailableCapacity returns the capacity of a storage pool that is
+// available for volume allocation, in KiB
+func (sys *scaleioSystem) getAvailableCapacity(
+	pool *siotypes.StoragePool) (int64, error) {
+
+	stats, err := goscaleio.NewStoragePoolEx(sys.client, pool).GetStatistics()
+	if err != nil {
+		return 0, err
+	}
+	return int64(stats.CapacityAvailableForVolumeAllocationInKb), nil
+}
+
+// selectPoolByCapacity returns the candidate storage pool with the most
+// capacity available for volume allocation, among those that can hold a
+// volume of the given size and are accessible from the topology
+// requirements. Candidates whose statistics cannot be retrieved are skipped.
+func (sys *scaleioSystem) selectPoolByCapacity(
+	pools []*siotypes.StoragePool,
+	sizeInKiB int64,
+	reqs *csi.TopologyRequirement) (*siotypes.StoragePool, error) {
+
+	var (
+		best      *siotypes.StoragePool
+		bestAvail int64
+	)
+	for _, pool := range pools {
+		f := log.Fields{
+			"storagePool":   pool.Name,
+			"storagePoolID": pool.ID,
+		}
+		if _, err := sys.getVolumeTopology(pool, reqs); err != nil {
+			log.WithFields(f).WithError(err).Debug(
+				"storage pool is not accessible from the requested topology")
+			continue
+		}
+		avail, err := sys.getAvailableCapacity(pool)
+		if err != nil {
+			log.WithFields(f).WithError(err).Warn(
+				"unable to get storage pool statistics")
+			continue
+		}
+		if avail < sizeInKiB {
+			continue
+		}
+		if best == nil || avail > bestAvail {
+			best, bestAvail = pool, avail
+		}
+	}
+
+	if best == nil {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"no candidate storage pool with %d KiB available is accessible "+
+				"from the requested topology", sizeInKiB)
+	}
+
+	log.WithFields(log.Fields{
+		"storagePool":   best.Name,
+		"storagePoolID": best.ID,
+		"availableKiB":  bestAvail,
+	}).Debug("selected storage pool by available capacity")
+
+	return best, nil
+}
+
+// placeVolume selects the storage pool of a volume among the candidates of a
+// selection. If the volume already exists, as when the request is retried,
+// or it has a source, the volume is in the pool of that volume or source,
+// which is therefore kept if it is a candidate. Otherwise, the volume is
+// placed in the candidate with the most capacity available for the volume
+// size, as rounded up by validateVolSize.
+func (s *service) placeVolume(
+	ctx context.Context,
+	sys *scaleioSystem,
+	name string,
+	r poolRef,
+	req *csi.CreateVolumeRequest) (*siotypes.StoragePool, error) {
+
+	sizeInKiB, err := validateVolSize(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+
+	pools, err := sys.getCandidatePools(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if spID := s.getPlacedPoolID(ctx, sys, name, req); spID != "" {
+		for _, pool := range pools {
+			if pool.ID == spID {
+				return pool, nil
+			}
+		}
+	}
+
+	return sys.selectPoolByCapacity(pools, sizeInKiB,
+		req.GetAccessibilityRequirements())
+}
+
+// getPlacedPoolID returns the ID of the storage pool of the volume with the
+// given name, or else of the source of the volume to create, if any. Lookup
+// errors are ignored, as they are reported when the volume is created.
+func (s *service) getPlacedPoolID(
+	ctx context.Context,
+	sys *scaleioSystem,
+	name string,
+	req *csi.CreateVolumeRequest) string {
+
+	if id, err := sys.client.FindVolumeID(name); err == nil && id != "" {
+		if vol, err := sys.getVolByID(id); err == nil {
+			return vol.StoragePoolID
+		}
+	}
+
+	srcID := req.GetVolumeContentSource().GetSnapshot().GetId()
+	if srcID == "" {
+		srcID = req.GetParameters()[KeySourceVolumeID]
+	}
+	if srcID == "" {
+		return ""
+	}
+	srcSys, id, err := s.getSystemForID(ctx, srcID)
+	if err != nil || srcSys.id() != sys.id() {
+		return ""
+	}
+	src, err := sys.getVolByID(id)
+	if err != nil {
+		return ""
+	}
+	return src.StoragePoolID
+}
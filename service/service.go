@@ -12,9 +12,10 @@ import (
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/rexray/gocsi"
 	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/utils"
 	log "github.com/sirupsen/logrus"
-	sio "github.com/thecodeteam/goscaleio"
 	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc"
 
 	"github.com/thecodeteam/csi-scaleio/core"
 )
@@ -29,7 +30,6 @@ const (
 
 	thinProvisioned  = "ThinProvisioned"
 	thickProvisioned = "ThickProvisioned"
-	defaultPrivDir   = "/dev/disk/csi-scaleio"
 )
 
 // Manifest is the SP's manifest.
@@ -58,27 +58,69 @@ type Opts struct {
 	Insecure   bool
 	Thick      bool
 	AutoProbe  bool
+	// ProtectionDomains are the names of the protection domains reachable
+	// from the node
+	ProtectionDomains []string
+	// UserFile and PasswordFile are the paths of files that the user name
+	// and password are read from instead of User and Password
+	UserFile     string
+	PasswordFile string
+	// TLS defines how the connections to the Gateway are secured
+	TLS TLSOpts
+	// EndpointPolicy is the policy used to choose the Gateway endpoint
+	// that serves a request, when Endpoint lists several endpoints
+	EndpointPolicy string
+	// MetricsAddress is the address that the Prometheus metrics are served
+	// on, if any
+	MetricsAddress string
+	// OTLPEndpoint is the OTLP/HTTP endpoint that trace spans are
+	// exported to, if any
+	OTLPEndpoint string
+	// TraceFile is the path of the file that trace spans are written to
+	// when OTLPEndpoint is not set, if any
+	TraceFile string
+	// AuditFile is the path of the file that the audit log is appended
+	// to, if any
+	AuditFile string
+	// VolumeNamePrefix is the prefix of the names of the ScaleIO volumes
+	// and snapshots created by the plugin
+	VolumeNamePrefix string
+	// VolumeNameTemplate is the template of the names of the ScaleIO
+	// volumes created by the plugin, if any
+	VolumeNameTemplate string
+	// StoragePool is the storage pool that volumes are created in when
+	// the volume create parameters name none
+	StoragePool string
+	// PrefixedVolumesOnly restricts the volumes and snapshots listed,
+	// modified and deleted by the plugin to those named with
+	// VolumeNamePrefix
+	PrefixedVolumesOnly bool
+	// Systems are the ScaleIO systems managed by the controller. When
+	// empty, the system defined by the options above is managed.
+	Systems []SystemConfig
 }
 
 type service struct {
 	opts        Opts
 	mode        string
-	adminClient *sio.Client
-	system      *sio.System
-	volCache    []*siotypes.Volume
-	volCacheRWL sync.RWMutex
-	sdcMap      map[string]string
-	sdcMapRWL   sync.RWMutex
-	spCache     map[string]string
-	spCacheRWL  sync.RWMutex
-	privDir     string
+	systems     []*scaleioSystem
+	volListings *volListings
+	mdmIDs      []string
+	mdmIDsRWL   sync.RWMutex
+	// volMdmIDs caches the MDM IDs of volumes whose IDs do not include one
+	volMdmIDs    map[string]string
+	volMdmIDsRWL sync.Mutex
+	// extInterceptor chains the interceptors of the gRPC server, which
+	// the extension methods run themselves
+	extInterceptor grpc.UnaryServerInterceptor
 }
 
 // New returns a new Service.
 func New() Service {
 	return &service{
-		sdcMap:  map[string]string{},
-		spCache: map[string]string{},
+		volListings:    newVolListings(),
+		volMdmIDs:      map[string]string{},
+		extInterceptor: utils.ChainUnaryServer(),
 	}
 }
 
@@ -87,16 +129,31 @@ func (s *service) BeforeServe(
 
 	defer func() {
 		fields := map[string]interface{}{
-			"endpoint":       s.opts.Endpoint,
-			"user":           s.opts.User,
-			"password":       "",
-			"systemname":     s.opts.SystemName,
-			"sdcGUID":        s.opts.SdcGUID,
-			"insecure":       s.opts.Insecure,
-			"thickprovision": s.opts.Thick,
-			"privatedir":     s.privDir,
-			"autoprobe":      s.opts.AutoProbe,
-			"mode":           s.mode,
+			"endpoint":            s.opts.Endpoint,
+			"endpointpolicy":      s.opts.EndpointPolicy,
+			"user":                s.opts.User,
+			"password":            "",
+			"userfile":            s.opts.UserFile,
+			"passwordfile":        s.opts.PasswordFile,
+			"systemname":          s.opts.SystemName,
+			"sdcGUID":             s.opts.SdcGUID,
+			"insecure":            s.opts.Insecure,
+			"cacerts":             s.opts.TLS.CACerts,
+			"clientcert":          s.opts.TLS.ClientCert,
+			"certpins":            len(s.opts.TLS.CertPins),
+			"thickprovision":      s.opts.Thick,
+			"autoprobe":           s.opts.AutoProbe,
+			"protectiondomains":   s.opts.ProtectionDomains,
+			"systems":             len(s.opts.Systems),
+			"metricsaddress":      s.opts.MetricsAddress,
+			"otlpendpoint":        s.opts.OTLPEndpoint,
+			"tracefile":           s.opts.TraceFile,
+			"auditfile":           s.opts.AuditFile,
+			"volumenameprefix":    s.opts.VolumeNamePrefix,
+			"volumenametemplate":  s.opts.VolumeNameTemplate,
+			"prefixedvolumesonly": s.opts.PrefixedVolumesOnly,
+			"storagepool":         s.opts.StoragePool,
+			"mode":                s.mode,
 		}
 
 		if s.opts.Password != "" {
@@ -114,6 +171,21 @@ func (s *service) BeforeServe(
 	if ep, ok := csictx.LookupEnv(ctx, EnvEndpoint); ok {
 		opts.Endpoint = ep
 	}
+	if ca, ok := csictx.LookupEnv(ctx, EnvCACerts); ok {
+		opts.TLS.CACerts = ca
+	}
+	if cert, ok := csictx.LookupEnv(ctx, EnvClientCert); ok {
+		opts.TLS.ClientCert = cert
+	}
+	if key, ok := csictx.LookupEnv(ctx, EnvClientKey); ok {
+		opts.TLS.ClientKey = key
+	}
+	if pins, ok := csictx.LookupEnv(ctx, EnvCertPins); ok && pins != "" {
+		opts.TLS.CertPins = strings.Split(pins, ",")
+	}
+	if policy, ok := csictx.LookupEnv(ctx, EnvEndpointPolicy); ok {
+		opts.EndpointPolicy = policy
+	}
 	if user, ok := csictx.LookupEnv(ctx, EnvUser); ok {
 		opts.User = user
 	}
@@ -123,17 +195,59 @@ func (s *service) BeforeServe(
 	if pw, ok := csictx.LookupEnv(ctx, EnvPassword); ok {
 		opts.Password = pw
 	}
+	if path, ok := csictx.LookupEnv(ctx, EnvUserFile); ok {
+		opts.UserFile = path
+	}
+	if path, ok := csictx.LookupEnv(ctx, EnvPasswordFile); ok {
+		opts.PasswordFile = path
+	}
 	if name, ok := csictx.LookupEnv(ctx, EnvSystemName); ok {
 		opts.SystemName = name
 	}
 	if guid, ok := csictx.LookupEnv(ctx, EnvSDCGUID); ok {
 		opts.SdcGUID = guid
 	}
-	if pd, ok := csictx.LookupEnv(ctx, "X_CSI_PRIVATE_MOUNT_DIR"); ok {
-		s.privDir = pd
+	if path, ok := csictx.LookupEnv(ctx, EnvSystemsFile); ok && path != "" {
+		systems, err := readSystemsFile(path)
+		if err != nil {
+			return err
+		}
+		opts.Systems = systems
+	}
+	if addr, ok := csictx.LookupEnv(ctx, EnvMetricsAddress); ok {
+		opts.MetricsAddress = addr
+	}
+	if ep, ok := csictx.LookupEnv(ctx, EnvOTLPEndpoint); ok {
+		opts.OTLPEndpoint = ep
+	}
+	if path, ok := csictx.LookupEnv(ctx, EnvTraceFile); ok {
+		opts.TraceFile = path
+	}
+	if path, ok := csictx.LookupEnv(ctx, EnvAuditFile); ok {
+		opts.AuditFile = path
+	}
+	if prefix, ok := csictx.LookupEnv(ctx, EnvVolumeNamePrefix); ok {
+		if err := validateVolumeNamePrefix(prefix); err != nil {
+			return err
+		}
+		opts.VolumeNamePrefix = prefix
+	}
+	if tmpl, ok := csictx.LookupEnv(ctx, EnvVolumeNameTemplate); ok {
+		if err := validateVolumeNameTemplate(tmpl); err != nil {
+			return fmt.Errorf("invalid %s: %s",
+				EnvVolumeNameTemplate, err.Error())
+		}
+		opts.VolumeNameTemplate = tmpl
+	}
+	if sp, ok := csictx.LookupEnv(ctx, EnvStoragePool); ok {
+		opts.StoragePool = sp
 	}
-	if s.privDir == "" {
-		s.privDir = defaultPrivDir
+	if pds, ok := csictx.LookupEnv(ctx, EnvProtectionDomains); ok {
+		for _, pd := range strings.Split(pds, ",") {
+			if pd = strings.TrimSpace(pd); pd != "" {
+				opts.ProtectionDomains = append(opts.ProtectionDomains, pd)
+			}
+		}
 	}
 
 	// pb parses an environment variable into a boolean value. If an error
@@ -154,9 +268,53 @@ func (s *service) BeforeServe(
 	opts.Insecure = pb(EnvInsecure)
 	opts.Thick = pb(EnvThick)
 	opts.AutoProbe = pb(EnvAutoProbe)
+	opts.PrefixedVolumesOnly = pb(EnvPrefixedVolumesOnly)
+	if opts.PrefixedVolumesOnly && opts.VolumeNamePrefix == "" {
+		return fmt.Errorf("%s requires %s to be set",
+			EnvPrefixedVolumesOnly, EnvVolumeNamePrefix)
+	}
 
 	s.opts = opts
 
+	// Serve the extension methods on the same endpoint as the CSI services
+	sp.ServerOpts = append(sp.ServerOpts,
+		grpc.UnknownServiceHandler(s.handleExtension))
+
+	exporter, err := newTraceExporter(s.opts.OTLPEndpoint, s.opts.TraceFile)
+	if err != nil {
+		return err
+	}
+	if exporter != nil {
+		defaultTracer = newTracer(exporter)
+
+		// Interceptors added here are chained after those of GoCSI, so
+		// that the spans record the request ID
+		sp.Interceptors = append(sp.Interceptors, TracingInterceptor)
+	}
+
+	if s.opts.AuditFile != "" {
+		a, err := newAuditor(s.opts.AuditFile)
+		if err != nil {
+			return err
+		}
+		defaultAuditor = a
+		sp.Interceptors = append(sp.Interceptors, AuditInterceptor)
+	}
+
+	// gRPC does not run the interceptors of the server for the handler of
+	// unknown services, so the extension methods are run through the same
+	// chain, which GoCSI builds from these interceptors after BeforeServe
+	s.extInterceptor = utils.ChainUnaryServer(sp.Interceptors...)
+
+	if s.opts.MetricsAddress != "" {
+		if !strings.EqualFold(s.mode, "controller") {
+			defaultMetrics.setNodeVolumes(countNodeVolumes)
+		}
+		if err := serveMetrics(s.opts.MetricsAddress, defaultMetrics); err != nil {
+			return err
+		}
+	}
+
 	if _, ok := csictx.LookupEnv(ctx, "X_CSI_SCALEIO_NO_PROBE_ON_START"); !ok {
 		// Do a controller probe
 		if !strings.EqualFold(s.mode, "node") {
@@ -200,83 +358,31 @@ func (s *service) getVolProvisionType(params map[string]string) string {
 	return volType
 }
 
-func (s *service) getVolByID(id string) (*siotypes.Volume, error) {
-
-	// The `GetVolume` API returns a slice of volumes, but when only passing
-	// in a volume ID, the response will be just the one volume
-	vols, err := s.adminClient.GetVolume("", id, "", "", false)
-	if err != nil {
-		return nil, err
-	}
-	return vols[0], nil
-}
-
-func (s *service) getSDCID(sdcGUID string) (string, error) {
-	sdcGUID = strings.ToUpper(sdcGUID)
-
-	// check if ID is already in cache
-	f := func() string {
-		s.sdcMapRWL.RLock()
-		defer s.sdcMapRWL.RUnlock()
-
-		if id, ok := s.sdcMap[sdcGUID]; ok {
-			return id
-		}
-		return ""
-	}
-	if id := f(); id != "" {
-		return id, nil
-	}
-
-	// Need to translate sdcGUID to sdcID
-	id, err := s.system.FindSdc("SdcGuid", sdcGUID)
-	if err != nil {
-		return "", fmt.Errorf("error finding SDC from GUID: %s, err: %s",
-			sdcGUID, err.Error())
-	}
-
-	s.sdcMapRWL.Lock()
-	defer s.sdcMapRWL.Unlock()
-
-	s.sdcMap[sdcGUID] = id.Sdc.ID
-
-	return id.Sdc.ID, nil
-}
-
-func (s *service) getStoragePoolID(name string) (string, error) {
-	// check if ID is already in cache
-	f := func() string {
-		s.spCacheRWL.RLock()
-		defer s.spCacheRWL.RUnlock()
+func getCSIVolume(systemID string, vol *siotypes.Volume) *csi.Volume {
 
-		if id, ok := s.spCache[name]; ok {
-			return id
-		}
-		return ""
-	}
-	if id := f(); id != "" {
-		return id, nil
-	}
-
-	// Need to lookup ID from the gateway
-	pool, err := s.adminClient.FindStoragePool("", name, "")
-	if err != nil {
-		return "", err
+	vi := &csi.Volume{
+		Id:            newVolumeID(systemID, vol.ID),
+		CapacityBytes: int64(vol.SizeInKb * bytesInKiB),
+		Attributes:    getVolumeAttributes(systemID, vol),
 	}
 
-	s.spCacheRWL.Lock()
-	defer s.spCacheRWL.Unlock()
-	s.spCache[name] = pool.ID
-
-	return pool.ID, nil
+	return vi
 }
 
-func getCSIVolume(vol *siotypes.Volume) *csi.Volume {
-
-	vi := &csi.Volume{
-		Id:            vol.ID,
-		CapacityBytes: int64(vol.SizeInKb * bytesInKiB),
+func getCSISnapshot(systemID string, vol *siotypes.Volume) *csi.Snapshot {
+
+	snap := &csi.Snapshot{
+		Id:             newVolumeID(systemID, vol.ID),
+		SourceVolumeId: newVolumeID(systemID, vol.AncestorVolumeID),
+		SizeBytes:      int64(vol.SizeInKb * bytesInKiB),
+		// ScaleIO reports creation time in seconds since the epoch, while
+		// CSI expects nanoseconds
+		CreatedAt: int64(vol.CreationTime) * int64(time.Second),
+		// ScaleIO snapshots are instantaneous, so they are always ready
+		Status: &csi.SnapshotStatus{
+			Type: csi.SnapshotStatus_READY,
+		},
 	}
 
-	return vi
+	return snap
 }
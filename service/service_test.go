@@ -3,6 +3,7 @@ package service_test
 import (
 	"context"
 	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -15,9 +16,12 @@ import (
 
 func startServer(ctx context.Context, t *testing.T) (*grpc.ClientConn, func()) {
 
+	// There is no ScaleIO system to probe when testing
+	os.Setenv("X_CSI_SCALEIO_NO_PROBE_ON_START", "true")
+
 	// Create a new SP instance and serve it with a piped connection.
 	sp := provider.New()
-	lis, err := memconn.Listen("csi-test")
+	lis, err := memconn.Listen("memu", "csi-test")
 	assert.NoError(t, err)
 	go func() {
 		if err := sp.Serve(ctx, lis); err != nil {
@@ -28,7 +32,7 @@ func startServer(ctx context.Context, t *testing.T) (*grpc.ClientConn, func()) {
 	clientOpts := []grpc.DialOption{
 		grpc.WithInsecure(),
 		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
-			return memconn.Dial("csi-test")
+			return memconn.Dial("memu", "csi-test")
 		}),
 	}
 
@@ -1,11 +1,45 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/protobuf/proto"
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/thecodeteam/goscaleio"
 	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestGetVolSize(t *testing.T) {
@@ -352,3 +386,3031 @@ func TestVolumeCaps(t *testing.T) {
 		})
 	}
 }
+
+func TestGetCSISnapshot(t *testing.T) {
+	vol := &siotypes.Volume{
+		ID:               "f2ffb6f600000002",
+		AncestorVolumeID: "f2ffb6f500000001",
+		SizeInKb:         8 * kiBytesInGiB,
+		CreationTime:     1538000000,
+	}
+
+	snap := getCSISnapshot("4bd3c12e3e4ebd7e", vol)
+	assert.Equal(t, "4bd3c12e3e4ebd7e-f2ffb6f600000002", snap.GetId())
+	assert.Equal(t, "4bd3c12e3e4ebd7e-f2ffb6f500000001",
+		snap.GetSourceVolumeId())
+	assert.EqualValues(t, 8*bytesInGiB, snap.GetSizeBytes())
+	assert.EqualValues(t, int64(1538000000)*1000000000, snap.GetCreatedAt())
+	assert.Equal(t, csi.SnapshotStatus_READY, snap.GetStatus().GetType())
+}
+
+func TestGetCSIVolume(t *testing.T) {
+	vol := &siotypes.Volume{
+		ID:            "f2ffb6f600000002",
+		StoragePoolID: "b1b5d4d300000000",
+		VolumeType:    thickProvisioned,
+		VTreeID:       "e4a6bbf000000001",
+		SizeInKb:      8 * kiBytesInGiB,
+		CreationTime:  1538000000,
+		MappedSdcInfo: []*siotypes.MappedSdcInfo{
+			{SdcID: "sdc1", LimitIops: 100, LimitBwInMbps: 10},
+			{SdcID: "sdc2", LimitIops: 100, LimitBwInMbps: 10},
+		},
+	}
+
+	vi := getCSIVolume("4bd3c12e3e4ebd7e", vol)
+	assert.Equal(t, "4bd3c12e3e4ebd7e-f2ffb6f600000002", vi.GetId())
+	assert.EqualValues(t, 8*bytesInGiB, vi.GetCapacityBytes())
+	assert.Equal(t, map[string]string{
+		AttributeKeySystemID:      "4bd3c12e3e4ebd7e",
+		AttributeKeyStoragePoolID: "b1b5d4d300000000",
+		AttributeKeyProvisioning:  ProvisioningThick,
+		AttributeKeyVTreeID:       "e4a6bbf000000001",
+		AttributeKeyCreationTime:  "2018-09-26T22:13:20Z",
+		AttributeKeyRmCache:       "false",
+		KeyMaxIOPS:                "100",
+		KeyMaxBandwidthMBps:       "10",
+	}, vi.GetAttributes())
+
+	// mappings with different limits leave the QoS limits out
+	vol.MappedSdcInfo[1].LimitIops = 0
+	vol.VolumeType = sioVolumeTypeSnapshot
+	vi = getCSIVolume("4bd3c12e3e4ebd7e", vol)
+	assert.NotContains(t, vi.GetAttributes(), KeyMaxIOPS)
+	assert.NotContains(t, vi.GetAttributes(), KeyMaxBandwidthMBps)
+	assert.Equal(t, ProvisioningThin, vi.GetAttributes()[AttributeKeyProvisioning])
+
+	// the storage pool and protection domain are looked up, once for all
+	// pools
+	var lookups int32
+	sys, done := newTestSystem(t, "sys1", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&lookups, 1)
+			switch r.URL.Path {
+			case "/api/types/StoragePool/instances":
+				json.NewEncoder(w).Encode([]*siotypes.StoragePool{
+					{ID: "b1b5d4d300000000", Name: "pool1",
+						ProtectionDomainID: "a6d5e2c800000000"},
+					{ID: "b1b5d4d400000001", Name: "pool2",
+						ProtectionDomainID: "a6d5e2c800000000"},
+				})
+			case "/api/instances/System::sys1/relationships/ProtectionDomain":
+				json.NewEncoder(w).Encode([]*siotypes.ProtectionDomain{
+					{ID: "a6d5e2c800000000", Name: "pd1"},
+				})
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer done()
+	sys.system.System.Links = []*siotypes.Link{{
+		Rel:  "/api/System/relationship/ProtectionDomain",
+		HREF: "/api/instances/System::sys1/relationships/ProtectionDomain",
+	}}
+
+	vi = sys.getCSIVolume(vol)
+	attrs := vi.GetAttributes()
+	assert.Equal(t, "sys1", attrs[AttributeKeySystemName])
+	assert.Equal(t, "pool1", attrs[AttributeKeyStoragePool])
+	assert.Equal(t, "a6d5e2c800000000", attrs[AttributeKeyProtectionDomainID])
+	assert.Equal(t, "pd1", attrs[AttributeKeyProtectionDomain])
+
+	vol.StoragePoolID = "b1b5d4d400000001"
+	vi = sys.getCSIVolume(vol)
+	assert.Equal(t, "pool2", vi.GetAttributes()[AttributeKeyStoragePool])
+	assert.EqualValues(t, 2, atomic.LoadInt32(&lookups))
+
+	// requested attributes replace those of the volume
+	addAttributes(vi, map[string]string{KeyMaxIOPS: "200"})
+	assert.Equal(t, "200", vi.GetAttributes()[KeyMaxIOPS])
+}
+
+func TestValidateSourceSize(t *testing.T) {
+	tests := []struct {
+		cr    *csi.CapacityRange
+		valid bool
+	}{
+		{
+			// no range requested accepts the size of the source
+			cr:    &csi.CapacityRange{},
+			valid: true,
+		},
+		{
+			// requesting less than the source is satisfied by the source
+			cr: &csi.CapacityRange{
+				RequiredBytes: 10 * bytesInGiB,
+			},
+			valid: true,
+		},
+		{
+			// requesting more than the source is not possible
+			cr: &csi.CapacityRange{
+				RequiredBytes: 24 * bytesInGiB,
+			},
+			valid: false,
+		},
+		{
+			// a limit below the size of the source is not possible
+			cr: &csi.CapacityRange{
+				LimitBytes: 8 * bytesInGiB,
+			},
+			valid: false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("", func(st *testing.T) {
+			st.Parallel()
+			err := validateSourceSize(tt.cr, 16*kiBytesInGiB)
+			if tt.valid {
+				assert.NoError(st, err)
+			} else {
+				assert.Error(st, err)
+			}
+		})
+	}
+}
+
+func TestOrderSnapshotGroup(t *testing.T) {
+	snapA := &siotypes.Volume{ID: "snapa", AncestorVolumeID: "vola"}
+	snapB := &siotypes.Volume{ID: "snapb", AncestorVolumeID: "volb"}
+	snapC := &siotypes.Volume{ID: "snapc", AncestorVolumeID: "volc"}
+
+	tests := []struct {
+		srcIDs  []string
+		members []*siotypes.Volume
+		ordered []*siotypes.Volume
+		ok      bool
+	}{
+		{
+			// members are returned in the order of the sources
+			srcIDs:  []string{"volb", "vola"},
+			members: []*siotypes.Volume{snapA, snapB},
+			ordered: []*siotypes.Volume{snapB, snapA},
+			ok:      true,
+		},
+		{
+			// a missing member does not match
+			srcIDs:  []string{"vola", "volb"},
+			members: []*siotypes.Volume{snapA},
+			ok:      false,
+		},
+		{
+			// a member of a different source does not match
+			srcIDs:  []string{"vola", "volb"},
+			members: []*siotypes.Volume{snapA, snapC},
+			ok:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("", func(st *testing.T) {
+			st.Parallel()
+			ordered, ok := orderSnapshotGroup(tt.srcIDs, tt.members)
+			assert.Equal(st, tt.ok, ok)
+			assert.Equal(st, tt.ordered, ordered)
+		})
+	}
+}
+
+func TestGetVolumeQoS(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		qos    volumeQoS
+		valid  bool
+	}{
+		{
+			// no limits
+			params: map[string]string{},
+			valid:  true,
+		},
+		{
+			params: map[string]string{
+				KeyMaxIOPS:          "500",
+				KeyMaxBandwidthMBps: "100",
+			},
+			qos:   volumeQoS{iops: 500, bwInMBps: 100},
+			valid: true,
+		},
+		{
+			// 0 explicitly removes the limit
+			params: map[string]string{KeyMaxIOPS: "0"},
+			valid:  true,
+		},
+		{
+			// ScaleIO does not accept IOPS limits of 10 or less
+			params: map[string]string{KeyMaxIOPS: "10"},
+			valid:  false,
+		},
+		{
+			params: map[string]string{KeyMaxBandwidthMBps: "-1"},
+			valid:  false,
+		},
+		{
+			params: map[string]string{KeyMaxIOPS: "fast"},
+			valid:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("", func(st *testing.T) {
+			st.Parallel()
+			qos, err := getVolumeQoS(tt.params)
+			if !tt.valid {
+				assert.Error(st, err)
+				return
+			}
+			assert.NoError(st, err)
+			assert.Equal(st, tt.qos, qos)
+
+			// limits must survive a round trip through volume attributes
+			rt, err := getVolumeQoS(qos.attributes())
+			assert.NoError(st, err)
+			assert.Equal(st, qos, rt)
+		})
+	}
+}
+
+func TestParseMdmIDs(t *testing.T) {
+	out := []byte(`Retrieved 2 mdm(s)
+MDM-ID 14dbbf5617523654 SDC ID d0f33bd700000004 INSTALLATION ID 1c078b073d75512c IPs [0]-10.0.0.1 [1]-10.0.0.2
+MDM-ID 6b2e4d2a1f6d0c51 SDC ID 9a8d3e0c00000002 INSTALLATION ID 2d1a0c5b4e6f7a8b IPs [0]-10.1.0.1
+`)
+	assert.Equal(t, []string{"14dbbf5617523654", "6b2e4d2a1f6d0c51"},
+		parseMdmIDs(out))
+	assert.Empty(t, parseMdmIDs([]byte("Retrieved 0 mdm(s)\n")))
+}
+
+func TestNodeGetInfoWithoutTopology(t *testing.T) {
+	if _, err := os.Stat(drvCfg); err == nil {
+		t.Skip("drv_cfg is installed")
+	}
+
+	s := New().(*service)
+	s.opts.SdcGUID = "guid1"
+
+	// the node is reported even though the SDC MDMs cannot be queried
+	resp, err := s.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "guid1", resp.GetNodeId())
+	assert.Nil(t, resp.GetAccessibleTopology())
+}
+
+func TestPoolTopologySatisfies(t *testing.T) {
+	pt := poolTopology{
+		systemKey: TopologyKeySystemPrefix + "sys1",
+		pdKey:     TopologyKeyProtectionDomainPrefix + "pd1",
+	}
+
+	tests := []struct {
+		segs      map[string]string
+		satisfies bool
+	}{
+		{
+			// segments of other plugins are ignored
+			segs:      map[string]string{"zone": "a"},
+			satisfies: true,
+		},
+		{
+			segs:      map[string]string{pt.systemKey: "true"},
+			satisfies: true,
+		},
+		{
+			segs: map[string]string{
+				TopologyKeySystemPrefix + "sys2": "true",
+			},
+			satisfies: false,
+		},
+		{
+			segs: map[string]string{
+				pt.systemKey: "true",
+				TopologyKeyProtectionDomainPrefix + "pd2": "true",
+				pt.pdKey: "true",
+			},
+			satisfies: true,
+		},
+		{
+			segs: map[string]string{
+				pt.systemKey: "true",
+				TopologyKeyProtectionDomainPrefix + "pd2": "true",
+			},
+			satisfies: false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("", func(st *testing.T) {
+			st.Parallel()
+			topo := &csi.Topology{Segments: tt.segs}
+			assert.Equal(st, tt.satisfies, pt.satisfies(topo))
+		})
+	}
+}
+
+func TestSplitVolumeID(t *testing.T) {
+	tests := []struct {
+		id       string
+		systemID string
+		volID    string
+	}{
+		{
+			id:       newVolumeID("4bd3c12e3e4ebd7e", "f2ffb6f600000002"),
+			systemID: "4bd3c12e3e4ebd7e",
+			volID:    "f2ffb6f600000002",
+		},
+		{
+			// IDs of volumes created by older versions of the plugin
+			// belong to the default system
+			id:    "f2ffb6f600000002",
+			volID: "f2ffb6f600000002",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("", func(st *testing.T) {
+			st.Parallel()
+			systemID, volID := splitVolumeID(tt.id)
+			assert.Equal(st, tt.systemID, systemID)
+			assert.Equal(st, tt.volID, volID)
+		})
+	}
+}
+
+func TestGetSystemConfigs(t *testing.T) {
+	opts := Opts{
+		Endpoint:   "https://gw1",
+		User:       "admin",
+		Password:   "pw",
+		SystemName: "sys1",
+	}
+	cfgs := opts.getSystemConfigs()
+	assert.Len(t, cfgs, 1)
+	assert.Equal(t, "sys1", cfgs[0].SystemName)
+	assert.True(t, cfgs[0].Default)
+
+	opts.Systems = []SystemConfig{
+		SystemConfig{SystemName: "sys2", Endpoint: "https://gw2"},
+		SystemConfig{SystemName: "sys3", Endpoint: "https://gw3"},
+	}
+	cfgs = opts.getSystemConfigs()
+	assert.Len(t, cfgs, 2)
+	assert.True(t, cfgs[0].Default)
+	assert.False(t, cfgs[1].Default)
+	assert.Equal(t, "admin", cfgs[1].User)
+}
+
+func TestFindMappedVol(t *testing.T) {
+	localVols := []*goscaleio.SdcMappedVolume{
+		&goscaleio.SdcMappedVolume{
+			MdmID:     "4bd3c12e3e4ebd7e",
+			VolumeID:  "f2ffb6f600000002",
+			SdcDevice: "/dev/scinia",
+		},
+		&goscaleio.SdcMappedVolume{
+			MdmID:     "6b2e4d2a1f6d0c51",
+			VolumeID:  "f2ffb6f600000002",
+			SdcDevice: "/dev/scinib",
+		},
+		&goscaleio.SdcMappedVolume{
+			MdmID:     "6b2e4d2a1f6d0c51",
+			VolumeID:  "e1aa0b1200000003",
+			SdcDevice: "/dev/scinic",
+		},
+	}
+
+	tests := []struct {
+		mdmID  string
+		volID  string
+		device string
+		code   codes.Code
+	}{
+		{
+			mdmID:  "6b2e4d2a1f6d0c51",
+			volID:  "f2ffb6f600000002",
+			device: "/dev/scinib",
+		},
+		{
+			// a volume ID that is unique among the mapped volumes does
+			// not need an MDM ID
+			volID:  "e1aa0b1200000003",
+			device: "/dev/scinic",
+		},
+		{
+			volID: "f2ffb6f600000002",
+			code:  codes.FailedPrecondition,
+		},
+		{
+			mdmID: "4bd3c12e3e4ebd7e",
+			volID: "e1aa0b1200000003",
+			code:  codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("", func(st *testing.T) {
+			st.Parallel()
+			vol, err := findMappedVol(localVols, tt.volID, tt.mdmID, tt.volID)
+			if tt.code != codes.OK {
+				assert.Equal(st, tt.code, status.Code(err))
+				return
+			}
+			assert.NoError(st, err)
+			assert.Equal(st, tt.device, vol.SdcDevice)
+		})
+	}
+}
+
+func TestAuthTransport(t *testing.T) {
+	var (
+		logins int32
+		token  atomic.Value
+	)
+	token.Store("")
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, pw, _ := r.BasicAuth()
+			if r.URL.Path == "/api/login" {
+				if user != "admin" || pw != "password" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				n := atomic.AddInt32(&logins, 1)
+				tok := fmt.Sprintf("token%d", n)
+				token.Store(tok)
+				fmt.Fprintf(w, `"%s"`, tok)
+				return
+			}
+			if pw == "" || pw != token.Load().(string) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer srv.Close()
+
+	endpoint, err := url.Parse(srv.URL + "/api")
+	assert.NoError(t, err)
+	creds, err := newCredentialsSource("admin", "password", "", "")
+	assert.NoError(t, err)
+	tr := newAuthTransport(http.DefaultTransport, *endpoint, creds)
+	client := &http.Client{Transport: tr}
+
+	// the token of a login is recorded by the transport
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/login", nil)
+	req.SetBasicAuth("admin", "password")
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&logins))
+
+	// expire the session, and send concurrent requests
+	token.Store("expired")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL + "/api/types/System/instances")
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the rejected requests only caused a single login
+	assert.EqualValues(t, 2, atomic.LoadInt32(&logins))
+
+	// rejected credentials are not retried
+	creds.current.password = "wrong"
+	token.Store("expired")
+	_, err = client.Get(srv.URL + "/api/types/System/instances")
+	assert.Error(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&logins))
+}
+
+func TestFailoverTransport(t *testing.T) {
+	newServer := func(hits *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(hits, 1)
+				w.WriteHeader(http.StatusOK)
+			}))
+	}
+
+	var hits1, hits2 int32
+	srv1 := newServer(&hits1)
+	srv2 := newServer(&hits2)
+	defer srv2.Close()
+
+	eps, err := parseEndpoints(srv1.URL + "/api, " + srv2.URL + "/api")
+	assert.NoError(t, err)
+	assert.Len(t, eps, 2)
+
+	newRT := func(*url.URL) http.RoundTripper { return http.DefaultTransport }
+
+	// round-robin spreads requests across the endpoints
+	rr, err := newFailoverTransport(eps, EndpointPolicyRoundRobin, newRT)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rr}
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(srv1.URL + "/api/version")
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&hits1))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&hits2))
+
+	// failover sends requests to the first endpoint while it is up, and
+	// to the second one once it is down
+	fo, err := newFailoverTransport(eps, EndpointPolicyFailover, newRT)
+	assert.NoError(t, err)
+	client = &http.Client{Transport: fo}
+
+	resp, err := client.Get(srv1.URL + "/api/version")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, 3, atomic.LoadInt32(&hits1))
+	assert.Equal(t, fo.endpoints[0], fo.served)
+
+	srv1.Close()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv1.URL + "/api/version")
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.EqualValues(t, 4, atomic.LoadInt32(&hits2))
+	assert.Equal(t, fo.endpoints[1], fo.served)
+	assert.False(t, fo.endpoints[0].healthy(time.Now()))
+	assert.True(t, fo.endpoints[1].healthy(time.Now()))
+
+	_, err = newFailoverTransport(eps, "random", newRT)
+	assert.Error(t, err)
+}
+
+func TestFailoverTransportPost(t *testing.T) {
+	var hits1, hits2 int32
+	srv1 := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits1, 1)
+			if r.URL.Path == "/api/drop" {
+				// the connection is lost after the request was received
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	srv2 := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits2, 1)
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer srv2.Close()
+
+	eps, err := parseEndpoints(srv1.URL + "," + srv2.URL)
+	assert.NoError(t, err)
+	newRT := func(*url.URL) http.RoundTripper { return http.DefaultTransport }
+	newClient := func() *http.Client {
+		fo, err := newFailoverTransport(eps, EndpointPolicyFailover, newRT)
+		assert.NoError(t, err)
+		return &http.Client{Transport: fo}
+	}
+	post := func(c *http.Client, path string) (*http.Response, error) {
+		return c.Post(srv1.URL+path, "application/json",
+			strings.NewReader("{}"))
+	}
+
+	// a POST that the endpoint answered as unavailable is not sent again
+	resp, err := post(newClient(), "/api/addVolume")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits1))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hits2))
+
+	// nor is a POST whose response was lost
+	_, err = post(newClient(), "/api/drop")
+	assert.Error(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&hits1))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hits2))
+
+	// while a GET is
+	resp, err = newClient().Get(srv1.URL + "/api/version")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt32(&hits1))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits2))
+
+	// a POST that never reached the endpoint is sent to the next one
+	srv1.Close()
+	resp, err = post(newClient(), "/api/addVolume")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&hits2))
+}
+
+func TestTLSTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer srv.Close()
+	// httptest servers share a certificate, so another one is generated
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	assert.NoError(t, err)
+	other, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "csi-scaleio-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeCA := func(cert *x509.Certificate, mtime time.Time) string {
+		path := filepath.Join(dir, "ca.pem")
+		b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		assert.NoError(t, ioutil.WriteFile(path, b, 0600))
+		assert.NoError(t, os.Chtimes(path, mtime, mtime))
+		return path
+	}
+	get := func(rt http.RoundTripper) error {
+		resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// the Gateway's certificate is verified with the CA bundle, which is
+	// reloaded when it changes
+	now := time.Now()
+	ca := writeCA(other, now.Add(-time.Minute))
+	tt, err := newTLSTransport(TLSOpts{CACerts: ca}, false)
+	assert.NoError(t, err)
+	assert.Error(t, get(tt))
+
+	writeCA(srv.Certificate(), now)
+	assert.NoError(t, get(tt))
+
+	// a pin allows a certificate that is not otherwise verified
+	h := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := certPinPrefix + base64.StdEncoding.EncodeToString(h[:])
+	tt, err = newTLSTransport(TLSOpts{CertPins: []string{pin}}, true)
+	assert.NoError(t, err)
+	assert.NoError(t, get(tt))
+
+	h = sha256.Sum256(other.RawSubjectPublicKeyInfo)
+	pin = base64.StdEncoding.EncodeToString(h[:])
+	tt, err = newTLSTransport(TLSOpts{CertPins: []string{pin}}, true)
+	assert.NoError(t, err)
+	assert.Error(t, get(tt))
+
+	// without a verified chain, only the leaf is pinned, so a pinned
+	// certificate presented after another leaf is not accepted
+	h = sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pins := [][]byte{h[:]}
+	assert.NoError(t, verifyCertPins(
+		[][]byte{srv.Certificate().Raw}, nil, pins))
+	assert.Error(t, verifyCertPins(
+		[][]byte{other.Raw, srv.Certificate().Raw}, nil, pins))
+	assert.Error(t, verifyCertPins(nil, nil, pins))
+
+	// with a verified chain, any certificate of the chain may be pinned
+	assert.NoError(t, verifyCertPins(
+		[][]byte{other.Raw, srv.Certificate().Raw},
+		[][]*x509.Certificate{{other, srv.Certificate()}}, pins))
+	assert.Error(t, verifyCertPins(
+		[][]byte{other.Raw, srv.Certificate().Raw},
+		[][]*x509.Certificate{{other}}, pins))
+
+	_, err = newTLSTransport(TLSOpts{CertPins: []string{"notapin"}}, true)
+	assert.Error(t, err)
+	_, err = newTLSTransport(TLSOpts{ClientCert: ca}, false)
+	assert.Error(t, err)
+}
+
+func TestCredentialsReload(t *testing.T) {
+	var (
+		logins   int32
+		password atomic.Value
+		token    atomic.Value
+	)
+	password.Store("old")
+	token.Store("")
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, pw, _ := r.BasicAuth()
+			if r.URL.Path == "/api/login" {
+				if user != "admin" || pw != password.Load().(string) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				n := atomic.AddInt32(&logins, 1)
+				tok := fmt.Sprintf("token%d", n)
+				token.Store(tok)
+				fmt.Fprintf(w, `"%s"`, tok)
+				return
+			}
+			if pw == "" || pw != token.Load().(string) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "csi-scaleio-creds")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeFile := func(name, content string, mtime time.Time) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		assert.NoError(t, os.Chtimes(path, mtime, mtime))
+		return path
+	}
+	userFile := writeFile("user", "admin\n", now.Add(-time.Minute))
+	pwFile := writeFile("password", "old\n", now.Add(-time.Minute))
+
+	creds, err := newCredentialsSource("", "", userFile, pwFile)
+	assert.NoError(t, err)
+	assert.Equal(t, credentials{user: "admin", password: "old"}, creds.get())
+
+	endpoint, err := url.Parse(srv.URL + "/api")
+	assert.NoError(t, err)
+	client := &http.Client{
+		Transport: newAuthTransport(http.DefaultTransport, *endpoint, creds),
+	}
+	get := func() {
+		resp, err := client.Get(srv.URL + "/api/types/System/instances")
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/login", nil)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	get()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&logins))
+
+	// the new password is tried as soon as it is read, but the previous
+	// one is used while the Gateway rejects it
+	writeFile("password", "new\n", now)
+	get()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&logins))
+	assert.Equal(t, "old", creds.get().password)
+	get()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&logins))
+
+	// once the Gateway accepts the new password, it replaces the previous
+	password.Store("new")
+	token.Store("expired")
+	get()
+	assert.EqualValues(t, 3, atomic.LoadInt32(&logins))
+	assert.Equal(t, "new", creds.get().password)
+	cands, _ := creds.candidates()
+	assert.Len(t, cands, 1)
+}
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+
+	info := &grpc.UnaryServerInfo{
+		FullMethod: "/csi.v0.Controller/CreateVolume",
+	}
+	ok := func(context.Context, interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	fail := func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	m.intercept(context.Background(), nil, info, ok)
+	m.intercept(context.Background(), nil, info, ok)
+	m.intercept(context.Background(), nil, info, fail)
+	assert.EqualValues(t, 2, m.rpcRequests.get("Controller", "CreateVolume", "OK"))
+	assert.EqualValues(t, 1,
+		m.rpcRequests.get("Controller", "CreateVolume", "NotFound"))
+
+	m.observeGatewayRequest("gw1:443", 20*time.Millisecond,
+		&http.Response{StatusCode: http.StatusOK}, nil)
+	m.observeGatewayRequest("gw1:443", time.Second, nil, errors.New("down"))
+	m.observeCacheLookup("sdc", true)
+	m.observeCacheLookup("sdc", false)
+	m.setNodeVolumes(func() (int, int, error) { return 3, 2, nil })
+
+	var buf bytes.Buffer
+	assert.NoError(t, m.write(&buf))
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE csi_scaleio_rpc_requests_total counter",
+		`csi_scaleio_rpc_requests_total{service="Controller",method="CreateVolume",code="OK"} 2`,
+		`csi_scaleio_rpc_duration_seconds_count{service="Controller",method="CreateVolume"} 3`,
+		`csi_scaleio_gateway_requests_total{endpoint="gw1:443",code="200"} 1`,
+		`csi_scaleio_gateway_requests_total{endpoint="gw1:443",code="error"} 1`,
+		`csi_scaleio_gateway_request_duration_seconds_bucket{endpoint="gw1:443",le="0.025"} 1`,
+		`csi_scaleio_gateway_request_duration_seconds_bucket{endpoint="gw1:443",le="+Inf"} 2`,
+		`csi_scaleio_cache_requests_total{cache="sdc",result="hit"} 1`,
+		`csi_scaleio_cache_requests_total{cache="sdc",result="miss"} 1`,
+		"csi_scaleio_node_volumes_mapped 3",
+		"csi_scaleio_node_volumes_mounted 2",
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+
+	assert.Equal(t, `a="x\"y\\z\n"`,
+		formatLabels([]string{"a"}, []string{"x\"y\\z\n"}))
+}
+
+// expositionSample is a sample parsed from the Prometheus text format
+type expositionSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+var (
+	expositionNameRE  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	expositionLabelRE = regexp.MustCompile(
+		`^([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\\n]|\\[\\"n])*)"(,|$)`)
+	expositionUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+)
+
+// parseExposition checks that the given output follows the Prometheus text
+// exposition format, version 0.0.4, and returns its samples by family:
+// every family has one HELP and TYPE line before its samples, its samples
+// are grouped, names and labels are well formed, series are not repeated,
+// and the buckets of histograms are cumulative and end with the +Inf bucket,
+// which equals the count.
+func parseExposition(t *testing.T, out string) map[string][]expositionSample {
+	families := map[string][]expositionSample{}
+	types := map[string]string{}
+	seen := map[string]bool{}
+	family := ""
+
+	if !assert.True(t, strings.HasSuffix(out, "\n"), "missing final newline") {
+		return nil
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			f := strings.SplitN(line[2:], " ", 3)
+			if !assert.Len(t, f, 3, line) {
+				continue
+			}
+			assert.Regexp(t, expositionNameRE, f[1], line)
+			switch f[0] {
+			case "HELP":
+				assert.NotContains(t, seen, "HELP "+f[1], line)
+				seen["HELP "+f[1]] = true
+				assert.Regexp(t, `^(?:[^\\\n]|\\[\\n])*$`, f[2], line)
+			case "TYPE":
+				assert.NotContains(t, types, f[1], line)
+				assert.Contains(t, []string{"counter", "gauge",
+					"histogram", "summary", "untyped"}, f[2], line)
+				types[f[1]] = f[2]
+				assert.NotContains(t, families, f[1], "family repeated")
+				families[f[1]] = nil
+				family = f[1]
+			default:
+				t.Errorf("unexpected comment: %s", line)
+			}
+			continue
+		}
+
+		i := strings.IndexAny(line, "{ ")
+		if !assert.True(t, i > 0, line) {
+			continue
+		}
+		sample := expositionSample{name: line[:i], labels: map[string]string{}}
+		assert.Regexp(t, expositionNameRE, sample.name, line)
+		rest := line[i:]
+		if rest[0] == '{' {
+			end := strings.Index(rest, "} ")
+			if !assert.True(t, end > 0, line) {
+				continue
+			}
+			labels := rest[1:end]
+			for labels != "" {
+				m := expositionLabelRE.FindStringSubmatch(labels)
+				if !assert.NotNil(t, m, line) {
+					break
+				}
+				assert.NotContains(t, sample.labels, m[1], line)
+				sample.labels[m[1]] = expositionUnescaper.Replace(m[2])
+				labels = labels[len(m[0]):]
+			}
+			rest = rest[end+1:]
+		}
+		v, err := strconv.ParseFloat(strings.TrimPrefix(rest, " "), 64)
+		assert.NoError(t, err, line)
+		sample.value = v
+
+		// the sample belongs to the family of the last TYPE line
+		suffixes := []string{""}
+		if types[family] == "histogram" {
+			suffixes = []string{"_bucket", "_sum", "_count"}
+		}
+		found := false
+		for _, suffix := range suffixes {
+			found = found || sample.name == family+suffix
+		}
+		assert.True(t, found, "sample outside of its family: %s", line)
+
+		series := fmt.Sprintf("%s%v", sample.name, sample.labels)
+		assert.False(t, seen[series], "series repeated: %s", line)
+		seen[series] = true
+		families[family] = append(families[family], sample)
+	}
+
+	for name, typ := range types {
+		assert.True(t, seen["HELP "+name], "missing HELP for %s", name)
+		if typ != "histogram" {
+			continue
+		}
+		// the buckets of each series are cumulative, with increasing
+		// bounds, and end with +Inf
+		type hist struct {
+			les    []float64
+			counts []float64
+			count  float64
+			sum    bool
+		}
+		hists := map[string]*hist{}
+		get := func(labels map[string]string) *hist {
+			key := fmt.Sprintf("%v", labels)
+			if hists[key] == nil {
+				hists[key] = &hist{count: -1}
+			}
+			return hists[key]
+		}
+		for _, sample := range families[name] {
+			labels := map[string]string{}
+			for k, v := range sample.labels {
+				if k != "le" {
+					labels[k] = v
+				}
+			}
+			h := get(labels)
+			switch sample.name {
+			case name + "_bucket":
+				le, err := strconv.ParseFloat(sample.labels["le"], 64)
+				assert.NoError(t, err, sample.labels["le"])
+				h.les = append(h.les, le)
+				h.counts = append(h.counts, sample.value)
+			case name + "_sum":
+				h.sum = true
+			case name + "_count":
+				h.count = sample.value
+			}
+		}
+		for key, h := range hists {
+			n := len(h.les)
+			if !assert.True(t, n > 0, "%s%s has no buckets", name, key) {
+				continue
+			}
+			for i := 1; i < n; i++ {
+				assert.True(t, h.les[i] > h.les[i-1], "%s%s", name, key)
+				assert.True(t, h.counts[i] >= h.counts[i-1], "%s%s", name, key)
+			}
+			assert.True(t, math.IsInf(h.les[n-1], 1), "%s%s", name, key)
+			assert.Equal(t, h.count, h.counts[n-1], "%s%s", name, key)
+			assert.True(t, h.sum, "%s%s has no sum", name, key)
+		}
+	}
+	return families
+}
+
+func TestMetricsExpositionFormat(t *testing.T) {
+	m := newMetrics()
+	m.rpcRequests.help = "Help with a \\ and a\nnewline."
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Node/NodeGetId"}
+	m.intercept(context.Background(), nil, info,
+		func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	for _, d := range []time.Duration{
+		time.Millisecond, 40 * time.Millisecond, 2 * time.Minute} {
+		m.observeGatewayRequest(`gw"1"\a`+"\n", d, nil, errors.New("down"))
+	}
+	m.observeGatewayRequest("gw2:443", time.Second,
+		&http.Response{StatusCode: http.StatusServiceUnavailable}, nil)
+	m.observeCacheLookup("storagepool", false)
+	m.setNodeVolumes(func() (int, int, error) { return 1, 0, nil })
+
+	var buf bytes.Buffer
+	assert.NoError(t, m.write(&buf))
+	families := parseExposition(t, buf.String())
+	assert.Len(t, families, 7)
+
+	// label values are escaped so that they are read back as recorded
+	var endpoints []string
+	for _, sample := range families["csi_scaleio_gateway_requests_total"] {
+		endpoints = append(endpoints, sample.labels["endpoint"])
+	}
+	assert.ElementsMatch(t, []string{`gw"1"\a` + "\n", "gw2:443"}, endpoints)
+
+	// the histograms have a bucket for each bound, and the +Inf bucket
+	for _, sample := range families["csi_scaleio_gateway_request_duration_seconds"] {
+		if sample.labels["le"] == "+Inf" && sample.labels["endpoint"] == "gw2:443" {
+			assert.EqualValues(t, 1, sample.value)
+		}
+	}
+	assert.Len(t, families["csi_scaleio_gateway_request_duration_seconds"],
+		2*(len(metricsBuckets)+3))
+
+	// and the checks catch malformed output
+	checker := &testing.T{}
+	parseExposition(checker, "# TYPE a counter\nb 1\n")
+	assert.True(t, checker.Failed())
+}
+
+type testSpanExporter struct {
+	reqs [][]byte
+}
+
+func (e *testSpanExporter) export(req []byte) error {
+	e.reqs = append(e.reqs, req)
+	return nil
+}
+
+func TestTracerShutdown(t *testing.T) {
+	exporter := &testSpanExporter{}
+	defaultTracer = newTracer(exporter)
+	defer func() { defaultTracer = nil }()
+
+	_, sp := startSpan(context.Background(), "test", spanKindServer)
+	sp.finish()
+
+	// the span is exported on shutdown, well before the next export
+	ShutdownTracing()
+	if assert.Len(t, exporter.reqs, 1) {
+		assert.Contains(t, string(exporter.reqs[0]), `"name":"test"`)
+	}
+	select {
+	case <-defaultTracer.stopped:
+	default:
+		t.Error("export loop still running")
+	}
+
+	// shutting down again exports nothing more
+	ShutdownTracing()
+	assert.Len(t, exporter.reqs, 1)
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &testSpanExporter{}
+	defaultTracer = &tracer{
+		exporter: exporter,
+		queue:    make(chan *span, traceQueueSize),
+	}
+	defer func() { defaultTracer = nil }()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	ft, err := newFailoverTransport([]*url.URL{u}, "",
+		func(*url.URL) http.RoundTripper { return http.DefaultTransport })
+	assert.NoError(t, err)
+
+	// the RPC sends a Gateway request through a transport bound to its
+	// context
+	handler := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		client := &http.Client{
+			Transport: &contextTransport{ctx: ctx, rt: ft},
+		}
+		resp, err := client.Get(srv.URL + "/api/types/Volume/instances")
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		traceParentKey,
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		csictx.RequestIDKey, "42"))
+	_, err = TracingInterceptor(ctx, nil, &grpc.UnaryServerInfo{
+		FullMethod: "/csi.v0.Controller/CreateVolume",
+	}, handler)
+	assert.Error(t, err)
+
+	defaultTracer.flush()
+	if !assert.Len(t, exporter.reqs, 1) {
+		return
+	}
+	var traces otlpTraces
+	assert.NoError(t, json.Unmarshal(exporter.reqs[0], &traces))
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+
+	attrs := func(s otlpSpan) map[string]string {
+		m := map[string]string{}
+		for _, kv := range s.Attributes {
+			switch {
+			case kv.Value.StringValue != nil:
+				m[kv.Key] = *kv.Value.StringValue
+			case kv.Value.IntValue != nil:
+				m[kv.Key] = *kv.Value.IntValue
+			}
+		}
+		return m
+	}
+
+	// the Gateway span ends first, and is a child of the RPC span, which
+	// is a child of the remote span
+	gw, rpc := spans[0], spans[1]
+	assert.Equal(t, "csi.v0.Controller/CreateVolume", rpc.Name)
+	assert.Equal(t, spanKindServer, rpc.Kind)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", rpc.TraceID)
+	assert.Equal(t, "b7ad6b7169203331", rpc.ParentSpanID)
+	assert.Equal(t, spanStatusError, rpc.Status.Code)
+	assert.Equal(t, "42", attrs(rpc)["csi.request_id"])
+	assert.Equal(t, "5", attrs(rpc)["rpc.grpc.status_code"])
+
+	assert.Equal(t, "HTTP GET", gw.Name)
+	assert.Equal(t, spanKindClient, gw.Kind)
+	assert.Equal(t, rpc.TraceID, gw.TraceID)
+	assert.Equal(t, rpc.SpanID, gw.ParentSpanID)
+	assert.Equal(t, "/api/types/Volume/instances", attrs(gw)["url.path"])
+	assert.Equal(t, "200", attrs(gw)["http.response.status_code"])
+
+	for _, tp := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	} {
+		_, ok := parseTraceParent(tp)
+		assert.False(t, ok, tp)
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithTimeout(
+		context.WithValue(context.Background(), key{}, "v"), time.Hour)
+	cancel()
+
+	ctx := detachedContext{parent: parent}
+	assert.Equal(t, "v", ctx.Value(key{}))
+	assert.NoError(t, ctx.Err())
+	assert.Nil(t, ctx.Done())
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+}
+
+// testExtStream is a server stream of a single extension request
+type testExtStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	req proto.Message
+	rep interface{}
+}
+
+func newTestExtStream(method string, req proto.Message) *testExtStream {
+	return &testExtStream{
+		ctx: grpc.NewContextWithServerTransportStream(
+			context.Background(), &testTransportStream{method: method}),
+		req: req,
+	}
+}
+
+func (st *testExtStream) Context() context.Context { return st.ctx }
+
+func (st *testExtStream) RecvMsg(m interface{}) error {
+	proto.Merge(m.(proto.Message), st.req)
+	return nil
+}
+
+func (st *testExtStream) SendMsg(m interface{}) error {
+	st.rep = m
+	return nil
+}
+
+// testTransportStream is the transport stream of a testExtStream, which
+// records the method of the request
+type testTransportStream struct {
+	grpc.ServerTransportStream
+	method string
+}
+
+func (ts *testTransportStream) Method() string { return ts.method }
+
+func TestHandleExtension(t *testing.T) {
+	s := New().(*service)
+
+	var methods []string
+	s.extInterceptor = utils.ChainUnaryServer(MetricsInterceptor,
+		func(
+			ctx context.Context,
+			req interface{},
+			info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler) (interface{}, error) {
+
+			methods = append(methods, info.FullMethod)
+			assert.IsType(t, &NodeExpandVolumeRequest{}, req)
+			return handler(ctx, req)
+		})
+
+	// the extension methods run the interceptors of the server
+	method := "/" + ExtensionsService + "/NodeExpandVolume"
+	_, want := s.NodeExpandVolume(
+		context.Background(), &NodeExpandVolumeRequest{})
+	err := s.handleExtension(nil,
+		newTestExtStream(method, &NodeExpandVolumeRequest{}))
+	assert.Equal(t, status.Code(want), status.Code(err))
+	assert.Equal(t, []string{method}, methods)
+
+	// unknown methods are not run
+	err = s.handleExtension(nil, newTestExtStream(
+		"/"+ExtensionsService+"/Unknown", &NodeExpandVolumeRequest{}))
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	assert.Len(t, methods, 1)
+}
+
+func TestExtensionTracing(t *testing.T) {
+	exporter := &testSpanExporter{}
+	defaultTracer = &tracer{
+		exporter: exporter,
+		queue:    make(chan *span, traceQueueSize),
+	}
+	defer func() { defaultTracer = nil }()
+
+	s := New().(*service)
+	s.extInterceptor = utils.ChainUnaryServer(TracingInterceptor)
+
+	err := s.handleExtension(nil, newTestExtStream(
+		"/"+ExtensionsService+"/NodeExpandVolume", &NodeExpandVolumeRequest{}))
+	assert.Error(t, err)
+
+	defaultTracer.flush()
+	if !assert.Len(t, exporter.reqs, 1) {
+		return
+	}
+	var traces otlpTraces
+	assert.NoError(t, json.Unmarshal(exporter.reqs[0], &traces))
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	assert.Equal(t, ExtensionsService+"/NodeExpandVolume", spans[0].Name)
+	assert.Equal(t, spanKindServer, spans[0].Kind)
+	assert.Equal(t, spanStatusError, spans[0].Status.Code)
+}
+
+func TestAuditInterceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-scaleio-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	defaultAuditor, err = newAuditor(path)
+	assert.NoError(t, err)
+	defer func() { defaultAuditor = nil }()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		csictx.RequestIDKey, "7", "user-agent", "csi-provisioner"))
+	info := func(method string) *grpc.UnaryServerInfo {
+		return &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/" + method}
+	}
+
+	_, err = AuditInterceptor(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		Parameters: map[string]string{
+			KeyStoragePool:  "pool1",
+			"adminPassword": "hunter2",
+		},
+	}, info("CreateVolume"),
+		func(context.Context, interface{}) (interface{}, error) {
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{Id: "sys1-vol1"},
+			}, nil
+		})
+	assert.NoError(t, err)
+
+	_, err = AuditInterceptor(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: "sys1-vol1",
+		NodeId:   "guid1",
+	}, info("ControllerPublishVolume"),
+		func(ctx context.Context, _ interface{}) (interface{}, error) {
+			setAuditSdcID(ctx, "sdc1")
+			return nil, status.Error(codes.NotFound, "volume not found")
+		})
+	assert.Error(t, err)
+
+	// read-only operations are not audited
+	_, err = AuditInterceptor(ctx, &csi.ListVolumesRequest{},
+		info("ListVolumes"),
+		func(context.Context, interface{}) (interface{}, error) {
+			return &csi.ListVolumesResponse{}, nil
+		})
+	assert.NoError(t, err)
+	_, err = AuditInterceptor(ctx, &ListSnapshotGroupRequest{},
+		&grpc.UnaryServerInfo{
+			FullMethod: "/" + ExtensionsService + "/ListSnapshotGroup",
+		},
+		func(context.Context, interface{}) (interface{}, error) {
+			return &ListSnapshotGroupResponse{}, nil
+		})
+	assert.NoError(t, err)
+
+	// imports are audited like volume creations
+	_, err = AuditInterceptor(ctx, &ImportVolumeRequest{
+		Volume:     "legacy1",
+		Parameters: map[string]string{"secretName": "sio"},
+	}, &grpc.UnaryServerInfo{
+		FullMethod: "/" + ExtensionsService + "/ImportVolume",
+	}, func(context.Context, interface{}) (interface{}, error) {
+		return &ImportVolumeResponse{
+			Volume: &csi.Volume{Id: "sys1-vol2"},
+		}, nil
+	})
+	assert.NoError(t, err)
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+
+	var create, publish, imp auditRecord
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &create))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &publish))
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &imp))
+
+	assert.Equal(t, "CreateVolume", create.Method)
+	assert.EqualValues(t, 7, create.RequestID)
+	assert.Equal(t, "csi-provisioner", create.UserAgent)
+	assert.Equal(t, "pvc-1", create.Name)
+	assert.Equal(t, "sys1-vol1", create.VolumeID)
+	assert.Equal(t, map[string]string{
+		KeyStoragePool:  "pool1",
+		"adminPassword": redactedValue,
+	}, create.Parameters)
+	assert.Equal(t, "OK", create.Result)
+	assert.Empty(t, create.Error)
+
+	assert.Equal(t, "ControllerPublishVolume", publish.Method)
+	assert.Equal(t, "sys1-vol1", publish.VolumeID)
+	assert.Equal(t, "guid1", publish.NodeID)
+	assert.Equal(t, "sdc1", publish.SdcID)
+	assert.Equal(t, "NotFound", publish.Result)
+	assert.Equal(t, "volume not found", publish.Error)
+
+	assert.Equal(t, "ImportVolume", imp.Method)
+	assert.Equal(t, "legacy1", imp.Name)
+	assert.Equal(t, "sys1-vol2", imp.VolumeID)
+	assert.Equal(t, map[string]string{"secretName": redactedValue},
+		imp.Parameters)
+	assert.Equal(t, "OK", imp.Result)
+}
+
+// newTestSystem returns a probed system whose Gateway is served by the
+// given handler
+func newTestSystem(
+	t *testing.T, id string, h http.Handler) (*scaleioSystem, func()) {
+
+	srv := httptest.NewServer(h)
+	c, err := goscaleio.NewClientWithArgs(srv.URL, "", true, false)
+	assert.NoError(t, err)
+
+	sys := newScaleIOSystem(SystemConfig{SystemName: id, Default: true})
+	sys.client = c
+	sys.system = goscaleio.NewSystem(c)
+	sys.system.System.ID = id
+	return sys, srv.Close
+}
+
+func TestProbeSystemsIndependently(t *testing.T) {
+	sys1, done := newTestSystem(t, "sys1", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode([]*siotypes.Volume{
+				&siotypes.Volume{ID: "vol1", Name: "vol1"},
+			})
+		}))
+	defer done()
+	sys1.Endpoint = sys1.client.SIOEndpoint.String()
+	sys1.User, sys1.Password = "admin", "password"
+	sys1.client.Token = "token"
+
+	// The second system has no endpoint, so it never probes
+	sys2 := newScaleIOSystem(SystemConfig{SystemName: "sys2"})
+
+	s := New().(*service)
+	s.mode = "controller"
+	s.opts.AutoProbe = true
+	s.systems = []*scaleioSystem{sys1, sys2}
+	ctx := context.Background()
+
+	_, err := s.Probe(ctx, &csi.ProbeRequest{})
+	assert.NoError(t, err)
+
+	sys, id, err := s.getSystemForID(ctx, "sys1-vol1")
+	assert.NoError(t, err)
+	assert.Equal(t, "sys1", sys.SystemName)
+	assert.Equal(t, "vol1", id)
+
+	_, _, err = s.getSystemForID(ctx, "sys3-vol1")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "systems not probed: sys2")
+
+	_, err = s.getSystemByName(ctx, "sys2")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "missing ScaleIO Gateway endpoint")
+
+	resp, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if assert.NoError(t, err) && assert.Len(t, resp.Entries, 1) {
+		assert.Equal(t, "sys1-vol1", resp.Entries[0].Volume.Id)
+	}
+
+	s.opts.AutoProbe = false
+	_, err = s.getSystemByName(ctx, "sys2")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "sys2 has not been probed")
+
+	// The probe only fails when no system can be probed
+	s.systems = []*scaleioSystem{
+		sys2, newScaleIOSystem(SystemConfig{SystemName: "sys3"})}
+	_, err = s.Probe(ctx, &csi.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "system: sys2: missing")
+	assert.Contains(t, err.Error(), "system: sys3: missing")
+}
+
+func TestListVolumesPagination(t *testing.T) {
+	var vols atomic.Value
+	setVols := func(ids ...string) {
+		var sioVols []*siotypes.Volume
+		for _, id := range ids {
+			sioVols = append(sioVols, &siotypes.Volume{ID: id, Name: id})
+		}
+		vols.Store(sioVols)
+	}
+	setVols("v1", "v2", "v3", "v4", "v5")
+
+	sys, done := newTestSystem(t, "sys1", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(vols.Load())
+		}))
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+
+	list := func(max int32, token string) ([]string, string, error) {
+		resp, err := s.ListVolumes(context.Background(),
+			&csi.ListVolumesRequest{MaxEntries: max, StartingToken: token})
+		if err != nil {
+			return nil, "", err
+		}
+		var ids []string
+		for _, e := range resp.Entries {
+			ids = append(ids, e.Volume.Id)
+		}
+		return ids, resp.NextToken, nil
+	}
+
+	// the pages of a listing are taken from the volumes listed for the
+	// first page, even when volumes are created and deleted meanwhile
+	ids, token, err := list(2, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sys1-v1", "sys1-v2"}, ids)
+	assert.NotEmpty(t, token)
+
+	setVols("v2", "v3", "v4", "v5", "v6")
+
+	// a concurrent listing is independent of the first one
+	other, otherToken, err := list(3, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sys1-v2", "sys1-v3", "sys1-v4"}, other)
+
+	ids, token, err = list(2, token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sys1-v3", "sys1-v4"}, ids)
+
+	ids, token, err = list(2, token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sys1-v5"}, ids)
+	assert.Empty(t, token)
+
+	other, otherToken, err = list(3, otherToken)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sys1-v5", "sys1-v6"}, other)
+	assert.Empty(t, otherToken)
+
+	// all volumes are returned at once without a maximum
+	ids, token, err = list(0, "")
+	assert.NoError(t, err)
+	assert.Len(t, ids, 5)
+	assert.Empty(t, token)
+
+	// invalid and expired tokens are rejected
+	_, _, err = list(2, "1")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, _, err = list(2, formatListToken("unknown", 2))
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	_, token, err = list(2, "")
+	assert.NoError(t, err)
+	id, offset, err := parseListToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, offset)
+	s.volListings.listings[id].expires = time.Now()
+	_, _, err = list(2, token)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestListSnapshotsPagination(t *testing.T) {
+	var sioVols []*siotypes.Volume
+	for _, id := range []string{"s1", "s2", "s3"} {
+		sioVols = append(sioVols, &siotypes.Volume{
+			ID:               id,
+			Name:             getSnapshotName("", id),
+			AncestorVolumeID: "v1",
+		})
+	}
+	sioVols = append(sioVols,
+		&siotypes.Volume{ID: "v1", Name: "v1"},
+		&siotypes.Volume{ID: "v2", Name: "v2"})
+
+	sys, done := newTestSystem(t, "sys1", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(sioVols)
+		}))
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+
+	list := func(max int32, token string) ([]string, string, error) {
+		resp, err := s.ListSnapshots(context.Background(),
+			&csi.ListSnapshotsRequest{MaxEntries: max, StartingToken: token})
+		if err != nil {
+			return nil, "", err
+		}
+		var ids []string
+		for _, e := range resp.Entries {
+			ids = append(ids, e.Snapshot.Id)
+		}
+		return ids, resp.NextToken, nil
+	}
+
+	ids, token, err := list(2, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sys1-s1", "sys1-s2"}, ids)
+	ids, next, err := list(2, token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sys1-s3"}, ids)
+	assert.Empty(t, next)
+
+	// integer, negative and out of range offsets are rejected, as are the
+	// tokens of volume listings
+	id, _, err := parseListToken(token)
+	assert.NoError(t, err)
+	for _, tok := range []string{
+		"1",
+		"-1",
+		formatListToken(id, 4),
+		base64.RawURLEncoding.EncodeToString([]byte(id + ":-1")),
+	} {
+		_, _, err = list(2, tok)
+		assert.Equal(t, codes.Aborted, status.Code(err), tok)
+	}
+
+	volResp, err := s.ListVolumes(context.Background(),
+		&csi.ListVolumesRequest{MaxEntries: 1})
+	assert.NoError(t, err)
+	_, _, err = list(1, volResp.NextToken)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = s.ListVolumes(context.Background(),
+		&csi.ListVolumesRequest{StartingToken: token})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	_, _, err = list(-1, "")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestVolListingsEviction(t *testing.T) {
+	vl := newVolListings()
+	now := time.Now()
+	var ids []string
+	for i := 0; i < maxVolListings; i++ {
+		id := vl.add(nil)
+		vl.listings[id].expires = now.Add(time.Duration(i+1) * time.Second)
+		ids = append(ids, id)
+	}
+
+	// paging through the first listing extends its expiry, so that the
+	// second one is evicted to make room for a new one
+	_, ok := vl.get(ids[0])
+	assert.True(t, ok)
+	vl.add(nil)
+	assert.Len(t, vl.listings, maxVolListings)
+	_, ok = vl.get(ids[0])
+	assert.True(t, ok)
+	_, ok = vl.get(ids[1])
+	assert.False(t, ok)
+}
+
+// newTestGateway returns a handler that serves the given volumes, and two
+// storage pools, "pool1" and "pool2", in the protection domain "pd1" of the
+// system with the given ID. Volumes are looked up by name or ID.
+func newTestGateway(
+	sysID string, vols func() []*siotypes.Volume) http.Handler {
+
+	pdPath := "/api/instances/System::" + sysID +
+		"/relationships/ProtectionDomain"
+	// pool2 is the name of a pool in each protection domain
+	pools := []*siotypes.StoragePool{
+		{ID: "sp1", Name: "pool1", ProtectionDomainID: "pd1id"},
+		{ID: "sp2", Name: "pool2", ProtectionDomainID: "pd1id"},
+		{ID: "sp3", Name: "pool2", ProtectionDomainID: "pd2id"},
+	}
+	availGiB := map[string]int{"sp1": 100, "sp2": 300, "sp3": 200}
+	for _, p := range pools {
+		p.Links = []*siotypes.Link{{
+			Rel: "/api/StoragePool/relationship/Statistics",
+			HREF: "/api/instances/StoragePool::" + p.ID +
+				"/relationships/Statistics",
+		}}
+	}
+	pds := []*siotypes.ProtectionDomain{}
+	for _, pd := range []string{"pd1", "pd2"} {
+		pds = append(pds, &siotypes.ProtectionDomain{
+			ID:   pd + "id",
+			Name: pd,
+			Links: []*siotypes.Link{{
+				Rel: "/api/ProtectionDomain/relationship/StoragePool",
+				HREF: "/api/instances/ProtectionDomain::" + pd + "id" +
+					"/relationships/StoragePool",
+			}},
+		})
+	}
+	writeErr := func(w http.ResponseWriter, msg string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(&siotypes.Error{
+			Message: msg, MajorErrorCode: http.StatusInternalServerError})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/types/Volume/instances":
+			json.NewEncoder(w).Encode(vols())
+		case r.URL.Path == "/api/types/Volume/instances/action/queryIdByKey":
+			var p siotypes.VolumeQeryIdByKeyParam
+			json.NewDecoder(r.Body).Decode(&p)
+			for _, v := range vols() {
+				if v.Name == p.Name {
+					fmt.Fprintf(w, "%q", v.ID)
+					return
+				}
+			}
+			writeErr(w, sioGatewayNotFound)
+		case strings.HasPrefix(r.URL.Path, "/api/instances/Volume::"):
+			id := strings.TrimPrefix(r.URL.Path, "/api/instances/Volume::")
+			for _, v := range vols() {
+				if v.ID == id {
+					json.NewEncoder(w).Encode(v)
+					return
+				}
+			}
+			writeErr(w, sioGatewayVolumeNotFound)
+		case r.URL.Path == "/api/types/StoragePool/instances":
+			json.NewEncoder(w).Encode(pools)
+		case strings.HasPrefix(r.URL.Path, "/api/instances/StoragePool::"):
+			spID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path,
+				"/api/instances/StoragePool::"), "/relationships/Statistics")
+			json.NewEncoder(w).Encode(&siotypes.Statistics{
+				CapacityAvailableForVolumeAllocationInKb: availGiB[spID] *
+					kiBytesInGiB,
+			})
+		case r.URL.Path == pdPath:
+			json.NewEncoder(w).Encode(pds)
+		case strings.HasPrefix(r.URL.Path, "/api/instances/ProtectionDomain::"):
+			pdID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path,
+				"/api/instances/ProtectionDomain::"), "/relationships/StoragePool")
+			pdPools := []*siotypes.StoragePool{}
+			for _, p := range pools {
+				if p.ProtectionDomainID == pdID {
+					pdPools = append(pdPools, p)
+				}
+			}
+			json.NewEncoder(w).Encode(pdPools)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func TestImportVolume(t *testing.T) {
+	legacy := &siotypes.Volume{
+		ID:            "vol1",
+		Name:          "legacy1",
+		StoragePoolID: "sp1",
+		VolumeType:    thickProvisioned,
+		SizeInKb:      16 * kiBytesInGiB,
+	}
+	vols := []*siotypes.Volume{legacy}
+
+	sys, done := newTestSystem(t, "sys1", newTestGateway("sys1",
+		func() []*siotypes.Volume { return vols }))
+	defer done()
+	sys.system.System.Links = []*siotypes.Link{{
+		Rel:  "/api/System/relationship/ProtectionDomain",
+		HREF: "/api/instances/System::sys1/relationships/ProtectionDomain",
+	}}
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+
+	create := func(params map[string]string, requiredBytes int64) (
+		*csi.Volume, error) {
+
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name:       "pvc-1",
+				Parameters: params,
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: requiredBytes,
+				},
+			})
+		return resp.GetVolume(), err
+	}
+
+	// the volume is imported by name or by ID, without a storage pool
+	for _, ref := range []string{"legacy1", "vol1"} {
+		vi, err := create(map[string]string{
+			KeyImportVolume: ref,
+			KeyMaxIOPS:      "100",
+		}, 8*bytesInGiB)
+		assert.NoError(t, err)
+		assert.Equal(t, "sys1-vol1", vi.GetId())
+		assert.EqualValues(t, 16*bytesInGiB, vi.GetCapacityBytes())
+		assert.Equal(t, "true", vi.GetAttributes()[AttributeKeyImported])
+		assert.Equal(t, "pool1", vi.GetAttributes()[AttributeKeyStoragePool])
+		assert.Equal(t, "pd1", vi.GetAttributes()[AttributeKeyProtectionDomain])
+		assert.Equal(t, "100", vi.GetAttributes()[KeyMaxIOPS])
+		assert.Equal(t, map[string]string{
+			TopologyKeySystemPrefix + "sys1": topologySegmentTrue,
+		}, vi.GetAccessibleTopology()[0].GetSegments())
+	}
+
+	// the companion extension method returns the same volume
+	resp, err := s.ImportVolume(context.Background(), &ImportVolumeRequest{
+		Volume:     "legacy1",
+		Parameters: map[string]string{KeyStoragePool: "pool1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "sys1-vol1", resp.Volume.GetId())
+
+	_, err = create(map[string]string{KeyImportVolume: "missing"}, 0)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = create(map[string]string{
+		KeyImportVolume:  "legacy1",
+		KeyStoragePoolID: "sp2",
+	}, 0)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = create(map[string]string{KeyImportVolume: "legacy1"},
+		24*bytesInGiB)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	_, err = create(map[string]string{
+		KeyImportVolume:   "legacy1",
+		KeySourceVolumeID: "sys1-vol2",
+	}, 0)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// volumes mapped to an SDC are in use outside of the CO
+	legacy.MappedSdcInfo = []*siotypes.MappedSdcInfo{{SdcID: "sdc1"}}
+	_, err = create(map[string]string{KeyImportVolume: "legacy1"}, 0)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// testVolumes are the volumes of a test Gateway that creates volumes, and
+// the parameters they were created with
+type testVolumes struct {
+	sync.Mutex
+	vols   []*siotypes.Volume
+	params []*siotypes.VolumeParam
+}
+
+func (tv *testVolumes) list() []*siotypes.Volume {
+	tv.Lock()
+	defer tv.Unlock()
+	return tv.vols
+}
+
+func (tv *testVolumes) lastParam() *siotypes.VolumeParam {
+	tv.Lock()
+	defer tv.Unlock()
+	if len(tv.params) == 0 {
+		return nil
+	}
+	return tv.params[len(tv.params)-1]
+}
+
+// newTestCreateGateway returns a test Gateway that also creates, resizes,
+// renames and removes volumes, and creates snapshots. Like the ScaleIO Gateway, it rejects names that are in use, or
+// that are not valid ScaleIO names.
+func newTestCreateGateway(sysID string, tv *testVolumes) http.Handler {
+	gw := newTestGateway(sysID, tv.list)
+
+	writeErr := func(w http.ResponseWriter, msg string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(&siotypes.Error{
+			Message: msg, MajorErrorCode: http.StatusInternalServerError})
+	}
+	// checkName must be called with the lock held
+	checkName := func(name string) string {
+		if len(name) > maxVolumeNameLen || !isValidVolumeName(name) {
+			return "Invalid name"
+		}
+		for _, v := range tv.vols {
+			if v.Name == name {
+				return sioGatewayVolumeNameInUse
+			}
+		}
+		return ""
+	}
+
+	snapshotPath := "/api/instances/System::" + sysID +
+		"/action/snapshotVolumes"
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var action string
+		if i := strings.Index(r.URL.Path, "/action/"); i >= 0 &&
+			strings.HasPrefix(r.URL.Path, "/api/instances/Volume::") {
+			action = r.URL.Path[i+len("/action/"):]
+		}
+		if r.Method != http.MethodPost ||
+			(r.URL.Path != "/api/types/Volume/instances" &&
+				r.URL.Path != snapshotPath && action == "") {
+			gw.ServeHTTP(w, r)
+			return
+		}
+
+		tv.Lock()
+		defer tv.Unlock()
+
+		if action != "" {
+			id := strings.TrimPrefix(r.URL.Path[:strings.Index(
+				r.URL.Path, "/action/")], "/api/instances/Volume::")
+			i := 0
+			for i < len(tv.vols) && tv.vols[i].ID != id {
+				i++
+			}
+			if i == len(tv.vols) {
+				writeErr(w, sioGatewayVolumeNotFound)
+				return
+			}
+			switch action {
+			case "setVolumeSize":
+				var p setVolumeSizeParam
+				json.NewDecoder(r.Body).Decode(&p)
+				var sizeInGiB int
+				fmt.Sscan(p.SizeInGB, &sizeInGiB)
+				tv.vols[i].SizeInKb = sizeInGiB * kiBytesInGiB
+			case "setVolumeName":
+				var p setVolumeNameParam
+				json.NewDecoder(r.Body).Decode(&p)
+				if msg := checkName(p.NewName); msg != "" {
+					writeErr(w, msg)
+					return
+				}
+				tv.vols[i].Name = p.NewName
+			case "removeVolume":
+				tv.vols = append(tv.vols[:i:i], tv.vols[i+1:]...)
+			default:
+				http.NotFound(w, r)
+			}
+			return
+		}
+
+		if r.URL.Path == "/api/types/Volume/instances" {
+			var p siotypes.VolumeParam
+			json.NewDecoder(r.Body).Decode(&p)
+			tv.params = append(tv.params, &p)
+			if msg := checkName(p.Name); msg != "" {
+				writeErr(w, msg)
+				return
+			}
+			vol := &siotypes.Volume{
+				ID:            fmt.Sprintf("v%d", len(tv.vols)+1),
+				Name:          p.Name,
+				StoragePoolID: p.StoragePoolID,
+				VolumeType:    p.VolumeType,
+				UseRmCache:    p.UseRmCache == "true",
+			}
+			fmt.Sscan(p.VolumeSizeInKb, &vol.SizeInKb)
+			tv.vols = append(tv.vols, vol)
+			json.NewEncoder(w).Encode(&siotypes.VolumeResp{ID: vol.ID})
+			return
+		}
+
+		var p siotypes.SnapshotVolumesParam
+		json.NewDecoder(r.Body).Decode(&p)
+		resp := &siotypes.SnapshotVolumesResp{
+			SnapshotGroupID: fmt.Sprintf("cg%d", len(tv.vols)+1),
+		}
+		var snaps []*siotypes.Volume
+		for _, def := range p.SnapshotDefs {
+			if msg := checkName(def.SnapshotName); msg != "" {
+				writeErr(w, msg)
+				return
+			}
+			var src *siotypes.Volume
+			for _, v := range tv.vols {
+				if v.ID == def.VolumeID {
+					src = v
+				}
+			}
+			if src == nil {
+				writeErr(w, sioGatewayVolumeNotFound)
+				return
+			}
+			snap := *src
+			snap.ID = fmt.Sprintf("v%d", len(tv.vols)+len(snaps)+1)
+			snap.Name = def.SnapshotName
+			snap.AncestorVolumeID = src.ID
+			snap.ConsistencyGroupID = resp.SnapshotGroupID
+			snap.VolumeType = "Snapshot"
+			snap.MappedSdcInfo = nil
+			snaps = append(snaps, &snap)
+			resp.VolumeIDList = append(resp.VolumeIDList, snap.ID)
+		}
+		tv.vols = append(tv.vols, snaps...)
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// newTestSnapshotSystem returns a test system of a Gateway that creates
+// volumes and snapshots
+func newTestSnapshotSystem(
+	t *testing.T, sysID string, tv *testVolumes) (*scaleioSystem, func()) {
+
+	sys, done := newTestSystem(t, sysID, newTestCreateGateway(sysID, tv))
+	sys.system.System.Links = []*siotypes.Link{
+		{
+			Rel:  "self",
+			HREF: "/api/instances/System::" + sysID,
+		},
+		{
+			Rel:  "/api/System/relationship/ProtectionDomain",
+			HREF: "/api/instances/System::" + sysID + "/relationships/ProtectionDomain",
+		},
+	}
+	return sys, done
+}
+
+func TestForeignSnapshots(t *testing.T) {
+	self := func(id string) []*siotypes.Link {
+		return []*siotypes.Link{{
+			Rel: "self", HREF: "/api/instances/Volume::" + id}}
+	}
+	tv := &testVolumes{vols: []*siotypes.Volume{
+		{ID: "vol1", Name: "data", StoragePoolID: "sp1"},
+		// snapshots taken outside of the plugin, one of them named like
+		// a CSI snapshot
+		{ID: "snap1", Name: "nightly", AncestorVolumeID: "vol1",
+			StoragePoolID: "sp1", Links: self("snap1")},
+		{ID: "snap2", Name: "data_0123456789abcdef", AncestorVolumeID: "vol1",
+			StoragePoolID: "sp1", Links: self("snap2")},
+	}}
+	var lists int32
+	gw := newTestCreateGateway("sys1", tv)
+	sys, done := newTestSystem(t, "sys1", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet &&
+				r.URL.Path == "/api/types/Volume/instances" {
+				atomic.AddInt32(&lists, 1)
+			}
+			gw.ServeHTTP(w, r)
+		}))
+	defer done()
+	sys.system.System.Links = []*siotypes.Link{{
+		Rel:  "/api/System/relationship/ProtectionDomain",
+		HREF: "/api/instances/System::sys1/relationships/ProtectionDomain",
+	}}
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+	ctx := context.Background()
+
+	// they are listed neither as volumes, which takes a single request,
+	// nor as snapshots
+	vols, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, vols.Entries, 1) {
+		assert.Equal(t, "sys1-vol1", vols.Entries[0].Volume.Id)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&lists))
+
+	snaps, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, snaps.Entries)
+
+	// nor can they be deleted as either
+	for _, id := range []string{"sys1-snap1", "sys1-snap2"} {
+		_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = s.DeleteSnapshot(ctx,
+			&csi.DeleteSnapshotRequest{SnapshotId: id})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	assert.Len(t, tv.list(), 3)
+
+	// an imported snapshot is marked as a volume, and then managed as one
+	imp, err := s.ImportVolume(ctx, &ImportVolumeRequest{Volume: "nightly"})
+	assert.NoError(t, err)
+	assert.Equal(t, "sys1-snap1", imp.Volume.GetId())
+	assert.Equal(t, getMarkedVolumeName("", "nightly"), tv.list()[1].Name)
+
+	imp, err = s.ImportVolume(ctx, &ImportVolumeRequest{Volume: "nightly"})
+	assert.NoError(t, err)
+	assert.Equal(t, "sys1-snap1", imp.Volume.GetId())
+
+	vols, err = s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, vols.Entries, 2)
+
+	_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "sys1-snap1"})
+	assert.NoError(t, err)
+	assert.Len(t, tv.list(), 2)
+}
+
+func TestSnapshotGroupNames(t *testing.T) {
+	tv := &testVolumes{vols: []*siotypes.Volume{
+		{ID: "vol1", Name: "c1.data1", StoragePoolID: "sp1"},
+		{ID: "vol2", Name: "c1.data2", StoragePoolID: "sp1"},
+	}}
+	sys, done := newTestSnapshotSystem(t, "sys1", tv)
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+	s.opts.VolumeNamePrefix = "c1"
+	s.opts.PrefixedVolumesOnly = true
+
+	// long CO names are translated like the names of other snapshots
+	req := &CreateSnapshotGroupRequest{
+		Name:            "snapshot-0a8d5fb4-6c3c-11e8-9b5f-0050569b3d32",
+		SourceVolumeIds: []string{"sys1-vol2", "sys1-vol1"},
+	}
+	resp, err := s.CreateSnapshotGroup(context.Background(), req)
+	assert.NoError(t, err)
+	if !assert.Len(t, resp.Snapshots, 2) {
+		return
+	}
+	assert.Equal(t, "sys1-vol2", resp.Snapshots[0].SourceVolumeId)
+	assert.Equal(t, "sys1-vol1", resp.Snapshots[1].SourceVolumeId)
+	for i, snap := range tv.list()[2:] {
+		assert.Equal(t, s.getSnapshotGroupMemberName(req.Name, i), snap.Name)
+		assert.True(t, s.ownsVolume(snap), snap.Name)
+	}
+
+	// the group is found by the name of its first member when retried
+	again, err := s.CreateSnapshotGroup(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.SnapshotGroupId, again.SnapshotGroupId)
+	assert.Len(t, tv.list(), 4)
+
+	group, err := s.ListSnapshotGroup(context.Background(),
+		&ListSnapshotGroupRequest{SnapshotGroupId: resp.SnapshotGroupId})
+	assert.NoError(t, err)
+	assert.Len(t, group.Snapshots, 2)
+}
+
+func TestVolumesFromSnapshots(t *testing.T) {
+	tv := &testVolumes{vols: []*siotypes.Volume{{
+		ID:            "vol1",
+		Name:          "c1.data",
+		StoragePoolID: "sp1",
+		SizeInKb:      16 * kiBytesInGiB,
+	}}}
+	sys, done := newTestSnapshotSystem(t, "sys1", tv)
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+	s.opts.VolumeNamePrefix = "c1"
+
+	snapResp, err := s.CreateSnapshot(context.Background(),
+		&csi.CreateSnapshotRequest{
+			Name:           "snap-1",
+			SourceVolumeId: "sys1-vol1",
+		})
+	assert.NoError(t, err)
+	snapID := snapResp.GetSnapshot().GetId()
+
+	// restored volumes are ScaleIO snapshots of the snapshot, even when
+	// their CO name looks like the name of a CSI snapshot
+	restore := func(name string) string {
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name:       name,
+				Parameters: map[string]string{KeyStoragePool: "pool1"},
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{
+							Id: snapID,
+						},
+					},
+				},
+			})
+		assert.NoError(t, err)
+		return resp.GetVolume().GetId()
+	}
+	restored := []string{
+		restore("restored"),
+		restore("a_0123456789abcdef"),
+	}
+	for _, v := range tv.list()[2:] {
+		assert.NotEmpty(t, v.AncestorVolumeID)
+		assert.False(t, isCSISnapshot(v), v.Name)
+	}
+
+	// the restored volumes are listed as volumes, and not as snapshots
+	vols, err := s.ListVolumes(context.Background(),
+		&csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	var volIDs []string
+	for _, e := range vols.Entries {
+		volIDs = append(volIDs, e.Volume.Id)
+	}
+	assert.ElementsMatch(t, append([]string{"sys1-vol1"}, restored...), volIDs)
+
+	snaps, err := s.ListSnapshots(context.Background(),
+		&csi.ListSnapshotsRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, snaps.Entries, 1) {
+		assert.Equal(t, snapID, snaps.Entries[0].Snapshot.Id)
+	}
+	for _, id := range restored {
+		snaps, err = s.ListSnapshots(context.Background(),
+			&csi.ListSnapshotsRequest{SnapshotId: id})
+		assert.NoError(t, err)
+		assert.Empty(t, snaps.Entries)
+	}
+
+	// a restored volume cannot be deleted as a snapshot, nor a snapshot
+	// as a volume
+	for _, id := range restored {
+		_, err = s.DeleteSnapshot(context.Background(),
+			&csi.DeleteSnapshotRequest{SnapshotId: id})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	_, err = s.DeleteVolume(context.Background(),
+		&csi.DeleteVolumeRequest{VolumeId: snapID})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Len(t, tv.list(), 4)
+
+	// nor can a volume be restored from a restored volume
+	_, err = s.CreateVolume(context.Background(),
+		&csi.CreateVolumeRequest{
+			Name:       "restored-again",
+			Parameters: map[string]string{KeyStoragePool: "pool1"},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{
+						Id: restored[0],
+					},
+				},
+			},
+		})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCloneVolume(t *testing.T) {
+	tv := &testVolumes{vols: []*siotypes.Volume{
+		{ID: "vol1", Name: "c1.data", StoragePoolID: "sp1",
+			SizeInKb: 16 * kiBytesInGiB},
+		{ID: "vol2", Name: "c1.logs", StoragePoolID: "sp1",
+			SizeInKb: 16 * kiBytesInGiB},
+	}}
+	sys, done := newTestSnapshotSystem(t, "sys1", tv)
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+	s.opts.VolumeNamePrefix = "c1"
+
+	clone := func(name, srcID string) (*csi.Volume, error) {
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name: name,
+				Parameters: map[string]string{
+					KeyStoragePool:    "pool1",
+					KeySourceVolumeID: srcID,
+				},
+			})
+		return resp.GetVolume(), err
+	}
+
+	vi, err := clone("copy", "sys1-vol1")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 16*bytesInGiB, vi.GetCapacityBytes())
+	if assert.Len(t, tv.list(), 3) {
+		c := tv.list()[2]
+		assert.Equal(t, "sys1-"+c.ID, vi.GetId())
+		assert.Equal(t, getMarkedVolumeName("c1", "copy"), c.Name)
+		assert.True(t, isCSIVolume(c), c.Name)
+		assert.Equal(t, "vol1", c.AncestorVolumeID)
+	}
+
+	// a retried request returns the same clone, but the name cannot be
+	// reused for a clone of another volume
+	again, err := clone("copy", "sys1-vol1")
+	assert.NoError(t, err)
+	assert.Equal(t, vi.GetId(), again.GetId())
+	assert.Len(t, tv.list(), 3)
+	_, err = clone("copy", "sys1-vol2")
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// the clone is listed as a volume, and not as a snapshot of its source
+	snapResp, err := s.CreateSnapshot(context.Background(),
+		&csi.CreateSnapshotRequest{
+			Name:           "snap-1",
+			SourceVolumeId: "sys1-vol1",
+		})
+	assert.NoError(t, err)
+
+	vols, err := s.ListVolumes(context.Background(),
+		&csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	var volIDs []string
+	for _, e := range vols.Entries {
+		volIDs = append(volIDs, e.Volume.Id)
+	}
+	assert.ElementsMatch(t,
+		[]string{"sys1-vol1", "sys1-vol2", vi.GetId()}, volIDs)
+
+	snaps, err := s.ListSnapshots(context.Background(),
+		&csi.ListSnapshotsRequest{SourceVolumeId: "sys1-vol1"})
+	assert.NoError(t, err)
+	if assert.Len(t, snaps.Entries, 1) {
+		assert.Equal(t, snapResp.GetSnapshot().GetId(),
+			snaps.Entries[0].Snapshot.Id)
+	}
+
+	_, err = s.DeleteSnapshot(context.Background(),
+		&csi.DeleteSnapshotRequest{SnapshotId: vi.GetId()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// snapshots are not cloned as volumes
+	_, err = clone("snap-copy", snapResp.GetSnapshot().GetId())
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the error of the Gateway is wrapped by goscaleio
+	_, err = clone("other", "sys1-missing")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestImportPrefixedVolume(t *testing.T) {
+	tv := &testVolumes{vols: []*siotypes.Volume{
+		{ID: "vol1", Name: "legacy1", StoragePoolID: "sp1",
+			SizeInKb: 16 * kiBytesInGiB,
+			Links: []*siotypes.Link{{
+				Rel:  "self",
+				HREF: "/api/instances/Volume::vol1",
+			}}},
+		{ID: "vol2", Name: "legacy2", StoragePoolID: "sp1",
+			SizeInKb: 16 * kiBytesInGiB},
+		{ID: "vol3", Name: "c1.data", StoragePoolID: "sp1",
+			SizeInKb: 16 * kiBytesInGiB},
+	}}
+	sys, done := newTestSnapshotSystem(t, "sys1", tv)
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+	s.opts.VolumeNamePrefix = "c1"
+	s.opts.PrefixedVolumesOnly = true
+
+	listIDs := func() []string {
+		resp, err := s.ListVolumes(context.Background(),
+			&csi.ListVolumesRequest{})
+		assert.NoError(t, err)
+		var ids []string
+		for _, e := range resp.Entries {
+			ids = append(ids, e.Volume.Id)
+		}
+		return ids
+	}
+	assert.ElementsMatch(t, []string{"sys1-vol3"}, listIDs())
+
+	// the volume is renamed with the prefix, and found by either name when
+	// the request is retried
+	for _, ref := range []string{"legacy1", "legacy1", "c1.legacy1"} {
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name:       "pvc-1",
+				Parameters: map[string]string{KeyImportVolume: ref},
+			})
+		assert.NoError(t, err)
+		assert.Equal(t, "sys1-vol1", resp.GetVolume().GetId())
+		assert.Equal(t, "c1.legacy1",
+			resp.GetVolume().GetAttributes()[AttributeKeyVolumeName])
+	}
+
+	// so is a volume returned by the extension method
+	resp, err := s.ImportVolume(context.Background(), &ImportVolumeRequest{
+		Volume: "vol2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "c1.legacy2",
+		resp.Volume.GetAttributes()[AttributeKeyVolumeName])
+
+	// volumes named with the prefix keep their names
+	_, err = s.ImportVolume(context.Background(), &ImportVolumeRequest{
+		Volume: "c1.data",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "c1.data", tv.list()[2].Name)
+
+	// the imported volumes are listed, and can be deleted
+	assert.ElementsMatch(t,
+		[]string{"sys1-vol1", "sys1-vol2", "sys1-vol3"}, listIDs())
+	_, err = s.DeleteVolume(context.Background(),
+		&csi.DeleteVolumeRequest{VolumeId: "sys1-vol1"})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"sys1-vol2", "sys1-vol3"}, listIDs())
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	tv := &testVolumes{vols: []*siotypes.Volume{{
+		ID:            "vol1",
+		Name:          "data",
+		StoragePoolID: "sp1",
+		SizeInKb:      16 * kiBytesInGiB,
+	}}}
+	sys, done := newTestSnapshotSystem(t, "sys1", tv)
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+
+	expand := func(
+		gib int64, vc *csi.VolumeCapability) (*ControllerExpandVolumeResponse, error) {
+
+		return s.ControllerExpandVolume(context.Background(),
+			&ControllerExpandVolumeRequest{
+				VolumeId:         "sys1-vol1",
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: gib * bytesInGiB},
+				VolumeCapability: vc,
+			})
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+	}
+
+	// node expansion is required for volumes that are not known to be
+	// block volumes, whether or not they are mapped
+	resp, err := expand(20, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 24*bytesInGiB, resp.CapacityBytes)
+	assert.True(t, resp.NodeExpansionRequired)
+	assert.EqualValues(t, 24*kiBytesInGiB, tv.list()[0].SizeInKb)
+
+	resp, err = expand(24, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 24*bytesInGiB, resp.CapacityBytes)
+	assert.True(t, resp.NodeExpansionRequired)
+
+	resp, err = expand(32, block)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 32*bytesInGiB, resp.CapacityBytes)
+	assert.False(t, resp.NodeExpansionRequired)
+
+	// volumes are never shrunk
+	resp, err = expand(8, block)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 32*bytesInGiB, resp.CapacityBytes)
+	assert.EqualValues(t, 32*kiBytesInGiB, tv.list()[0].SizeInKb)
+}
+
+func TestSnapshotNames(t *testing.T) {
+	snap := getSnapshotName("c1", "snap-1")
+	assert.True(t, isSnapshotName(snap), snap)
+	assert.True(t, strings.HasPrefix(snap, "c1.snap-1_"), snap)
+	assert.Equal(t, snap, getSnapshotName("c1", "snap-1"))
+
+	long := getSnapshotName("c1", "snapshot-0a8d5fb4-6c3c-11e8-9b5f")
+	assert.True(t, isSnapshotName(long), long)
+	assert.Len(t, long, maxVolumeNameLen)
+
+	// volume names are never marked as snapshot names
+	for _, name := range []string{
+		"snap-1",
+		"a_0123456789abcdef",
+		"a_0123456789abcdef_0123456789abcdef",
+		snap,
+	} {
+		v := getVolumeName("c1", name)
+		assert.False(t, isSnapshotName(v), v)
+		assert.True(t, isValidVolumeName(v), v)
+	}
+	assert.False(t, isSnapshotName("a_0123456789ABCDEF"))
+	assert.False(t, isSnapshotName("_0123456789abcde"))
+
+	// the mark is checked, not only the shape of the name
+	assert.False(t, isSnapshotName("c2"+snap[2:]), snap)
+	assert.False(t, isMarkedName(snap, volumeNameHashSeparator), snap)
+	assert.True(t, isMarkedName(
+		getMarkedVolumeName("c1", "snap-1"), volumeNameHashSeparator))
+}
+
+func TestStoragePoolParameters(t *testing.T) {
+	tv := &testVolumes{}
+	sys, done := newTestSystem(t, "sys1", newTestCreateGateway("sys1", tv))
+	defer done()
+	sys.system.System.Links = []*siotypes.Link{{
+		Rel:  "/api/System/relationship/ProtectionDomain",
+		HREF: "/api/instances/System::sys1/relationships/ProtectionDomain",
+	}}
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+
+	create := func(name string, params map[string]string) (
+		*csi.Volume, error) {
+
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name:       name,
+				Parameters: params,
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 8 * bytesInGiB,
+				},
+			})
+		return resp.GetVolume(), err
+	}
+
+	tests := []struct {
+		params map[string]string
+		spID   string
+		pdID   string
+		code   codes.Code
+	}{
+		{
+			params: map[string]string{KeyStoragePool: "pool1"},
+			spID:   "sp1",
+			pdID:   "pd1id",
+		},
+		{
+			params: map[string]string{
+				KeyStoragePool:      "pool2",
+				KeyProtectionDomain: "pd2",
+			},
+			spID: "sp3",
+			pdID: "pd2id",
+		},
+		{
+			params: map[string]string{KeyStoragePoolID: "sp2"},
+			spID:   "sp2",
+			pdID:   "pd1id",
+		},
+		{
+			params: map[string]string{
+				KeyStoragePoolID:    "sp3",
+				KeyStoragePool:      "pool2",
+				KeyProtectionDomain: "pd2",
+			},
+			spID: "sp3",
+			pdID: "pd2id",
+		},
+		{
+			// the name is used in both protection domains
+			params: map[string]string{KeyStoragePool: "pool2"},
+			code:   codes.InvalidArgument,
+		},
+		{
+			params: map[string]string{KeyStoragePool: "missing"},
+			code:   codes.InvalidArgument,
+		},
+		{
+			params: map[string]string{KeyProtectionDomain: "pd1"},
+			code:   codes.InvalidArgument,
+		},
+		{
+			params: map[string]string{
+				KeyStoragePoolID:    "sp2",
+				KeyProtectionDomain: "pd2",
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+	for i, tt := range tests {
+		vi, err := create(fmt.Sprintf("vol%d", i), tt.params)
+		if tt.code != codes.OK {
+			assert.Equal(t, tt.code, status.Code(err), "test %d", i)
+			continue
+		}
+		if !assert.NoError(t, err, "test %d", i) {
+			continue
+		}
+		p := tv.lastParam()
+		assert.Equal(t, tt.spID, p.StoragePoolID, "test %d", i)
+		assert.Equal(t, tt.pdID, p.ProtectionDomainID, "test %d", i)
+		assert.Equal(t, tt.spID,
+			vi.GetAttributes()[AttributeKeyStoragePoolID], "test %d", i)
+		assert.Equal(t, tt.pdID,
+			vi.GetAttributes()[AttributeKeyProtectionDomainID], "test %d", i)
+	}
+
+	// a retried request finds the volume in the requested pool
+	vi, err := create("vol1", map[string]string{
+		KeyStoragePool:      "pool2",
+		KeyProtectionDomain: "pd2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "sys1-v2", vi.GetId())
+	_, err = create("vol1", map[string]string{KeyStoragePoolID: "sp2"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestStoragePoolPlacement(t *testing.T) {
+	tv := &testVolumes{}
+	sys, done := newTestSystem(t, "sys1", newTestCreateGateway("sys1", tv))
+	defer done()
+	sys.system.System.Links = []*siotypes.Link{{
+		Rel:  "/api/System/relationship/ProtectionDomain",
+		HREF: "/api/instances/System::sys1/relationships/ProtectionDomain",
+	}}
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+
+	create := func(name string, params map[string]string, sizeGiB int64) (
+		*csi.Volume, error) {
+
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name:       name,
+				Parameters: params,
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: sizeGiB * bytesInGiB,
+				},
+			})
+		return resp.GetVolume(), err
+	}
+	poolID := func(vi *csi.Volume) string {
+		return vi.GetAttributes()[AttributeKeyStoragePoolID]
+	}
+
+	// sp2 has the most available capacity, then sp3, then sp1
+	vi, err := create("auto1", map[string]string{
+		KeyStoragePool: StoragePoolAuto,
+	}, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "sp2", poolID(vi))
+
+	vi, err = create("auto2", map[string]string{
+		KeyStoragePool:      StoragePoolAuto,
+		KeyProtectionDomain: "pd2",
+	}, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "sp3", poolID(vi))
+
+	vi, err = create("list1", map[string]string{
+		KeyStoragePool:      "pool1, pool2",
+		KeyProtectionDomain: "pd1",
+	}, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "sp2", poolID(vi))
+
+	// pools without room for the volume are skipped
+	_, err = create("auto3", map[string]string{
+		KeyStoragePool: StoragePoolAuto,
+	}, 400)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// the requested capacity is rounded up before it is compared, as sp1
+	// has 100GiB available
+	_, err = create("rounded", map[string]string{KeyStoragePool: "pool1,"}, 97)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = create("auto4", map[string]string{
+		KeyStoragePool:   StoragePoolAuto,
+		KeyStoragePoolID: "sp1",
+	}, 8)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a retried request finds the volume where it was placed
+	vi, err = create("placed", map[string]string{KeyStoragePool: "pool1"}, 8)
+	assert.NoError(t, err)
+	vi, err = create("placed", map[string]string{
+		KeyStoragePool: StoragePoolAuto,
+	}, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "sp1", poolID(vi))
+
+	// the default storage pool of the system is used without parameters
+	_, err = create("default1", nil, 8)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	sys.StoragePool = StoragePoolAuto
+	vi, err = create("default1", nil, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "sp2", poolID(vi))
+
+	// but not when the topology requirements name protection domains
+	sys.StoragePool = "pool1"
+	resp, err := s.CreateVolume(context.Background(),
+		&csi.CreateVolumeRequest{
+			Name: "default2",
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{
+					Segments: map[string]string{
+						TopologyKeySystemPrefix + "sys1":          topologySegmentTrue,
+						TopologyKeyProtectionDomainPrefix + "pd2": topologySegmentTrue,
+					},
+				}},
+			},
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "sp3", poolID(resp.GetVolume()))
+
+	// the pools of the protection domains are selected by capacity too
+	resp, err = s.CreateVolume(context.Background(),
+		&csi.CreateVolumeRequest{
+			Name: "default3",
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{
+					Segments: map[string]string{
+						TopologyKeySystemPrefix + "sys1":          topologySegmentTrue,
+						TopologyKeyProtectionDomainPrefix + "pd1": topologySegmentTrue,
+					},
+				}},
+			},
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "sp2", poolID(resp.GetVolume()))
+
+	capResp, err := s.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{KeyStoragePool: StoragePoolAuto},
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 300*bytesInGiB, capResp.GetAvailableCapacity())
+}
+
+func TestVolumeTunables(t *testing.T) {
+	tv := &testVolumes{vols: []*siotypes.Volume{{
+		ID:            "legacy",
+		Name:          "legacy1",
+		StoragePoolID: "sp1",
+		VolumeType:    thinProvisioned,
+		SizeInKb:      8 * kiBytesInGiB,
+	}}}
+	sys, done := newTestSystem(t, "sys1", newTestCreateGateway("sys1", tv))
+	defer done()
+	sys.system.System.Links = []*siotypes.Link{{
+		Rel:  "/api/System/relationship/ProtectionDomain",
+		HREF: "/api/instances/System::sys1/relationships/ProtectionDomain",
+	}}
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+
+	create := func(params map[string]string) (*csi.Volume, error) {
+		params[KeyStoragePool] = "pool1"
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name:       "vol1",
+				Parameters: params,
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 8 * bytesInGiB,
+				},
+			})
+		return resp.GetVolume(), err
+	}
+
+	_, err := create(map[string]string{KeyRmCache: "yes"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	vi, err := create(map[string]string{KeyRmCache: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", tv.lastParam().UseRmCache)
+	assert.Equal(t, "true", vi.GetAttributes()[AttributeKeyRmCache])
+
+	// a retried request must ask for the settings of the existing volume
+	vi, err = create(map[string]string{KeyRmCache: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, "sys1-v2", vi.GetId())
+	_, err = create(map[string]string{KeyRmCache: "false"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = create(map[string]string{KeyThickProvisioning: "true"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = s.ImportVolume(context.Background(), &ImportVolumeRequest{
+		Volume:     "legacy1",
+		Parameters: map[string]string{KeyRmCache: "true"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// volumes created from a source keep the settings of their source
+	n := len(tv.list())
+	_, err = create(map[string]string{
+		KeyRmCache:        "false",
+		KeySourceVolumeID: "sys1-legacy",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "vol2",
+		Parameters: map[string]string{
+			KeyStoragePool: "pool1",
+			KeyRmCache:     "false",
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					Id: "sys1-legacy",
+				},
+			},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Len(t, tv.list(), n)
+}
+
+func TestGetVolumeName(t *testing.T) {
+	pvName := "pvc-0a8d5fb4-6c3c-11e8-9b5f-0050569b3d32"
+	hashed := getVolumeName("", pvName)
+	assert.Len(t, hashed, maxVolumeNameLen)
+	assert.True(t, strings.HasPrefix(hashed, "pvc-0a8d5fb4-6-"), hashed)
+	assert.True(t, isValidVolumeName(hashed))
+
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+	}{
+		// valid names that fit are kept
+		{"", "myvol", "myvol"},
+		{"k8s", "myvol", "k8s.myvol"},
+		// the name is deterministic
+		{"", pvName, hashed},
+		// names that only differ past the truncation differ by hash
+		{"", pvName[:len(pvName)-1] + "3", ""},
+		// invalid characters are replaced
+		{"", "my vol/1", ""},
+		{"k8s", pvName, ""},
+	}
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		got := getVolumeName(tt.prefix, tt.name)
+		assert.True(t, len(got) <= maxVolumeNameLen, got)
+		assert.True(t, isValidVolumeName(got), got)
+		assert.True(t, strings.HasPrefix(got, volumeNamePrefix(tt.prefix)), got)
+		if tt.want != "" {
+			assert.Equal(t, tt.want, got)
+			continue
+		}
+		assert.False(t, seen[got], got)
+		seen[got] = true
+	}
+	assert.True(t, strings.HasPrefix(
+		getVolumeName("", "my vol/1"), "my_vol_1-"))
+
+	assert.NoError(t, validateVolumeNamePrefix("k8s-prod_1"))
+	assert.Error(t, validateVolumeNamePrefix("k8s.prod"))
+	assert.Error(t, validateVolumeNamePrefix("k8s prod"))
+	assert.Error(t, validateVolumeNamePrefix("kubernetes-prod"))
+}
+
+func TestVolumeNameTemplate(t *testing.T) {
+	s := &service{opts: Opts{
+		VolumeNamePrefix:   "c1",
+		VolumeNameTemplate: "{cluster}-{namespace}-{pvcname}",
+	}}
+	params := map[string]string{
+		"cluster":                          "east",
+		"csi.storage.k8s.io/pvc/namespace": "db",
+		"csi.storage.k8s.io/pvc/name":      "www",
+	}
+
+	// the hash of the CO name is appended to expanded templates that fit
+	name, err := s.getCreateVolumeName("pvc-1", params, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "c1.east-db-www-"+name[len(name)-volumeNameHashLen-volumeNameMarkLen:], name)
+
+	// so CO names that expand to the same name get different volumes
+	s.opts.VolumeNameTemplate = "{cluster}-{namespace}"
+	name, err = s.getCreateVolumeName("pvc-1", params, false)
+	assert.NoError(t, err)
+	other, err := s.getCreateVolumeName("pvc-2", params, false)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(name, "c1.east-db-"), name)
+	assert.NotEqual(t, name, other)
+	s.opts.VolumeNameTemplate = "{cluster}-{namespace}-{pvcname}"
+
+	// and to names that do not fit, which are truncated
+	params["csi.storage.k8s.io/pvc/name"] = "postgres-primary-data"
+	name, err = s.getCreateVolumeName("pvc-1", params, false)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(name, "c1.east-db-pos-"), name)
+	assert.Len(t, name, maxVolumeNameLen)
+	other, err = s.getCreateVolumeName("pvc-2", params, false)
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, other)
+
+	// the template may be given in the parameters, and its invalid
+	// characters are replaced
+	params[KeyVolumeNameTemplate] = "{namespace} {name}"
+	name, err = s.getCreateVolumeName("pvc-1", params, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "c1.db_pvc-1-"+name[len(name)-volumeNameHashLen-volumeNameMarkLen:], name)
+
+	params[KeyVolumeNameTemplate] = "{cluster}-{zone}"
+	_, err = s.getCreateVolumeName("pvc-1", params, false)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	for _, tmpl := range []string{"{cluster", "cluster}", "{}", "{a{b}}"} {
+		assert.Error(t, validateVolumeNameTemplate(tmpl), tmpl)
+	}
+	assert.NoError(t, validateVolumeNameTemplate("{cluster}-{name}"))
+}
+
+func TestVolumeNameTemplateCollision(t *testing.T) {
+	tv := &testVolumes{}
+	sys, done := newTestSnapshotSystem(t, "sys1", tv)
+	defer done()
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+	s.opts.VolumeNamePrefix = "c1"
+	s.opts.VolumeNameTemplate = "{cluster}-{namespace}"
+
+	// both claims expand to the same name, but must not share a volume
+	var ids []string
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		resp, err := s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name: name,
+				Parameters: map[string]string{
+					KeyStoragePool:                     "pool1",
+					"cluster":                          "east",
+					"csi.storage.k8s.io/pvc/namespace": "db",
+				},
+			})
+		if !assert.NoError(t, err) {
+			return
+		}
+		ids = append(ids, resp.GetVolume().GetId())
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+	assert.Len(t, tv.list(), 2)
+}
+
+func TestPrefixedVolumesOnly(t *testing.T) {
+	vols := []*siotypes.Volume{
+		{ID: "vol1", Name: "c1.data", StoragePoolID: "sp1"},
+		{ID: "vol2", Name: "c2.data", StoragePoolID: "sp1"},
+		{ID: "vol3", Name: "c12.data", StoragePoolID: "sp1"},
+		{ID: "snap1", Name: getSnapshotName("c2", "snap"), StoragePoolID: "sp1",
+			AncestorVolumeID: "vol2", ConsistencyGroupID: "cg1"},
+	}
+	sys, done := newTestSystem(t, "sys1", newTestGateway("sys1",
+		func() []*siotypes.Volume { return vols }))
+	defer done()
+	sys.system.System.Links = []*siotypes.Link{{
+		Rel:  "/api/System/relationship/ProtectionDomain",
+		HREF: "/api/instances/System::sys1/relationships/ProtectionDomain",
+	}}
+
+	s := New().(*service)
+	s.systems = []*scaleioSystem{sys}
+	s.opts.VolumeNamePrefix = "c1"
+	s.opts.PrefixedVolumesOnly = true
+
+	// the prefix must be followed by its separator, so that "c1" does not
+	// claim the volumes of "c12"
+	resp, err := s.ListVolumes(context.Background(),
+		&csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, resp.Entries, 1) {
+		assert.Equal(t, "sys1-vol1", resp.Entries[0].Volume.Id)
+	}
+
+	for _, id := range []string{"sys1-vol2", "sys1-vol3"} {
+		_, err = s.DeleteVolume(context.Background(),
+			&csi.DeleteVolumeRequest{VolumeId: id})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), id)
+
+		_, err = s.ControllerPublishVolume(context.Background(),
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   "node1",
+			})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), id)
+
+		_, err = s.ControllerUnpublishVolume(context.Background(),
+			&csi.ControllerUnpublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   "node1",
+			})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), id)
+
+		_, err = s.ControllerExpandVolume(context.Background(),
+			&ControllerExpandVolumeRequest{
+				VolumeId: id,
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 32 * bytesInGiB,
+				},
+			})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), id)
+
+		// the volumes of others are not snapshotted or cloned either
+		_, err = s.CreateSnapshot(context.Background(),
+			&csi.CreateSnapshotRequest{
+				Name:           "snap-" + id,
+				SourceVolumeId: id,
+			})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), id)
+
+		_, err = s.CreateVolume(context.Background(),
+			&csi.CreateVolumeRequest{
+				Name: "clone-" + id,
+				Parameters: map[string]string{
+					KeyStoragePool:    "pool1",
+					KeySourceVolumeID: id,
+				},
+			})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), id)
+
+		_, err = s.CreateSnapshotGroup(context.Background(),
+			&CreateSnapshotGroupRequest{
+				Name:            "group-" + id,
+				SourceVolumeIds: []string{"sys1-vol1", id},
+			})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), id)
+	}
+
+	_, err = s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "restore",
+		Parameters: map[string]string{KeyStoragePool: "pool1"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					Id: "sys1-snap1",
+				},
+			},
+		},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = s.DeleteSnapshotGroup(context.Background(),
+		&DeleteSnapshotGroupRequest{SnapshotGroupId: "sys1-cg1"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	group, err := s.ListSnapshotGroup(context.Background(),
+		&ListSnapshotGroupRequest{SnapshotGroupId: "sys1-cg1"})
+	assert.NoError(t, err)
+	assert.Empty(t, group.Snapshots)
+
+	// all volumes are managed otherwise
+	s.opts.PrefixedVolumesOnly = false
+	resp, err = s.ListVolumes(context.Background(),
+		&csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 3)
+
+	group, err = s.ListSnapshotGroup(context.Background(),
+		&ListSnapshotGroupRequest{SnapshotGroupId: "sys1-cg1"})
+	assert.NoError(t, err)
+	assert.Len(t, group.Snapshots, 1)
+}
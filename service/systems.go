@@ -0,0 +1,631 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// KeySystemName is the key used to get the name of the ScaleIO system
+	// to create a volume in from the volume create parameters map. The
+	// default system is used when it is not given.
+	KeySystemName = "systemname"
+
+	// volumeIDSeparator separates the ID of the ScaleIO system from the ID
+	// of the ScaleIO volume in the volume IDs returned by the plugin
+	volumeIDSeparator = "-"
+)
+
+// SystemConfig defines the configuration of a ScaleIO system managed by the
+// plugin, and of the Gateway used to manage it
+type SystemConfig struct {
+	SystemName string `json:"systemName"`
+	// Endpoint is a comma-separated list of the endpoints of the Gateways
+	// of the system
+	Endpoint string `json:"endpoint"`
+	// EndpointPolicy is the policy used to choose the Gateway endpoint
+	// that serves a request, EndpointPolicyFailover or
+	// EndpointPolicyRoundRobin
+	EndpointPolicy string `json:"endpointPolicy"`
+	User           string `json:"user"`
+	Password       string `json:"password"`
+	// UserFile and PasswordFile are the paths of files that the user name
+	// and password are read from instead, and reloaded when they change
+	UserFile     string `json:"userFile"`
+	PasswordFile string `json:"passwordFile"`
+	Insecure     bool   `json:"insecure"`
+	TLSOpts
+	// StoragePool is the storage pool that volumes are created in when
+	// the volume create parameters name none. It may be StoragePoolAuto or
+	// a comma-separated list of candidate pools.
+	StoragePool string `json:"storagePool"`
+	// Default marks the system used when a request does not name one, and
+	// for volume IDs that do not include a system ID
+	Default bool `json:"default"`
+}
+
+// scaleioSystem holds the Gateway client and the caches of a ScaleIO system
+type scaleioSystem struct {
+	SystemConfig
+	creds  *credentialsSource
+	client *sio.Client
+	system *sio.System
+	*systemCaches
+}
+
+// systemCaches are the caches of a ScaleIO system. They are shared by the
+// copies of a system that are bound to a context.
+type systemCaches struct {
+	sdcMap    map[string]string
+	sdcMapRWL sync.RWMutex
+	// spCache holds the storage pools, keyed by the reference they were
+	// looked up with
+	spCache    map[poolRef]*siotypes.StoragePool
+	spCacheRWL sync.RWMutex
+	// poolInfo holds the details of the storage pools, keyed by ID
+	poolInfo    map[string]poolInfo
+	poolInfoRWL sync.RWMutex
+}
+
+func newScaleIOSystem(cfg SystemConfig) *scaleioSystem {
+	return &scaleioSystem{
+		SystemConfig: cfg,
+		systemCaches: &systemCaches{
+			sdcMap:   map[string]string{},
+			spCache:  map[poolRef]*siotypes.StoragePool{},
+			poolInfo: map[string]poolInfo{},
+		},
+	}
+}
+
+// withContext returns a copy of the system whose Gateway requests are sent
+// with the values of the given context, so that they are traced as part of
+// the RPC they are sent for. The system is returned as is when tracing is
+// not enabled, or it has not been probed yet.
+func (sys *scaleioSystem) withContext(ctx context.Context) *scaleioSystem {
+	if defaultTracer == nil || sys.client == nil || sys.system == nil {
+		return sys
+	}
+
+	// The requests are not canceled with the RPC, as Gateway requests are
+	// not otherwise canceled
+	client := *sys.client
+	client.Http.Transport = &contextTransport{
+		ctx: detachedContext{parent: ctx},
+		rt:  sys.client.Http.Transport,
+	}
+
+	bound := *sys
+	bound.client = &client
+	bound.system = sio.NewSystem(&client)
+	bound.system.System = sys.system.System
+	return &bound
+}
+
+// readSystemsFile reads the configuration of the ScaleIO systems from the
+// JSON file at the given path. The file holds an array of SystemConfig
+// objects.
+func readSystemsFile(path string) ([]SystemConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []SystemConfig
+	if err := json.Unmarshal(b, &cfgs); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err.Error())
+	}
+	return cfgs, nil
+}
+
+// getSystemConfigs returns the configuration of the systems to manage. If no
+// systems are configured, the system defined by the Endpoint, User, Password,
+// SystemName, Insecure, StoragePool and related options is the only, and
+// default, system.
+func (opts Opts) getSystemConfigs() []SystemConfig {
+	if len(opts.Systems) == 0 {
+		return []SystemConfig{
+			SystemConfig{
+				SystemName:     opts.SystemName,
+				Endpoint:       opts.Endpoint,
+				EndpointPolicy: opts.EndpointPolicy,
+				User:           opts.User,
+				Password:       opts.Password,
+				UserFile:       opts.UserFile,
+				PasswordFile:   opts.PasswordFile,
+				Insecure:       opts.Insecure,
+				TLSOpts:        opts.TLS,
+				StoragePool:    opts.StoragePool,
+				Default:        true,
+			},
+		}
+	}
+
+	cfgs := make([]SystemConfig, len(opts.Systems))
+	copy(cfgs, opts.Systems)
+
+	// The first system is the default if none is marked as such
+	hasDefault := false
+	for i := range cfgs {
+		if cfgs[i].User == "" {
+			cfgs[i].User = "admin"
+		}
+		hasDefault = hasDefault || cfgs[i].Default
+	}
+	if !hasDefault {
+		cfgs[0].Default = true
+	}
+	return cfgs
+}
+
+// probe logs in to the Gateway of the system and looks up the system, if it
+// has not been done yet
+func (sys *scaleioSystem) probe() error {
+
+	// Check that we have the details needed to login to the Gateway
+	if sys.Endpoint == "" {
+		return status.Error(codes.FailedPrecondition,
+			"missing ScaleIO Gateway endpoint")
+	}
+
+	// Read the credentials, if needed
+	if sys.creds == nil {
+		creds, err := newCredentialsSource(
+			sys.User, sys.Password, sys.UserFile, sys.PasswordFile)
+		if err != nil {
+			return status.Errorf(codes.FailedPrecondition,
+				"unable to read ScaleIO MDM credentials: %s", err.Error())
+		}
+		sys.creds = creds
+	}
+	creds := sys.creds.get()
+	if creds.user == "" {
+		return status.Error(codes.FailedPrecondition,
+			"missing ScaleIO MDM user")
+	}
+	if creds.password == "" {
+		return status.Error(codes.FailedPrecondition,
+			"missing ScaleIO MDM password")
+	}
+	if sys.SystemName == "" {
+		return status.Error(codes.FailedPrecondition,
+			"missing ScaleIO system name")
+	}
+
+	// Create our ScaleIO API client, if needed
+	if sys.client == nil {
+		eps, err := parseEndpoints(sys.Endpoint)
+		if err != nil || len(eps) == 0 {
+			return status.Errorf(codes.FailedPrecondition,
+				"invalid ScaleIO Gateway endpoint: %s", sys.Endpoint)
+		}
+
+		// The client is created for the first endpoint, and its requests
+		// are redirected to the other endpoints by the transport
+		c, err := sio.NewClientWithArgs(
+			eps[0].String(), "", sys.Insecure, true)
+		if err != nil {
+			return status.Errorf(codes.FailedPrecondition,
+				"unable to create ScaleIO client: %s", err.Error())
+		}
+
+		// Each endpoint has its own session, which is re-authenticated
+		// transparently when it expires
+		base := c.Http.Transport
+		if sys.TLSOpts.configured() {
+			if base, err = newTLSTransport(
+				sys.TLSOpts, sys.Insecure); err != nil {
+				return status.Errorf(codes.FailedPrecondition,
+					"invalid ScaleIO Gateway TLS configuration: %s",
+					err.Error())
+			}
+		}
+		ft, err := newFailoverTransport(eps, sys.EndpointPolicy,
+			func(u *url.URL) http.RoundTripper {
+				return newAuthTransport(base, *u, sys.creds)
+			})
+		if err != nil {
+			return status.Errorf(codes.FailedPrecondition,
+				"unable to create ScaleIO client: %s", err.Error())
+		}
+		c.Http.Transport = ft
+		sys.client = c
+	}
+
+	if sys.client.Token == "" {
+		_, err := sys.client.Authenticate(&sio.ConfigConnect{
+			Endpoint: sys.Endpoint,
+			Username: creds.user,
+			Password: creds.password,
+		})
+		if err != nil {
+			return status.Errorf(codes.FailedPrecondition,
+				"unable to login to ScaleIO Gateway: %s", err.Error())
+
+		}
+	}
+
+	if sys.system == nil {
+		system, err := sys.client.FindSystem(
+			"", sys.SystemName, "")
+		if err != nil {
+			return status.Errorf(codes.FailedPrecondition,
+				"unable to find matching ScaleIO system name: %s",
+				err.Error())
+		}
+		sys.system = system
+
+		log.WithFields(log.Fields{
+			"systemName": sys.SystemName,
+			"systemID":   sys.id(),
+			"endpoint":   sys.Endpoint,
+		}).Info("found ScaleIO system")
+	}
+
+	return nil
+}
+
+// id returns the ID of the system. The system must have been probed.
+func (sys *scaleioSystem) id() string {
+	return sys.system.System.ID
+}
+
+// newVolumeID returns the plugin's ID for a volume, which includes the ID of
+// the system of the volume
+func newVolumeID(systemID, volID string) string {
+	return systemID + volumeIDSeparator + volID
+}
+
+// splitVolumeID returns the system ID and ScaleIO volume ID of a volume ID
+// returned by the plugin. Volume IDs returned by older versions of the
+// plugin are just the ScaleIO volume ID, and the returned system ID is empty.
+func splitVolumeID(id string) (string, string) {
+	if i := strings.Index(id, volumeIDSeparator); i >= 0 {
+		return id[:i], id[i+len(volumeIDSeparator):]
+	}
+	return "", id
+}
+
+// getDefaultSystem returns the default system
+func (s *service) getDefaultSystem() *scaleioSystem {
+	for _, sys := range s.systems {
+		if sys.Default {
+			return sys
+		}
+	}
+	return s.systems[0]
+}
+
+// requireSystem checks that the given system has been probed, probing it
+// now if AutoProbe is enabled, and returns it bound to the given context.
+// Only the system a request targets has to be reachable.
+func (s *service) requireSystem(
+	ctx context.Context, sys *scaleioSystem) (*scaleioSystem, error) {
+
+	if sys.system == nil {
+		if !s.opts.AutoProbe {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"ScaleIO system: %s has not been probed", sys.SystemName)
+		}
+		log.WithField("systemName", sys.SystemName).Debug(
+			"probing ScaleIO system automatically")
+		if err := sys.probe(); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"failed to probe ScaleIO system: %s: %s",
+				sys.SystemName, status.Convert(err).Message())
+		}
+	}
+	return sys.withContext(ctx), nil
+}
+
+// getSystemByName returns the system with the given name, or the default
+// system if the name is empty, bound to the given context
+func (s *service) getSystemByName(
+	ctx context.Context, name string) (*scaleioSystem, error) {
+
+	if name == "" {
+		return s.requireSystem(ctx, s.getDefaultSystem())
+	}
+	for _, sys := range s.systems {
+		if sys.SystemName == name {
+			return s.requireSystem(ctx, sys)
+		}
+	}
+	return nil, status.Errorf(codes.InvalidArgument,
+		"unknown ScaleIO system: %s", name)
+}
+
+// getSystemForID returns the system of the given volume, snapshot or
+// snapshot group ID, bound to the given context, and the ScaleIO ID of the
+// object within the system. The ID of a system is only known once it has
+// been probed, so the systems that have not been are probed when no probed
+// system matches and AutoProbe is enabled.
+func (s *service) getSystemForID(
+	ctx context.Context, id string) (*scaleioSystem, string, error) {
+
+	sysID, objID := splitVolumeID(id)
+	if sysID == "" {
+		sys, err := s.requireSystem(ctx, s.getDefaultSystem())
+		return sys, objID, err
+	}
+	for _, sys := range s.systems {
+		if sys.system != nil && sys.id() == sysID {
+			return sys.withContext(ctx), objID, nil
+		}
+	}
+
+	var unprobed []string
+	for _, sys := range s.systems {
+		if sys.system != nil {
+			continue
+		}
+		if _, err := s.requireSystem(ctx, sys); err != nil {
+			unprobed = append(unprobed, sys.SystemName)
+			continue
+		}
+		if sys.id() == sysID {
+			return sys.withContext(ctx), objID, nil
+		}
+	}
+	if len(unprobed) > 0 {
+		return nil, "", status.Errorf(codes.FailedPrecondition,
+			"unknown ScaleIO system: %s, systems not probed: %s",
+			sysID, strings.Join(unprobed, ", "))
+	}
+	return nil, "", status.Errorf(codes.NotFound,
+		"unknown ScaleIO system: %s", sysID)
+}
+
+func (sys *scaleioSystem) getVolByID(id string) (*siotypes.Volume, error) {
+
+	// The `GetVolume` API returns a slice of volumes, but when only passing
+	// in a volume ID, the response will be just the one volume
+	vols, err := sys.client.GetVolume("", id, "", "", false)
+	if err != nil {
+		return nil, err
+	}
+	return vols[0], nil
+}
+
+func (sys *scaleioSystem) getSDCID(sdcGUID string) (string, error) {
+	sdcGUID = strings.ToUpper(sdcGUID)
+
+	// check if ID is already in cache
+	f := func() string {
+		sys.sdcMapRWL.RLock()
+		defer sys.sdcMapRWL.RUnlock()
+
+		if id, ok := sys.sdcMap[sdcGUID]; ok {
+			return id
+		}
+		return ""
+	}
+	id := f()
+	defaultMetrics.observeCacheLookup("sdc", id != "")
+	if id != "" {
+		return id, nil
+	}
+
+	// Need to translate sdcGUID to sdcID
+	sdc, err := sys.system.FindSdc("SdcGuid", sdcGUID)
+	if err != nil {
+		return "", fmt.Errorf("error finding SDC from GUID: %s, err: %s",
+			sdcGUID, err.Error())
+	}
+
+	sys.sdcMapRWL.Lock()
+	defer sys.sdcMapRWL.Unlock()
+
+	sys.sdcMap[sdcGUID] = sdc.Sdc.ID
+
+	return sdc.Sdc.ID, nil
+}
+
+// poolRef identifies a storage pool from the volume create parameters: by
+// ID, or by name, optionally qualified by the name of its protection domain.
+// Pools of different protection domains may have the same name.
+type poolRef struct {
+	id     string
+	name   string
+	pdName string
+}
+
+// getPoolRef returns the storage pool named by the given parameters
+func getPoolRef(params map[string]string) poolRef {
+	return poolRef{
+		id:     params[KeyStoragePoolID],
+		name:   params[KeyStoragePool],
+		pdName: params[KeyProtectionDomain],
+	}
+}
+
+// isEmpty returns whether the parameters name no storage pool
+func (r poolRef) isEmpty() bool {
+	return r.id == "" && r.name == "" && r.pdName == ""
+}
+
+// validate checks that the parameters name a storage pool
+func (r poolRef) validate() error {
+	if r.pdName != "" && r.id == "" && r.name == "" {
+		return status.Errorf(codes.InvalidArgument,
+			"`%s` requires `%s` or `%s`",
+			KeyProtectionDomain, KeyStoragePool, KeyStoragePoolID)
+	}
+	return nil
+}
+
+func (r poolRef) String() string {
+	if r.id != "" {
+		return r.id
+	}
+	if r.pdName != "" {
+		return r.pdName + "/" + r.name
+	}
+	return r.name
+}
+
+// getStoragePool looks up the storage pool named by the given reference.
+// A pool that is only named must be the only one with that name in the
+// system. The pools are cached by reference.
+func (sys *scaleioSystem) getStoragePool(
+	r poolRef) (*siotypes.StoragePool, error) {
+
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	// check if the pool is already in cache
+	f := func() *siotypes.StoragePool {
+		sys.spCacheRWL.RLock()
+		defer sys.spCacheRWL.RUnlock()
+
+		return sys.spCache[r]
+	}
+	pool := f()
+	defaultMetrics.observeCacheLookup("storagepool", pool != nil)
+	if pool != nil {
+		return pool, nil
+	}
+
+	// Need to lookup the pool from the gateway
+	var err error
+	switch {
+	case r.id != "":
+		pool, err = sys.findStoragePoolByID(r)
+	case r.pdName != "":
+		pool, err = sys.findStoragePoolInDomain(r.pdName, r.name)
+	default:
+		pool, err = sys.findStoragePoolByName(r.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sys.spCacheRWL.Lock()
+	defer sys.spCacheRWL.Unlock()
+	sys.spCache[r] = pool
+
+	return pool, nil
+}
+
+// findStoragePoolByID looks up a storage pool by ID, and checks that it has
+// the name and protection domain of the reference, if any
+func (sys *scaleioSystem) findStoragePoolByID(
+	r poolRef) (*siotypes.StoragePool, error) {
+
+	pool, err := sys.client.FindStoragePool(r.id, "", "")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to look up storage pool: %s, err: %s",
+			r.id, err.Error())
+	}
+	if r.name != "" && pool.Name != r.name {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"storage pool: %s is named: %s, not: %s",
+			r.id, pool.Name, r.name)
+	}
+	if r.pdName != "" {
+		pd, err := sys.system.FindProtectionDomain("", r.pdName, "")
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"unable to look up protection domain: %s, err: %s",
+				r.pdName, err.Error())
+		}
+		if pool.ProtectionDomainID != pd.ID {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"storage pool: %s is not in protection domain: %s",
+				r.id, r.pdName)
+		}
+	}
+	return pool, nil
+}
+
+// findStoragePoolInDomain looks up a storage pool by name within the named
+// protection domain
+func (sys *scaleioSystem) findStoragePoolInDomain(
+	pdName, name string) (*siotypes.StoragePool, error) {
+
+	pd, err := sys.system.FindProtectionDomain("", pdName, "")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to look up protection domain: %s, err: %s",
+			pdName, err.Error())
+	}
+	pool, err := sio.NewProtectionDomainEx(sys.client, pd).FindStoragePool(
+		"", name, "")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to look up storage pool: %s in protection domain: %s, err: %s",
+			name, pdName, err.Error())
+	}
+	return pool, nil
+}
+
+// findStoragePoolByName looks up a storage pool by name across the system.
+// The name is ambiguous when pools of several protection domains have it.
+func (sys *scaleioSystem) findStoragePoolByName(
+	name string) (*siotypes.StoragePool, error) {
+
+	pools, err := sys.client.GetStoragePool("")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to look up storage pool: %s, err: %s",
+			name, err.Error())
+	}
+
+	var found *siotypes.StoragePool
+	for _, pool := range pools {
+		if pool.Name != name {
+			continue
+		}
+		if found != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"storage pool: %s exists in several protection domains, "+
+					"use `%s` or `%s` to select one",
+				name, KeyProtectionDomain, KeyStoragePoolID)
+		}
+		found = pool
+	}
+	if found == nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"storage pool: %s not found", name)
+	}
+	return found, nil
+}
+
+// getCreateSystem returns the system to create a volume in. This is the
+// system named by the parameters, or else the system of the source of the
+// volume, or else the default system. The system is bound to the given
+// context.
+func (s *service) getCreateSystem(
+	ctx context.Context,
+	req *csi.CreateVolumeRequest) (*scaleioSystem, error) {
+
+	params := req.GetParameters()
+	if name, ok := params[KeySystemName]; ok {
+		return s.getSystemByName(ctx, name)
+	}
+
+	srcID := params[KeySourceVolumeID]
+	if snap := req.GetVolumeContentSource().GetSnapshot(); snap != nil {
+		srcID = snap.GetId()
+	}
+	if srcID != "" {
+		sys, _, err := s.getSystemForID(ctx, srcID)
+		return sys, err
+	}
+
+	return s.requireSystem(ctx, s.getDefaultSystem())
+}
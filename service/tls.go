@@ -0,0 +1,262 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certPinPrefix is the optional prefix of a certificate pin
+const certPinPrefix = "sha256//"
+
+// TLSOpts defines how the connections to a ScaleIO Gateway are secured
+type TLSOpts struct {
+	// CACerts is the path of a PEM file of the CA certificates that the
+	// Gateway's certificate is verified with
+	CACerts string `json:"caCerts"`
+	// ClientCert and ClientKey are the paths of the PEM files of the
+	// certificate, and its key, presented to the Gateway
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+	// CertPins are the base64 encoded SHA-256 hashes of the public keys,
+	// in DER encoded SubjectPublicKeyInfo form, that are accepted in the
+	// verified certificate chain of the Gateway, or for the Gateway's own
+	// certificate when the chain is not verified. They may be prefixed by
+	// "sha256//".
+	CertPins []string `json:"certPins"`
+}
+
+// configured returns whether any TLS option is set
+func (o TLSOpts) configured() bool {
+	return o.CACerts != "" || o.ClientCert != "" || o.ClientKey != "" ||
+		len(o.CertPins) > 0
+}
+
+// files returns the paths of the files that the TLS options refer to
+func (o TLSOpts) files() []string {
+	var files []string
+	for _, f := range []string{o.CACerts, o.ClientCert, o.ClientKey} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// parseCertPins decodes certificate pins
+func parseCertPins(pins []string) ([][]byte, error) {
+	var hashes [][]byte
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), certPinPrefix)
+		if pin == "" {
+			continue
+		}
+		h, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin: %s", pin)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// newTLSConfig returns the TLS configuration defined by the options, reading
+// the files they refer to
+func newTLSConfig(o TLSOpts, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	if o.CACerts != "" {
+		pem, err := ioutil.ReadFile(o.CACerts)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf(
+				"no certificates found in CA bundle: %s", o.CACerts)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.ClientCert != "" || o.ClientKey != "" {
+		if o.ClientCert == "" || o.ClientKey == "" {
+			return nil, errors.New(
+				"both a client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	pins, err := parseCertPins(o.CertPins)
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) > 0 {
+		// Pins are checked even if the chain is not verified, so that
+		// pinning alone can secure a Gateway with a self-signed
+		// certificate
+		cfg.VerifyPeerCertificate = func(
+			rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyCertPins(rawCerts, verifiedChains, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// verifyCertPins checks that the public key of a certificate of one of the
+// verified chains matches one of the pins. When the chain is not verified,
+// only the leaf certificate is checked, as the other certificates presented
+// by the peer are not proven to be related to it.
+func verifyCertPins(
+	rawCerts [][]byte,
+	verifiedChains [][]*x509.Certificate,
+	pins [][]byte) error {
+
+	var certs []*x509.Certificate
+	if len(verifiedChains) > 0 {
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+	} else {
+		if len(rawCerts) == 0 {
+			return errors.New("ScaleIO Gateway presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	for _, cert := range certs {
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if string(h[:]) == string(pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("ScaleIO Gateway certificate does not match any pin")
+}
+
+// tlsTransport is an http.RoundTripper that secures the connections to a
+// Gateway as defined by TLS options. The files that the options refer to
+// are checked for changes before every request, and reloaded when they
+// change, so that rotated certificates are used without a restart.
+type tlsTransport struct {
+	opts     TLSOpts
+	insecure bool
+
+	rtRWL  sync.RWMutex
+	rt     *http.Transport
+	mtimes map[string]time.Time
+}
+
+func newTLSTransport(o TLSOpts, insecure bool) (*tlsTransport, error) {
+	t := &tlsTransport{
+		opts:     o,
+		insecure: insecure,
+	}
+	mtimes, err := t.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.load(mtimes); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// modTimes returns the modification times of the files of the options
+func (t *tlsTransport) modTimes() (map[string]time.Time, error) {
+	mtimes := map[string]time.Time{}
+	for _, f := range t.opts.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		mtimes[f] = fi.ModTime()
+	}
+	return mtimes, nil
+}
+
+// load creates the underlying transport from the current files
+func (t *tlsTransport) load(mtimes map[string]time.Time) error {
+	cfg, err := newTLSConfig(t.opts, t.insecure)
+	if err != nil {
+		return err
+	}
+	rt := &http.Transport{
+		TLSHandshakeTimeout: 120 * time.Second,
+		TLSClientConfig:     cfg,
+	}
+
+	t.rtRWL.Lock()
+	defer t.rtRWL.Unlock()
+	if t.rt != nil {
+		t.rt.CloseIdleConnections()
+	}
+	t.rt = rt
+	t.mtimes = mtimes
+	return nil
+}
+
+// changed returns whether a file has changed since it was loaded
+func (t *tlsTransport) changed(mtimes map[string]time.Time) bool {
+	t.rtRWL.RLock()
+	defer t.rtRWL.RUnlock()
+	for f, mt := range mtimes {
+		if !mt.Equal(t.mtimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reloads the files if they have changed. If the files cannot be
+// loaded, the previous configuration is kept.
+func (t *tlsTransport) reload() {
+	mtimes, err := t.modTimes()
+	if err != nil {
+		log.WithError(err).Warn("unable to check ScaleIO Gateway TLS files")
+		return
+	}
+	if !t.changed(mtimes) {
+		return
+	}
+	if err := t.load(mtimes); err != nil {
+		log.WithError(err).Error(
+			"unable to reload ScaleIO Gateway TLS files, keeping previous")
+		return
+	}
+	log.WithField("files", t.opts.files()).Info(
+		"reloaded ScaleIO Gateway TLS files")
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *tlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.reload()
+
+	t.rtRWL.RLock()
+	rt := t.rt
+	t.rtRWL.RUnlock()
+
+	return rt.RoundTrip(req)
+}
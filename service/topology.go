@@ -0,0 +1,311 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"sort"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	"github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// TopologyKeySystemPrefix is the prefix of the topology segment keys
+	// that indicate that a node is connected to a ScaleIO system. The key
+	// of a system is the prefix followed by the ID of the system, and the
+	// value of the segment is "true".
+	TopologyKeySystemPrefix = Name + "/system-"
+
+	// TopologyKeyProtectionDomainPrefix is the prefix of the topology
+	// segment keys that indicate that a node can reach the SDSs of a
+	// protection domain. The key of a protection domain is the prefix
+	// followed by the name of the protection domain, and the value of the
+	// segment is "true".
+	TopologyKeyProtectionDomainPrefix = Name + "/pd-"
+
+	topologySegmentTrue = "true"
+)
+
+// poolTopology describes where the volumes of a storage pool are accessible
+type poolTopology struct {
+	systemKey string
+	pdKey     string
+}
+
+// satisfies returns whether volumes in the pool are accessible from nodes in
+// the given topology. Only segments that belong to this plugin are
+// considered. When the topology names any systems or protection domains, the
+// pool's system and protection domain must be among them.
+func (pt poolTopology) satisfies(t *csi.Topology) bool {
+	var hasSys, hasPD, sysOK, pdOK bool
+	for k, v := range t.GetSegments() {
+		switch {
+		case strings.HasPrefix(k, TopologyKeySystemPrefix):
+			hasSys = true
+			if k == pt.systemKey && v == topologySegmentTrue {
+				sysOK = true
+			}
+		case strings.HasPrefix(k, TopologyKeyProtectionDomainPrefix):
+			hasPD = true
+			if k == pt.pdKey && v == topologySegmentTrue {
+				pdOK = true
+			}
+		}
+	}
+	return (!hasSys || sysOK) && (!hasPD || pdOK)
+}
+
+// accessibleTopology returns the accessible topology of volumes in the pool.
+// The protection domain segment is only included if the topology the volume
+// is created for makes use of protection domain segments, as nodes do not
+// report them unless configured to.
+func (pt poolTopology) accessibleTopology(t *csi.Topology) []*csi.Topology {
+	segs := map[string]string{
+		pt.systemKey: topologySegmentTrue,
+	}
+	if t != nil && len(topologyPDNames(t)) > 0 {
+		segs[pt.pdKey] = topologySegmentTrue
+	}
+	return []*csi.Topology{&csi.Topology{Segments: segs}}
+}
+
+// topologyPDNames returns the names of the protection domains in the given
+// topology, in sorted order
+func topologyPDNames(t *csi.Topology) []string {
+	var names []string
+	for k, v := range t.GetSegments() {
+		if strings.HasPrefix(k, TopologyKeyProtectionDomainPrefix) &&
+			v == topologySegmentTrue {
+			names = append(names,
+				strings.TrimPrefix(k, TopologyKeyProtectionDomainPrefix))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// orderedTopologies returns the preferred topologies of the requirements,
+// followed by the requisite ones
+func orderedTopologies(reqs *csi.TopologyRequirement) []*csi.Topology {
+	var topos []*csi.Topology
+	topos = append(topos, reqs.GetPreferred()...)
+	topos = append(topos, reqs.GetRequisite()...)
+	return topos
+}
+
+// namesProtectionDomains returns whether any preferred or requisite topology
+// of the requirements names a protection domain
+func namesProtectionDomains(reqs *csi.TopologyRequirement) bool {
+	for _, t := range orderedTopologies(reqs) {
+		if len(topologyPDNames(t)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getPoolTopology looks up the protection domain of the given storage pool
+func (sys *scaleioSystem) getPoolTopology(
+	pool *siotypes.StoragePool) (poolTopology, error) {
+
+	pd, err := sys.system.FindProtectionDomain(pool.ProtectionDomainID, "", "")
+	if err != nil {
+		return poolTopology{}, status.Errorf(codes.Internal,
+			"unable to look up protection domain of storage pool: %s, err: %s",
+			pool.Name, err.Error())
+	}
+
+	return poolTopology{
+		systemKey: TopologyKeySystemPrefix + sys.id(),
+		pdKey:     TopologyKeyProtectionDomainPrefix + pd.Name,
+	}, nil
+}
+
+// getVolumeTopology checks that volumes in the given storage pool satisfy
+// the topology requirements, and returns the accessible topology of a volume
+// in the pool
+func (sys *scaleioSystem) getVolumeTopology(
+	pool *siotypes.StoragePool,
+	reqs *csi.TopologyRequirement) ([]*csi.Topology, error) {
+
+	pt, err := sys.getPoolTopology(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	topos := orderedTopologies(reqs)
+	if len(topos) == 0 {
+		return pt.accessibleTopology(nil), nil
+	}
+
+	for _, t := range topos {
+		if pt.satisfies(t) {
+			return pt.accessibleTopology(t), nil
+		}
+	}
+
+	return nil, status.Errorf(codes.ResourceExhausted,
+		"storage pool: %s is not accessible from the requested topology",
+		pool.Name)
+}
+
+// selectStoragePool picks a storage pool from the protection domains named
+// by the topology requirements. As for a selection of storage pools, a
+// retried request keeps the pool of the existing volume or of its source.
+// Otherwise, the preferred topologies are tried first, and among the pools
+// of the protection domains of a topology, the pool is selected by
+// selectPoolByCapacity.
+func (s *service) selectStoragePool(
+	ctx context.Context,
+	sys *scaleioSystem,
+	name string,
+	req *csi.CreateVolumeRequest) (*siotypes.StoragePool, error) {
+
+	sizeInKiB, err := validateVolSize(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := req.GetAccessibilityRequirements()
+	topos := orderedTopologies(reqs)
+	candidates := make([][]*siotypes.StoragePool, len(topos))
+	for i, t := range topos {
+		if candidates[i], err = sys.getTopologyPools(t); err != nil {
+			return nil, err
+		}
+	}
+
+	if spID := s.getPlacedPoolID(ctx, sys, name, req); spID != "" {
+		for _, pools := range candidates {
+			for _, pool := range pools {
+				if pool.ID == spID {
+					return pool, nil
+				}
+			}
+		}
+	}
+
+	for _, pools := range candidates {
+		if len(pools) == 0 {
+			continue
+		}
+		pool, err := sys.selectPoolByCapacity(pools, sizeInKiB, reqs)
+		if err == nil {
+			return pool, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.ResourceExhausted,
+		"no storage pool with %d KiB available is accessible from the "+
+			"requested topology", sizeInKiB)
+}
+
+// getTopologyPools returns the storage pools of the protection domains of
+// this system that are named by the given topology
+func (sys *scaleioSystem) getTopologyPools(
+	t *csi.Topology) ([]*siotypes.StoragePool, error) {
+
+	pt := poolTopology{systemKey: TopologyKeySystemPrefix + sys.id()}
+
+	var pools []*siotypes.StoragePool
+	for _, pdName := range topologyPDNames(t) {
+		pt.pdKey = TopologyKeyProtectionDomainPrefix + pdName
+		if !pt.satisfies(t) {
+			continue
+		}
+
+		pd, err := sys.system.FindProtectionDomain("", pdName, "")
+		if err != nil {
+			log.WithError(err).WithField("protectionDomain", pdName).Debug(
+				"unable to find protection domain from topology")
+			continue
+		}
+		pdPools, err := goscaleio.NewProtectionDomainEx(
+			sys.client, pd).GetStoragePool("")
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"unable to list storage pools of protection domain: %s, err: %s",
+				pdName, err.Error())
+		}
+		pools = append(pools, pdPools...)
+	}
+
+	return pools, nil
+}
+
+// getNodeTopology returns the topology segments of this node: the ScaleIO
+// systems that its SDC is connected to, and the configured protection
+// domains
+func (s *service) getNodeTopology() (*csi.Topology, error) {
+	mdmIDs, err := s.getMdmIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	segs := map[string]string{}
+	for _, id := range mdmIDs {
+		segs[TopologyKeySystemPrefix+id] = topologySegmentTrue
+	}
+	for _, pd := range s.opts.ProtectionDomains {
+		segs[TopologyKeyProtectionDomainPrefix+pd] = topologySegmentTrue
+	}
+
+	return &csi.Topology{Segments: segs}, nil
+}
+
+// getMdmIDs returns the IDs of the MDMs, and thereby the systems, that the
+// SDC is connected to. The IDs are retrieved once, and then cached.
+func (s *service) getMdmIDs() ([]string, error) {
+	s.mdmIDsRWL.RLock()
+	ids := s.mdmIDs
+	s.mdmIDsRWL.RUnlock()
+	if len(ids) > 0 {
+		return ids, nil
+	}
+
+	out, err := exec.Command(drvCfg, "--query_mdms").CombinedOutput()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"error getting SDC MDMs: %s", err.Error())
+	}
+
+	ids = parseMdmIDs(out)
+	if len(ids) == 0 {
+		return nil, status.Error(codes.FailedPrecondition,
+			"SDC is not connected to any MDM")
+	}
+
+	s.mdmIDsRWL.Lock()
+	defer s.mdmIDsRWL.Unlock()
+	s.mdmIDs = ids
+
+	log.WithField("mdmIDs", ids).Info("set SDC MDM IDs")
+
+	return ids, nil
+}
+
+// parseMdmIDs parses the output of `drv_cfg --query_mdms`, which contains
+// a line of the form "MDM-ID <id> SDC ID <id> ..." per MDM
+func parseMdmIDs(out []byte) []string {
+	var ids []string
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		words := strings.Fields(sc.Text())
+		for i := 0; i < len(words)-1; i++ {
+			if words[i] == "MDM-ID" {
+				ids = append(ids, words[i+1])
+				break
+			}
+		}
+	}
+
+	return ids
+}
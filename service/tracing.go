@@ -0,0 +1,527 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	csictx "github.com/rexray/gocsi/context"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/core"
+)
+
+const (
+	// Span kinds, as defined by OTLP
+	spanKindServer = 2
+	spanKindClient = 3
+
+	// spanStatusError is the OTLP status code of a failed span
+	spanStatusError = 2
+
+	// traceParentKey is the W3C Trace Context header, and gRPC metadata key,
+	// that the parent of the span of an RPC is read from
+	traceParentKey = "traceparent"
+
+	// traceExportInterval is how often ended spans are exported
+	traceExportInterval = 2 * time.Second
+
+	// traceQueueSize is the number of ended spans that can wait to be
+	// exported. Spans that end while the queue is full are dropped.
+	traceQueueSize = 4096
+
+	// otlpTracesPath is the path, under the OTLP endpoint, that spans are
+	// sent to
+	otlpTracesPath = "/v1/traces"
+)
+
+// defaultTracer is the tracer of the plugin. It is nil when tracing is not
+// enabled.
+var defaultTracer *tracer
+
+// spanExporter sends ended spans to a tracing backend, as an OTLP JSON
+// encoded ExportTraceServiceRequest
+type spanExporter interface {
+	export(req []byte) error
+}
+
+// tracer records spans, and exports them in batches
+type tracer struct {
+	exporter spanExporter
+	queue    chan *span
+
+	// stop stops the export loop, which closes stopped once it is done
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newTracer(exporter spanExporter) *tracer {
+	t := &tracer{
+		exporter: exporter,
+		queue:    make(chan *span, traceQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// run exports the ended spans periodically, until the tracer is shut down
+func (t *tracer) run() {
+	defer close(t.stopped)
+	tick := time.NewTicker(traceExportInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.flush()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// shutdown stops the export loop, and exports the spans that are still in
+// the queue, so that they are not lost when the plugin exits
+func (t *tracer) shutdown() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		<-t.stopped
+		t.flush()
+	})
+}
+
+// ShutdownTracing exports the spans that have not been exported yet, and
+// stops exporting spans. It is called when the plugin shuts down.
+func ShutdownTracing() {
+	if defaultTracer != nil {
+		defaultTracer.shutdown()
+	}
+}
+
+// flush exports the spans in the queue
+func (t *tracer) flush() {
+	var spans []*span
+loop:
+	for {
+		select {
+		case sp := <-t.queue:
+			spans = append(spans, sp)
+		default:
+			break loop
+		}
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	req, err := encodeSpans(spans)
+	if err == nil {
+		err = t.exporter.export(req)
+	}
+	if err != nil {
+		log.WithError(err).WithField("spans", len(spans)).Warn(
+			"unable to export trace spans")
+	}
+}
+
+// span is a timed operation of a trace
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+
+	statusCode    int
+	statusMessage string
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span stored in the context, if any
+func spanFromContext(ctx context.Context) *span {
+	if ctx == nil {
+		return nil
+	}
+	sp, _ := ctx.Value(spanContextKey{}).(*span)
+	return sp
+}
+
+// startSpan starts a span that is a child of the span stored in the context,
+// or a new trace otherwise, and returns a context that stores the new span.
+// It returns a nil span when tracing is not enabled.
+func startSpan(
+	ctx context.Context, name string, kind int) (context.Context, *span) {
+
+	if defaultTracer == nil {
+		return ctx, nil
+	}
+
+	sp := &span{
+		tracer: defaultTracer,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  map[string]interface{}{},
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		sp.traceID = parent.traceID
+		sp.parentID = parent.spanID
+	} else {
+		rand.Read(sp.traceID[:])
+	}
+	rand.Read(sp.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, sp), sp
+}
+
+func (sp *span) setAttr(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.attrs[key] = value
+}
+
+// setError marks the span as failed if err is not nil
+func (sp *span) setError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.statusCode = spanStatusError
+	sp.statusMessage = err.Error()
+}
+
+// finish ends the span, and queues it to be exported
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case sp.tracer.queue <- sp:
+	default:
+		log.WithField("span", sp.name).Debug(
+			"trace span queue full, dropping span")
+	}
+}
+
+// parseTraceParent parses a W3C Trace Context traceparent header into a
+// remote span, that only has a trace and span ID
+func parseTraceParent(tp string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(tp), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return nil, false
+	}
+	sp := &span{}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != len(sp.traceID) {
+		return nil, false
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || len(sid) != len(sp.spanID) {
+		return nil, false
+	}
+	copy(sp.traceID[:], tid)
+	copy(sp.spanID[:], sid)
+	if sp.traceID == ([16]byte{}) || sp.spanID == ([8]byte{}) {
+		return nil, false
+	}
+	return sp, true
+}
+
+// TracingInterceptor is a gRPC server interceptor that records a span for
+// every RPC. The parent of the span is read from the traceparent metadata
+// of the request, if any. The span records the GoCSI request ID, so it must
+// run after the GoCSI request ID injector.
+func TracingInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	if defaultTracer == nil {
+		return handler(ctx, req)
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if tp := md[traceParentKey]; len(tp) == 1 {
+			if parent, ok := parseTraceParent(tp[0]); ok {
+				ctx = context.WithValue(ctx, spanContextKey{}, parent)
+			}
+		}
+	}
+
+	svc, method := splitFullMethod(info.FullMethod)
+	ctx, sp := startSpan(ctx, strings.TrimPrefix(info.FullMethod, "/"),
+		spanKindServer)
+	defer sp.finish()
+	sp.setAttr("rpc.system", "grpc")
+	sp.setAttr("rpc.service", svc)
+	sp.setAttr("rpc.method", method)
+	if id, ok := csictx.GetRequestID(ctx); ok {
+		sp.setAttr("csi.request_id", int64(id))
+	}
+
+	rep, err := handler(ctx, req)
+	sp.setAttr("rpc.grpc.status_code", int64(status.Code(err)))
+	sp.setError(err)
+	return rep, err
+}
+
+// contextTransport is an http.RoundTripper that sends requests with a given
+// context. It binds the requests of a ScaleIO client, which does not take
+// contexts, to the RPC they are sent for.
+type contextTransport struct {
+	ctx context.Context
+	rt  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *contextTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+
+	return t.rt.RoundTrip(req.WithContext(t.ctx))
+}
+
+// detachedContext is a context that carries the values of its parent, but
+// is never canceled and has no deadline
+type detachedContext struct {
+	parent context.Context
+}
+
+// Deadline implements context.Context
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done implements context.Context
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err implements context.Context
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Value implements context.Context
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// startGatewaySpan starts the span of a request sent to a Gateway endpoint
+func startGatewaySpan(
+	req *http.Request, endpoint string) (context.Context, *span) {
+
+	ctx, sp := startSpan(req.Context(), "HTTP "+req.Method, spanKindClient)
+	sp.setAttr("http.request.method", req.Method)
+	sp.setAttr("url.path", req.URL.Path)
+	sp.setAttr("server.address", endpoint)
+	return ctx, sp
+}
+
+// finishGatewaySpan ends the span of a request sent to a Gateway endpoint
+func finishGatewaySpan(sp *span, resp *http.Response, err error) {
+	if sp == nil {
+		return
+	}
+	if err == nil {
+		sp.setAttr("http.response.status_code", int64(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			err = fmt.Errorf("unexpected response: %s", resp.Status)
+		}
+	}
+	sp.setError(err)
+	sp.finish()
+}
+
+// OTLP JSON encoding of spans
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+)
+
+func newOTLPKeyValue(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+// encodeSpans encodes spans as an OTLP JSON ExportTraceServiceRequest
+func encodeSpans(spans []*span) ([]byte, error) {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, sp := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(sp.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.spanID[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+			Status: otlpStatus{
+				Code:    sp.statusCode,
+				Message: sp.statusMessage,
+			},
+		}
+		if sp.parentID != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+		}
+		for k, v := range sp.attrs {
+			o.Attributes = append(o.Attributes, newOTLPKeyValue(k, v))
+		}
+		otlpSpans = append(otlpSpans, o)
+	}
+
+	return json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{
+					newOTLPKeyValue("service.name", Name),
+					newOTLPKeyValue("service.version", core.SemVer),
+				},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{
+					Name:    Name,
+					Version: core.SemVer,
+				},
+				Spans: otlpSpans,
+			}},
+		}},
+	})
+}
+
+// otlpExporter sends spans to an OTLP/HTTP endpoint, such as an
+// OpenTelemetry Collector, using the JSON encoding
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *otlpExporter) export(req []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response from %s: %s",
+			e.url, resp.Status)
+	}
+	return nil
+}
+
+// fileExporter appends spans to a file, one OTLP JSON encoded
+// ExportTraceServiceRequest per line, like the file exporter of the
+// OpenTelemetry Collector
+type fileExporter struct {
+	fileL sync.Mutex
+	file  *os.File
+}
+
+func newFileExporter(path string) (*fileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: f}, nil
+}
+
+func (e *fileExporter) export(req []byte) error {
+	e.fileL.Lock()
+	defer e.fileL.Unlock()
+	_, err := e.file.Write(append(req, '\n'))
+	return err
+}
+
+// newTraceExporter returns the exporter for the given OTLP endpoint, or else
+// the given file, or nil if neither is set
+func newTraceExporter(otlpEndpoint, path string) (spanExporter, error) {
+	switch {
+	case otlpEndpoint != "":
+		if !strings.HasPrefix(otlpEndpoint, "http://") &&
+			!strings.HasPrefix(otlpEndpoint, "https://") {
+			return nil, fmt.Errorf("invalid OTLP endpoint: %s", otlpEndpoint)
+		}
+		return newOTLPExporter(otlpEndpoint), nil
+	case path != "":
+		return newFileExporter(path)
+	}
+	return nil, nil
+}